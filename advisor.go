@@ -0,0 +1,475 @@
+package mdb
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	DefaultMinSelectivity = 0.1
+	DefaultMinExamined    = 100
+)
+
+//rangeOperators are the conditions placed after the sort fields of a suggested index
+var rangeOperators = map[string]bool{
+	"$gt": true, "$gte": true, "$lt": true, "$lte": true, "$ne": true, "$nin": true,
+	"$regex": true, "$exists": true, "$type": true, "$mod": true, "$not": true,
+}
+
+type AdvisorOptions struct {
+	//SampleRate is the fraction of the queries explained, all of them if zero.
+	//The first query of each shape is always explained.
+	SampleRate float64
+	//MinSelectivity is the ratio of returned to examined documents under which a plan is poorly selective,
+	//DefaultMinSelectivity if zero
+	MinSelectivity float64
+	//MinExamined is the number of examined documents from which the selectivity is checked,
+	//DefaultMinExamined if zero
+	MinExamined int
+}
+
+//IndexAdvisor explains the queries passing through its middleware and suggests indexes for the inefficient ones.
+//Every sampled query runs a second time as explain, so it is meant for development and tests.
+type IndexAdvisor struct {
+	opts    AdvisorOptions
+	mu      sync.Mutex
+	queries map[string]*advisedQuery
+}
+
+type advisedQuery struct {
+	advice     IndexAdvice
+	collection *Collection
+}
+
+//IndexAdvice is an inefficient query shape with the index suggested for it
+type IndexAdvice struct {
+	Namespace string
+	Kind      OpKind
+	//Shape is the filter or pipeline, see QueryShape
+	Shape string
+	Sort  []string
+	//Executions counts the queries of the shape, Explained the sampled ones
+	Executions int
+	Explained  int
+	//CollScan, InMemorySort and LowSelectivity are set if any explained plan scanned the collection,
+	//sorted in memory or examined too many documents for those returned
+	CollScan       bool
+	InMemorySort   bool
+	LowSelectivity bool
+	//DocsExamined and Returned are from the explained plan examining the most documents
+	DocsExamined int
+	Returned     int
+	//Suggested is the index key ordered by equality, sort and range fields,
+	//nil if the query has no usable fields, like a top-level $or
+	Suggested []string
+	//Existing is the name of an existing index starting with the suggested key,
+	//the query doesn't use it or it isn't selective enough
+	Existing string
+}
+
+func (a IndexAdvice) String() string {
+	var issues []string
+	if a.CollScan {
+		issues = append(issues, "collection scan")
+	}
+	if a.InMemorySort {
+		issues = append(issues, "in-memory sort")
+	}
+	if a.LowSelectivity {
+		issues = append(issues, fmt.Sprintf("examined %d for %d returned", a.DocsExamined, a.Returned))
+	}
+
+	s := fmt.Sprintf("%s %s %s", a.Kind, a.Namespace, a.Shape)
+	if len(a.Sort) > 0 {
+		s += " sort " + strings.Join(a.Sort, ",")
+	}
+	s += ": " + strings.Join(issues, ", ")
+
+	switch {
+	case a.Existing != "":
+		s += ", existing index " + a.Existing
+	case a.Suggested != nil:
+		s += ", suggested index " + strings.Join(a.Suggested, ",")
+	}
+
+	return s
+}
+
+//NewIndexAdvisor returns an advisor, its Middleware must be added to the session with Use
+func NewIndexAdvisor(opts AdvisorOptions) *IndexAdvisor {
+	if opts.SampleRate == 0 {
+		opts.SampleRate = 1
+	}
+	if opts.MinSelectivity == 0 {
+		opts.MinSelectivity = DefaultMinSelectivity
+	}
+	if opts.MinExamined == 0 {
+		opts.MinExamined = DefaultMinExamined
+	}
+
+	return &IndexAdvisor{opts: opts, queries: map[string]*advisedQuery{}}
+}
+
+//Middleware samples the finds, counts, distincts and aggregations
+func (a *IndexAdvisor) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(op *Operation) error {
+			err := next(op)
+			if err != nil || op.collection == nil {
+				return err
+			}
+
+			switch op.Kind {
+			case OpFind, OpCount, OpDistinct, OpAggregate:
+				a.sample(op)
+			}
+
+			return err
+		}
+	}
+}
+
+func (a *IndexAdvisor) sample(op *Operation) {
+	filter, shape := op.Filter, QueryShape(op.Filter)
+	order, _ := op.Options["sort"].([]string)
+	if op.Kind == OpAggregate {
+		filter, order = pipelineQuery(op.Options["pipeline"])
+		shape = QueryShape(op.Options["pipeline"])
+	}
+	key := string(op.Kind) + " " + op.DB + "." + op.Collection + " " + shape + " " + strings.Join(order, ",")
+
+	a.mu.Lock()
+	query, ok := a.queries[key]
+	if !ok {
+		query = &advisedQuery{
+			advice: IndexAdvice{
+				Namespace: op.DB + "." + op.Collection,
+				Kind:      op.Kind,
+				Shape:     shape,
+				Sort:      order,
+				Suggested: esrIndex(filter, order),
+			},
+			collection: op.collection,
+		}
+		a.queries[key] = query
+	}
+	query.advice.Executions++
+	explain := !ok || rand.Float64() < a.opts.SampleRate
+	a.mu.Unlock()
+
+	if !explain {
+		return
+	}
+
+	//explained past the middleware
+	var result bson.M
+	err := op.collection.session.execWithRetry(func() error {
+		if op.Kind == OpAggregate {
+			return op.collection.originCollection.Pipe(op.Options["pipeline"]).Explain(&result)
+		}
+		q := op.collection.originCollection.Find(op.Filter)
+		if len(order) > 0 {
+			q = q.Sort(order...)
+		}
+		return q.Explain(&result)
+	})
+	if err != nil {
+		return
+	}
+	plan := analyzePlan(result)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	advice := &query.advice
+	advice.Explained++
+	advice.CollScan = advice.CollScan || plan.collScan
+	advice.InMemorySort = advice.InMemorySort || plan.inMemorySort
+	if plan.examined >= a.opts.MinExamined && float64(plan.returned) < a.opts.MinSelectivity*float64(plan.examined) {
+		advice.LowSelectivity = true
+	}
+	if plan.examined >= advice.DocsExamined {
+		advice.DocsExamined, advice.Returned = plan.examined, plan.returned
+	}
+}
+
+//Report returns the inefficient query shapes, the most examined documents first,
+//with the suggested indexes compared to the existing ones
+func (a *IndexAdvisor) Report() ([]IndexAdvice, error) {
+	a.mu.Lock()
+	var (
+		report      []IndexAdvice
+		collections = map[string]*Collection{}
+	)
+	for _, query := range a.queries {
+		advice := query.advice
+		if !advice.CollScan && !advice.InMemorySort && !advice.LowSelectivity {
+			continue
+		}
+		report = append(report, advice)
+		collections[advice.Namespace] = query.collection
+	}
+	a.mu.Unlock()
+
+	existing := map[string][]mgo.Index{}
+	for namespace, c := range collections {
+		indexes, err := c.Indexes()
+		if err != nil && !IsNamespaceNotFound(err) {
+			return nil, err
+		}
+		existing[namespace] = indexes
+	}
+
+	for i := range report {
+		advice := &report[i]
+		if index, ok := indexWithPrefix(existing[advice.Namespace], advice.Suggested); ok {
+			advice.Existing = index.Name
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].DocsExamined != report[j].DocsExamined {
+			return report[i].DocsExamined > report[j].DocsExamined
+		}
+		return report[i].Shape < report[j].Shape
+	})
+
+	return report, nil
+}
+
+//pipelineQuery returns the filter of a leading $match and the order of the $sort following it
+func pipelineQuery(pipeline interface{}) (interface{}, []string) {
+	stages, err := pipelineStages(pipeline)
+	if err != nil {
+		return nil, nil
+	}
+
+	var filter interface{}
+	for _, stage := range stages {
+		operator, value, ok := stageOperator(stage)
+		switch {
+		case ok && operator == "$match" && filter == nil:
+			filter = value
+			continue
+		case ok && operator == "$sort":
+			return filter, sortOrder(value)
+		}
+		break
+	}
+
+	return filter, nil
+}
+
+//stageOperator returns the operator of a pipeline stage and its argument, keeping the order of a bson.D $sort
+func stageOperator(stage interface{}) (string, interface{}, bool) {
+	if d, ok := stage.(bson.D); ok {
+		if len(d) != 1 {
+			return "", nil, false
+		}
+		return d[0].Name, d[0].Value, true
+	}
+
+	doc, err := toM(stage)
+	if err != nil || len(doc) != 1 {
+		return "", nil, false
+	}
+	for operator, value := range doc {
+		return operator, value, true
+	}
+
+	return "", nil, false
+}
+
+//sortOrder converts a $sort document to the field list of Query.Sort,
+//the fields of a bson.M are sorted by name
+func sortOrder(spec interface{}) []string {
+	var order []string
+	if d, ok := spec.(bson.D); ok {
+		for _, e := range d {
+			order = append(order, sortField(e.Name, e.Value))
+		}
+		return order
+	}
+
+	doc, ok := genericBson(spec).(bson.M)
+	if !ok {
+		return nil
+	}
+	for _, field := range sortedFields(doc) {
+		order = append(order, sortField(field, doc[field]))
+	}
+
+	return order
+}
+
+func sortField(name string, direction interface{}) string {
+	if n, ok := numberValue(direction); ok && n < 0 {
+		return "-" + name
+	}
+
+	return name
+}
+
+//esrIndex returns the index key for filter and order, following the equality, sort, range rule
+func esrIndex(filter interface{}, order []string) []string {
+	var equality, ranges []string
+	ok := true
+	var collect func(filter interface{})
+	collect = func(filter interface{}) {
+		doc, isDoc := genericBson(filter).(bson.M)
+		if !isDoc {
+			return
+		}
+
+		for _, field := range sortedFields(doc) {
+			value := doc[field]
+			switch {
+			case field == "$and":
+				conditions, _ := value.([]interface{})
+				for _, condition := range conditions {
+					collect(condition)
+				}
+			case strings.HasPrefix(field, "$"):
+				//$or, $nor, $expr, $text and $where need other indexes
+				ok = false
+			case isRangeCondition(value):
+				ranges = append(ranges, field)
+			default:
+				equality = append(equality, field)
+			}
+		}
+	}
+	collect(filter)
+	if !ok {
+		return nil
+	}
+
+	var key []string
+	seen := map[string]bool{}
+	add := func(field, name string) {
+		if !seen[name] {
+			seen[name] = true
+			key = append(key, field)
+		}
+	}
+	for _, field := range equality {
+		add(field, field)
+	}
+	for _, field := range order {
+		add(field, sortFieldName(field))
+	}
+	for _, field := range ranges {
+		add(field, field)
+	}
+
+	return key
+}
+
+func isRangeCondition(value interface{}) bool {
+	doc, ok := value.(bson.M)
+	if !ok {
+		return false
+	}
+
+	for operator := range doc {
+		if rangeOperators[operator] {
+			return true
+		}
+	}
+
+	return false
+}
+
+//indexWithPrefix returns the first index whose key starts with prefix
+func indexWithPrefix(indexes []mgo.Index, prefix []string) (mgo.Index, bool) {
+	if len(prefix) == 0 {
+		return mgo.Index{}, false
+	}
+
+	for _, index := range indexes {
+		if len(index.Key) < len(prefix) {
+			continue
+		}
+		matches := true
+		for i, field := range prefix {
+			if strings.TrimPrefix(index.Key[i], "+") != field {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return index, true
+		}
+	}
+
+	return mgo.Index{}, false
+}
+
+type planSummary struct {
+	collScan     bool
+	inMemorySort bool
+	examined     int
+	returned     int
+}
+
+//analyzePlan walks the explain output of any server version: COLLSCAN and SORT stages,
+//or BasicCursor and scanAndOrder of legacy servers, and the documents examined and returned
+func analyzePlan(explain bson.M) planSummary {
+	var plan planSummary
+	statsFound := false
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case bson.M:
+			switch v["stage"] {
+			case "COLLSCAN":
+				plan.collScan = true
+			case "SORT":
+				plan.inMemorySort = true
+			}
+			if cursor, _ := v["cursor"].(string); strings.HasPrefix(cursor, "BasicCursor") {
+				plan.collScan = true
+			}
+			if scanAndOrder, _ := v["scanAndOrder"].(bool); scanAndOrder {
+				plan.inMemorySort = true
+			}
+
+			if stats, ok := v["executionStats"].(bson.M); ok && !statsFound {
+				statsFound = true
+				plan.examined = intValue(stats["totalDocsExamined"])
+				plan.returned = intValue(stats["nReturned"])
+			}
+			if _, ok := v["nscannedObjects"]; ok && !statsFound {
+				statsFound = true
+				plan.examined = intValue(v["nscannedObjects"])
+				plan.returned = intValue(v["n"])
+			}
+
+			//the rejected plans aren't run
+			for _, field := range sortedFields(v) {
+				if field != "rejectedPlans" && field != "allPlansExecution" {
+					walk(v[field])
+				}
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(explain)
+
+	return plan
+}
+
+func intValue(v interface{}) int {
+	n, _ := numberValue(v)
+	return int(n)
+}
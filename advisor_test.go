@@ -0,0 +1,94 @@
+package mdb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestEsrIndex(t *testing.T) {
+	tests := []struct {
+		filter interface{}
+		order  []string
+		key    []string
+	}{
+		{bson.M{"status": "a", "age": bson.M{"$gt": 30}}, []string{"-createdAt"}, []string{"status", "-createdAt", "age"}},
+		{bson.M{"$and": []interface{}{bson.M{"tags": bson.M{"$in": []string{"a"}}}, bson.M{"name": bson.M{"$regex": "^A"}}}}, nil, []string{"tags", "name"}},
+		{bson.M{"status": "a"}, []string{"status", "age"}, []string{"status", "age"}},
+		{bson.M{"$or": []interface{}{bson.M{"a": 1}, bson.M{"b": 1}}}, nil, nil},
+	}
+
+	for _, test := range tests {
+		if key := esrIndex(test.filter, test.order); !reflect.DeepEqual(key, test.key) {
+			t.Errorf("expected %v for %v, got %v", test.key, test.filter, key)
+		}
+	}
+
+	filter, order := pipelineQuery([]bson.D{{{"$match", bson.M{"a": 1}}}, {{"$sort", bson.D{{"z", -1}, {"b", 1}}}}})
+	if !reflect.DeepEqual(esrIndex(filter, order), []string{"a", "-z", "b"}) {
+		t.Errorf("unexpected pipeline query %v %v", filter, order)
+	}
+}
+
+func TestIndexAdvisor(t *testing.T) {
+	server := newFakeServer(t)
+	server.Handle(func(op *fakeOp) []bson.M {
+		if op.Options["$explain"] != nil {
+			stage := "IXSCAN"
+			if op.Query["status"] != nil {
+				stage = "COLLSCAN"
+			}
+			return []bson.M{{
+				"queryPlanner": bson.M{"winningPlan": bson.M{"stage": "SORT", "inputStage": bson.M{"stage": stage}}},
+				"executionStats": bson.M{"nReturned": 2, "totalDocsExamined": 1000},
+			}}
+		}
+		if op.Query["listIndexes"] != nil {
+			return []bson.M{{"ok": 1, "cursor": bson.M{"id": int64(0), "ns": "test.people", "firstBatch": []bson.M{
+				{"name": "_id_", "key": bson.M{"_id": 1}},
+				{"name": "name_1_age_1", "key": bson.D{{"name", 1}, {"age", 1}}},
+			}}}}
+		}
+		return []bson.M{{"_id": 1}}
+	})
+
+	advisor := NewIndexAdvisor(AdvisorOptions{})
+	session := server.Dial(0)
+	Use(advisor.Middleware())(session)
+	c := session.DB("test").C("people")
+
+	var doc bson.M
+	for _, status := range []string{"a", "b"} {
+		if err := c.Find(bson.M{"status": status, "age": bson.M{"$gte": 18}}).Sort("-createdAt").One(&doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Find(bson.M{"name": "Ale"}).Sort("age").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := advisor.Report()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 2 {
+		t.Fatalf("expected two shapes, got %v", report)
+	}
+
+	var status, name IndexAdvice
+	for _, advice := range report {
+		if advice.Shape == "{name: ?}" {
+			name = advice
+		} else {
+			status = advice
+		}
+	}
+	if !status.CollScan || !status.InMemorySort || !status.LowSelectivity || status.Executions != 2 ||
+		!reflect.DeepEqual(status.Suggested, []string{"status", "-createdAt", "age"}) || status.Existing != "" {
+		t.Errorf("unexpected advice %+v", status)
+	}
+	if name.CollScan || !name.InMemorySort || name.Existing != "name_1_age_1" {
+		t.Errorf("unexpected advice %+v", name)
+	}
+}
@@ -0,0 +1,291 @@
+package mdb
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	DefaultAuditBufferSize = 1024
+	auditBatchSize         = 100
+)
+
+//ErrAuditDropped is passed to AuditOptions.OnError when a record is dropped because the buffer is full
+var ErrAuditDropped = errors.New("mdb: audit buffer full, record dropped")
+
+//AuditRecord is a write recorded by the Auditor
+type AuditRecord struct {
+	Time       time.Time     `bson:"time"`
+	Actor      interface{}   `bson:"actor,omitempty"`
+	Kind       OpKind        `bson:"kind"`
+	DB         string        `bson:"db"`
+	Collection string        `bson:"collection,omitempty"`
+	Filter     interface{}   `bson:"filter,omitempty"`
+	Update     interface{}   `bson:"update,omitempty"`
+	Docs       []interface{} `bson:"docs,omitempty"`
+	//Before and After are the images of the written document, see AuditOptions.Images
+	Before interface{} `bson:"before,omitempty"`
+	After  interface{} `bson:"after,omitempty"`
+	//Error is set if the write failed
+	Error string `bson:"error,omitempty"`
+}
+
+//AuditSink stores audit records
+type AuditSink interface {
+	Write(records []AuditRecord) error
+}
+
+type AuditOptions struct {
+	//Images records the document before and after single document updates, upserts, removals and applies.
+	//The document returned by Query.Apply is the exact image, before the write or after it with ReturnNew.
+	//The other images are read apart from the write, so concurrent writes may show in them.
+	Images bool
+	//BufferSize is the number of records waiting to be written, DefaultAuditBufferSize by default
+	BufferSize int
+	//OnError is called when the sink fails or a record is dropped
+	OnError func(err error)
+}
+
+//Auditor records the writes passing through its middleware and writes them to the sink in the background
+type Auditor struct {
+	sink    AuditSink
+	opts    AuditOptions
+	records chan AuditRecord
+	done    chan struct{}
+	mu      sync.RWMutex
+	closed  bool
+}
+
+//NewAuditor starts an auditor writing to sink, its Middleware must be added to the session with Use
+func NewAuditor(sink AuditSink, opts AuditOptions) *Auditor {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultAuditBufferSize
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(error) {}
+	}
+
+	a := &Auditor{sink: sink, opts: opts, records: make(chan AuditRecord, opts.BufferSize), done: make(chan struct{})}
+	go a.run()
+	return a
+}
+
+//Close writes the buffered records and stops the auditor, writes after Close are not recorded
+func (a *Auditor) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.records)
+	}
+	a.mu.Unlock()
+
+	<-a.done
+}
+
+//Middleware records the writes
+func (a *Auditor) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(op *Operation) error {
+			if !audited(op.Kind) {
+				return next(op)
+			}
+
+			var before interface{}
+			images := a.opts.Images && op.collection != nil && singleDocument(op.Kind)
+			returnNew, _ := op.Options["returnNew"].(bool)
+			//findAndModify returns the before image unless ReturnNew is set
+			if images && (op.Kind != OpApply || returnNew) {
+				before = a.image(op.collection, op.Filter)
+			}
+
+			err := next(op)
+
+			record := AuditRecord{
+				Time:       time.Now(),
+				Kind:       op.Kind,
+				DB:         op.DB,
+				Collection: op.Collection,
+				Filter:     op.Filter,
+				Update:     op.Update,
+				Docs:       op.Docs,
+				Before:     before,
+			}
+			record.Actor, _ = ActorFromContext(op.Context)
+			if err != nil {
+				record.Error = err.Error()
+			}
+			if images && err == nil {
+				if op.Kind == OpApply {
+					record.Before, record.After = a.applyImages(op, before, returnNew)
+				} else {
+					record.After = a.afterImage(op, before)
+				}
+			}
+
+			a.add(record)
+			return err
+		}
+	}
+}
+
+func (a *Auditor) add(record AuditRecord) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+
+	select {
+	case a.records <- record:
+	default:
+		a.opts.OnError(ErrAuditDropped)
+	}
+}
+
+func (a *Auditor) run() {
+	defer close(a.done)
+
+	batch := make([]AuditRecord, 0, auditBatchSize)
+	for record := range a.records {
+		batch = append(batch, record)
+		//take what is already buffered
+		for len(batch) < auditBatchSize && len(a.records) > 0 {
+			batch = append(batch, <-a.records)
+		}
+
+		if err := a.sink.Write(batch); err != nil {
+			a.opts.OnError(err)
+		}
+		batch = batch[:0]
+	}
+}
+
+//image loads the document matching filter, bypassing the middleware
+func (a *Auditor) image(c *Collection, filter interface{}) interface{} {
+	var doc bson.D
+	err := c.session.execWithRetry(func() error {
+		return c.originCollection.Find(filter).One(&doc)
+	})
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			a.opts.OnError(err)
+		}
+		return nil
+	}
+
+	return doc
+}
+
+//afterImage loads the written document by the _id of the before image,
+//or by the filter if an upsert inserted it
+func (a *Auditor) afterImage(op *Operation, before interface{}) interface{} {
+	if op.Kind == OpRemove {
+		return nil
+	}
+
+	if doc, ok := before.(bson.D); ok {
+		if id, ok := documentId(doc); ok {
+			return a.image(op.collection, bson.D{{"_id", id}})
+		}
+	}
+
+	return a.image(op.collection, op.Filter)
+}
+
+//applyImages takes the image returned by findAndModify and loads the other one
+func (a *Auditor) applyImages(op *Operation, before interface{}, returnNew bool) (interface{}, interface{}) {
+	var returned interface{}
+	if op.applied.Kind != 0 {
+		var doc bson.D
+		if err := op.applied.Unmarshal(&doc); err != nil {
+			a.opts.OnError(err)
+		} else {
+			returned = doc
+		}
+	}
+
+	if returnNew {
+		return before, returned
+	}
+	if remove, _ := op.Options["remove"].(bool); remove {
+		return returned, nil
+	}
+
+	return returned, a.afterImage(op, returned)
+}
+
+func audited(kind OpKind) bool {
+	switch kind {
+	case OpInsert, OpUpdate, OpUpdateAll, OpUpsert, OpRemove, OpRemoveAll, OpApply, OpBulkUpsert, OpDrop, OpDropDatabase:
+		return true
+	}
+
+	return false
+}
+
+func singleDocument(kind OpKind) bool {
+	return kind == OpUpdate || kind == OpUpsert || kind == OpRemove || kind == OpApply
+}
+
+//AuditCollection stores the records in c, created as a capped collection of maxBytes if missing.
+//The records are inserted bypassing the middleware.
+func AuditCollection(c *Collection, maxBytes int) AuditSink {
+	return &auditCollection{c: c, maxBytes: maxBytes}
+}
+
+//auditCollection is only written by the auditor goroutine
+type auditCollection struct {
+	c        *Collection
+	maxBytes int
+	created  bool
+}
+
+func (s *auditCollection) Write(records []AuditRecord) error {
+	if !s.created {
+		err := s.c.session.execWithRetry(func() error {
+			return s.c.originCollection.Create(&mgo.CollectionInfo{Capped: true, MaxBytes: s.maxBytes})
+		})
+		if err != nil && !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+		s.created = true
+	}
+
+	docs := make([]interface{}, len(records))
+	for i, record := range records {
+		docs[i] = record
+	}
+
+	return s.c.session.execWithRetry(func() error {
+		return s.c.originCollection.Insert(docs...)
+	})
+}
+
+//AuditWriter writes the records to w as relaxed extended JSON lines
+func AuditWriter(w io.Writer) AuditSink {
+	return &auditWriter{w: w}
+}
+
+type auditWriter struct {
+	w io.Writer
+}
+
+func (s *auditWriter) Write(records []AuditRecord) error {
+	for _, record := range records {
+		data, err := MarshalExtJSON(record, false)
+		if err != nil {
+			return err
+		}
+		if _, err := s.w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package mdb
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZloyDyadka/mdb/internal/mongotest"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestAuditor(t *testing.T) {
+	server := newFakeServer(t)
+	server.Handle(func(op *fakeOp) []bson.M {
+		return []bson.M{{"_id": 1, "name": "Ale"}}
+	})
+
+	var buf bytes.Buffer
+	auditor := NewAuditor(AuditWriter(&buf), AuditOptions{Images: true})
+
+	session := server.Dial(0)
+	Use(auditor.Middleware())(session)
+	c := session.DB("test").C("people").WithContext(WithActor(context.Background(), "ale"))
+
+	if err := c.Insert(bson.M{"_id": 2}); err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := c.FindId(1).One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveId(1); err != mgo.ErrNotFound {
+		t.Fatalf("expected the fake server to report no removal, got %v", err)
+	}
+	auditor.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected the 2 writes to be recorded, got %q", lines)
+	}
+
+	var records []bson.M
+	for _, line := range lines {
+		record, err := UnmarshalExtJSON([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record.Map())
+	}
+
+	if records[0]["kind"] != string(OpInsert) || records[0]["actor"] != "ale" || records[0]["collection"] != "people" {
+		t.Fatalf("expected the insert with its actor, got %v", records[0])
+	}
+	if records[1]["kind"] != string(OpRemove) || records[1]["error"] != "not found" || records[1]["before"] == nil {
+		t.Fatalf("expected the failed remove with its before image, got %v", records[1])
+	}
+}
+
+type memoryAuditSink struct {
+	records []AuditRecord
+}
+
+func (s *memoryAuditSink) Write(records []AuditRecord) error {
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func TestAuditApplyImages(t *testing.T) {
+	server := mongotest.NewServer(t)
+	sink := &memoryAuditSink{}
+	auditor := NewAuditor(sink, AuditOptions{Images: true, OnError: func(err error) { t.Error(err) }})
+
+	session := Wrap(server.Dial(), 0, time.Millisecond)
+	c := session.DB("test").C("counters")
+	if err := c.Insert(bson.M{"_id": 1, "n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	//a concurrent write lands between the auditor and the findAndModify
+	Use(auditor.Middleware(), func(next Handler) Handler {
+		return func(op *Operation) error {
+			if op.Kind == OpApply {
+				if err := c.originCollection.UpdateId(1, bson.M{"$inc": bson.M{"n": 10}}); err != nil {
+					return err
+				}
+			}
+			return next(op)
+		}
+	})(session)
+	c = session.DB("test").C("counters")
+
+	var result bson.M
+	if _, err := c.FindId(1).Apply(mgo.Change{Update: bson.M{"$inc": bson.M{"n": 1}}}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result["n"] != 11 {
+		t.Fatalf("expected the old document as result, got %v", result)
+	}
+	if _, err := c.FindId(1).Apply(mgo.Change{Remove: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	auditor.Close()
+
+	if len(sink.records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", sink.records)
+	}
+	update, remove := sink.records[0], sink.records[1]
+	if n := update.Before.(bson.D).Map()["n"]; n != 11 {
+		t.Fatalf("expected the before image returned by findAndModify, got %v", update.Before)
+	}
+	if n := update.After.(bson.D).Map()["n"]; n != 12 {
+		t.Fatalf("expected the after image, got %v", update.After)
+	}
+	if n := remove.Before.(bson.D).Map()["n"]; n != 22 || remove.After != nil {
+		t.Fatalf("expected the removed document as before image only, got %v %v", remove.Before, remove.After)
+	}
+}
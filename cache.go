@@ -0,0 +1,270 @@
+package mdb
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+//CacheStore stores encoded query results, it must be safe for concurrent use
+type CacheStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+//QueryCache caches the results of queries opting in with Query.Cache or Collection.WithCache.
+//Writes through the session invalidate the cached results of the written collection.
+func QueryCache(store CacheStore) func(session *Session) {
+	return func(s *Session) {
+		s.cache = &queryCache{store: store, generations: map[string]uint64{}}
+	}
+}
+
+//queryCache versions the keys by collection, a write bumps the version
+//so older entries are never read again and expire in the store
+type queryCache struct {
+	store       CacheStore
+	mu          sync.Mutex
+	generations map[string]uint64
+}
+
+func (c *queryCache) generation(namespace string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generations[namespace]
+}
+
+func (c *queryCache) invalidate(namespace string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generations[namespace]++
+}
+
+//WithCache returns the collection caching the results of One, All, Count and Distinct for ttl,
+//the session needs the QueryCache option
+func (c *Collection) WithCache(ttl time.Duration) *Collection {
+	nc := c.clone()
+	nc.cacheTTL = ttl
+	return nc
+}
+
+//Cache caches the results of One, All, Count and Distinct for ttl,
+//the session needs the QueryCache option
+func (q *Query) Cache(ttl time.Duration) *Query {
+	q.cacheTTL = ttl
+	return q
+}
+
+func (c *Collection) namespace() string {
+	return c.originCollection.FullName
+}
+
+//invalidateCache is called after every write to the collection
+func (c *Collection) invalidateCache() {
+	if c.session.cache != nil {
+		c.session.cache.invalidate(c.namespace())
+	}
+}
+
+func (q *Query) caching() bool {
+	return q.session.cache != nil && q.cacheTTL > 0
+}
+
+//cached loads the result of op from the cache or runs load, coalesced with identical
+//concurrent calls if enabled, and caches the encoded result.
+//The cache key is taken before load, so a write during load leaves the result unreachable.
+func (q *Query) cached(op string, extra interface{}, load func() ([]byte, error), decode func([]byte) error) error {
+	key, err := q.resultKey(op, extra)
+	if err != nil {
+		return err
+	}
+
+	cache := q.session.cache
+	var cacheKey string
+	if q.caching() {
+		cacheKey = strconv.FormatUint(cache.generation(q.collection.namespace()), 10) + ":" + key
+		if data, ok := cache.store.Get(cacheKey); ok {
+			return decode(data)
+		}
+	}
+
+	if q.coalescing() {
+		data, err := q.session.flights.do(key, load)
+		if err != nil {
+			return err
+		}
+		if cacheKey != "" {
+			cache.store.Set(cacheKey, data, q.cacheTTL)
+		}
+		return decode(data)
+	}
+
+	data, err := load()
+	if err != nil {
+		return err
+	}
+	if cacheKey != "" {
+		cache.store.Set(cacheKey, data, q.cacheTTL)
+	}
+
+	return decode(data)
+}
+
+//resultKey identifies the result of op on the query
+func (q *Query) resultKey(op string, extra interface{}) (string, error) {
+	canonical, err := canonicalBson(bson.M{
+		"filter":    q.spec.filter,
+		"selector":  q.spec.selector,
+		"sort":      q.spec.sort,
+		"skip":      q.spec.skip,
+		"limit":     q.spec.limit,
+		"collation": q.spec.collation,
+		"extra":     extra,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(canonical)
+	return q.collection.namespace() + ":" + op + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+type cachedDocuments struct {
+	Docs []bson.Raw `bson:"d"`
+}
+
+type cachedValue struct {
+	Value bson.Raw `bson:"v"`
+}
+
+func (q *Query) cachedOne(result interface{}) error {
+	return q.cached("one", nil, func() ([]byte, error) {
+		var raw bson.Raw
+		err := q.exec(OpFind, bson.M{"one": true}, func(query *mgo.Query) error {
+			return query.One(&raw)
+		})
+		return raw.Data, err
+	}, func(data []byte) error {
+		return bson.Unmarshal(data, result)
+	})
+}
+
+func (q *Query) cachedAll(result interface{}) error {
+	return q.cached("all", nil, func() ([]byte, error) {
+		var docs []bson.Raw
+		if err := q.Iter().All(&docs); err != nil {
+			return nil, err
+		}
+		return bson.Marshal(cachedDocuments{Docs: docs})
+	}, func(data []byte) error {
+		var cached cachedDocuments
+		if err := bson.Unmarshal(data, &cached); err != nil {
+			return err
+		}
+		return decodeDocuments(cached.Docs, result)
+	})
+}
+
+func (q *Query) cachedCount() (int, error) {
+	var n int
+	err := q.cached("count", nil, func() ([]byte, error) {
+		count, err := q.count()
+		if err != nil {
+			return nil, err
+		}
+		return bson.Marshal(bson.M{"v": count})
+	}, func(data []byte) error {
+		var cached struct {
+			N int `bson:"v"`
+		}
+		err := bson.Unmarshal(data, &cached)
+		n = cached.N
+		return err
+	})
+
+	return n, err
+}
+
+func (q *Query) cachedDistinct(key string, result interface{}) error {
+	return q.cached("distinct", key, func() ([]byte, error) {
+		var values []interface{}
+		err := q.exec(OpDistinct, bson.M{"key": key}, func(query *mgo.Query) error {
+			return query.Distinct(key, &values)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return bson.Marshal(bson.M{"v": values})
+	}, func(data []byte) error {
+		var cached cachedValue
+		if err := bson.Unmarshal(data, &cached); err != nil {
+			return err
+		}
+		return cached.Value.Unmarshal(result)
+	})
+}
+
+//NewLRUCache returns an in-memory CacheStore keeping up to maxEntries results
+func NewLRUCache(maxEntries int) CacheStore {
+	return &lruCache{max: maxEntries, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+type lruCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *lruCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*lruEntry)
+		entry.value, entry.expiresAt = value, time.Now().Add(ttl)
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)})
+	for c.max > 0 && c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
@@ -0,0 +1,74 @@
+package mdb
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestQueryCacheInvalidation(t *testing.T) {
+	server := newFakeServer(t)
+
+	var calls int32
+	server.Handle(func(op *fakeOp) []bson.M {
+		if _, ok := op.Query["count"]; ok {
+			return []bson.M{{"ok": 1, "n": atomic.AddInt32(&calls, 1)}}
+		}
+		return []bson.M{{"ok": 1}}
+	})
+
+	session := server.Dial(0)
+	QueryCache(NewLRUCache(10))(session)
+	c := session.DB("test").C("people").WithCache(time.Minute)
+
+	count := func(filter bson.M) int {
+		n, err := c.Find(filter).Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := count(bson.M{"a": 1, "b": 2}); n != 1 {
+		t.Fatalf("expected 1, got %d", n)
+	}
+	if n := count(bson.M{"b": 2, "a": 1}); n != 1 {
+		t.Fatalf("expected the cached count, got %d", n)
+	}
+	if n := count(bson.M{"a": 2}); n != 2 {
+		t.Fatalf("expected another query to miss the cache, got %d", n)
+	}
+
+	if err := c.Insert(bson.M{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(bson.M{"a": 1, "b": 2}); n != 3 {
+		t.Fatalf("expected the insert to invalidate the cache, got %d", n)
+	}
+
+	if n, err := session.DB("test").C("people").Find(nil).Count(); err != nil || n != 4 {
+		t.Fatalf("expected uncached queries to reach the server, got %d %v", n, err)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	cache := NewLRUCache(2)
+	cache.Set("a", []byte("1"), time.Minute)
+	cache.Set("b", []byte("2"), time.Minute)
+	cache.Get("a")
+	cache.Set("c", []byte("3"), time.Minute)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("expected the least recently used entry to be evicted")
+	}
+	if v, ok := cache.Get("a"); !ok || string(v) != "1" {
+		t.Fatalf("expected a, got %q %v", v, ok)
+	}
+
+	cache.Set("d", []byte("4"), -time.Second)
+	if _, ok := cache.Get("d"); ok {
+		t.Fatal("expected the expired entry to be missing")
+	}
+}
@@ -0,0 +1,21 @@
+// Command mdb-migrate applies migrations registered with migrate.Register.
+//
+// Migrations are compiled in, so copy this command into your project
+// and import the package registering them:
+//
+//	import _ "example.com/project/migrations"
+//
+// Usage:
+//
+//	mdb-migrate -url mongodb://127.0.0.1:27017/app up
+//	mdb-migrate -url mongodb://127.0.0.1:27017/app -dry-run down 3
+//	mdb-migrate -url mongodb://127.0.0.1:27017/app status
+package main
+
+import (
+	"github.com/ZloyDyadka/mdb/migrate"
+)
+
+func main() {
+	migrate.Main(migrate.Registered())
+}
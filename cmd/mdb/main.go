@@ -0,0 +1,430 @@
+// Command mdb is a scriptable shell over the mdb wrapper,
+// retrying on connection errors like the services using it.
+//
+// Usage:
+//
+//	mdb -url mongodb://127.0.0.1:27017/app ping
+//	mdb -url mongodb://127.0.0.1:27017/app find -sort -createdAt -limit 10 people '{"age": {"$gt": 30}}'
+//	mdb -url mongodb://127.0.0.1:27017/app export -format csv -fields name,address.city people > people.csv
+//	mdb -url mongodb://127.0.0.1:27017/app run '{"collStats": "people"}'
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ZloyDyadka/mdb"
+	"github.com/globalsign/mgo/bson"
+)
+
+const usage = `usage: %s [flags] <command> [command flags] [args]
+
+commands:
+  ping
+  dbs
+  collections
+  find [-sort fields] [-skip n] [-limit n] [-fields json] [-canonical] <collection> [filter]
+  count <collection> [filter]
+  indexes <collection>
+  explain [-sort fields] <collection> [filter]
+  export [-format format] [-fields names] [-out file] <collection> [filter]
+  import [-format format] [-types column=type,...] [-in file] [-batch n] [-resume] <collection>
+  run <json command>
+
+formats: jsonl, canonical-jsonl, json, canonical-json, csv, bson
+csv column types: string, int, float, bool, number; imported csv values are strings by default
+filters, projections and commands are extended JSON
+
+flags:
+`
+
+func main() {
+	if err := command(os.Args[0], os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type env struct {
+	session *mdb.Session
+	db      *mdb.Database
+	in      io.Reader
+	out     io.Writer
+}
+
+func command(name string, args []string, in io.Reader, out io.Writer) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	url := flags.String("url", "mongodb://127.0.0.1:27017/test", "mongodb url")
+	dbName := flags.String("db", "", "database, the one from url if empty")
+	retries := flags.Int("retries", mdb.DefaultMaxRetries, "max retries on connection errors")
+	retryInterval := flags.Duration("retry-interval", mdb.DefaultRetryInterval, "interval between retries")
+	flags.Usage = func() {
+		fmt.Fprintf(out, usage, name)
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("mdb: expected a command")
+	}
+
+	f, ok := commands[flags.Arg(0)]
+	if !ok {
+		flags.Usage()
+		return fmt.Errorf("mdb: unknown command %q", flags.Arg(0))
+	}
+
+	session, err := mdb.Dial(*url, mdb.MaxRetries(*retries), mdb.RetryInterval(*retryInterval))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	e := &env{session: session, db: session.DB(*dbName), in: in, out: out}
+	return f(e, flags.Arg(0), flags.Args()[1:])
+}
+
+var commands = map[string]func(e *env, name string, args []string) error{
+	"ping":        ping,
+	"dbs":         dbs,
+	"collections": collections,
+	"find":        find,
+	"count":       count,
+	"indexes":     indexes,
+	"explain":     explain,
+	"export":      export,
+	"import":      importCommand,
+	"run":         run,
+}
+
+func ping(e *env, name string, args []string) error {
+	if err := e.session.Ping(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(e.out, "ok", strings.Join(e.session.LiveServers(), ","))
+	return nil
+}
+
+func dbs(e *env, name string, args []string) error {
+	names, err := e.session.DatabaseNames()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		fmt.Fprintln(e.out, name)
+	}
+	return nil
+}
+
+func collections(e *env, name string, args []string) error {
+	names, err := e.db.CollectionNames()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		fmt.Fprintln(e.out, name)
+	}
+	return nil
+}
+
+func find(e *env, name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(e.out)
+	sort := flags.String("sort", "", "comma separated sort fields, - for descending")
+	skip := flags.Int("skip", 0, "documents to skip")
+	limit := flags.Int("limit", 0, "max documents, all if 0")
+	fields := flags.String("fields", "", "projection")
+	canonical := flags.Bool("canonical", false, "print canonical extended JSON")
+
+	c, filter, err := collectionArgs(e, flags, args)
+	if err != nil {
+		return err
+	}
+
+	q := c.Find(filter).Skip(*skip).Limit(*limit)
+	if *sort != "" {
+		q = q.Sort(strings.Split(*sort, ",")...)
+	}
+	if *fields != "" {
+		projection, err := mdb.UnmarshalExtJSON([]byte(*fields))
+		if err != nil {
+			return fmt.Errorf("mdb: invalid fields: %v", err)
+		}
+		q = q.Select(projection)
+	}
+
+	iter := q.Iter()
+	var doc bson.D
+	for iter.Next(&doc) {
+		if err := printDocument(e.out, doc, *canonical); err != nil {
+			iter.Close()
+			return err
+		}
+		doc = nil
+	}
+
+	return iter.Close()
+}
+
+func count(e *env, name string, args []string) error {
+	c, filter, err := collectionArgs(e, flag.NewFlagSet(name, flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	n, err := c.Find(filter).Count()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(e.out, n)
+	return nil
+}
+
+func indexes(e *env, name string, args []string) error {
+	c, _, err := collectionArgs(e, flag.NewFlagSet(name, flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	indexes, err := c.Indexes()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tKEY\tOPTIONS")
+	for _, index := range indexes {
+		var options []string
+		if index.Unique {
+			options = append(options, "unique")
+		}
+		if index.Sparse {
+			options = append(options, "sparse")
+		}
+		if index.ExpireAfter > 0 {
+			options = append(options, "ttl="+index.ExpireAfter.String())
+		}
+		if len(index.PartialFilter) > 0 {
+			options = append(options, "partial")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", index.Name, strings.Join(index.Key, ","), strings.Join(options, ","))
+	}
+
+	return w.Flush()
+}
+
+func explain(e *env, name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(e.out)
+	sort := flags.String("sort", "", "comma separated sort fields, - for descending")
+
+	c, filter, err := collectionArgs(e, flags, args)
+	if err != nil {
+		return err
+	}
+
+	q := c.Find(filter)
+	if *sort != "" {
+		q = q.Sort(strings.Split(*sort, ",")...)
+	}
+
+	var result bson.D
+	if err := q.Explain(&result); err != nil {
+		return err
+	}
+
+	return printDocument(e.out, result, false)
+}
+
+func export(e *env, name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(e.out)
+	formatName := flags.String("format", "jsonl", "file format")
+	fields := flags.String("fields", "", "comma separated csv fields")
+	path := flags.String("out", "", "output file, stdout if empty")
+
+	c, filter, err := collectionArgs(e, flags, args)
+	if err != nil {
+		return err
+	}
+
+	format, err := parseFormat(*formatName, *fields)
+	if err != nil {
+		return err
+	}
+
+	w := e.out
+	if *path != "" {
+		f, err := os.Create(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	n, err := c.Export(w, filter, format)
+	if err != nil {
+		return err
+	}
+
+	if *path != "" {
+		fmt.Fprintf(e.out, "exported %d documents\n", n)
+	}
+	return nil
+}
+
+func importCommand(e *env, name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(e.out)
+	formatName := flags.String("format", "jsonl", "file format")
+	path := flags.String("in", "", "input file, stdin if empty")
+	batch := flags.Int("batch", mdb.DefaultImportBatchSize, "documents per insert")
+	resume := flags.Bool("resume", false, "skip documents already imported")
+	typeNames := flags.String("types", "", "csv column types, e.g. age=int,score=number")
+
+	c, _, err := collectionArgs(e, flags, args)
+	if err != nil {
+		return err
+	}
+
+	format, err := parseFormat(*formatName, "")
+	if err != nil {
+		return err
+	}
+	types, err := parseColumnTypes(*typeNames)
+	if err != nil {
+		return err
+	}
+
+	r := e.in
+	if *path != "" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	result, err := c.Import(bufio.NewReader(r), format, mdb.ImportOptions{BatchSize: *batch, Resume: *resume, ColumnTypes: types})
+	if result != nil {
+		fmt.Fprintf(e.out, "imported %d documents, skipped %d\n", result.Inserted, result.Skipped)
+	}
+
+	return err
+}
+
+func run(e *env, name string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("mdb: %s expects a json command", name)
+	}
+
+	cmd, err := mdb.UnmarshalExtJSON([]byte(args[0]))
+	if err != nil {
+		return fmt.Errorf("mdb: invalid command: %v", err)
+	}
+
+	var result bson.D
+	if err := e.db.Run(cmd, &result); err != nil {
+		return err
+	}
+
+	return printDocument(e.out, result, false)
+}
+
+//collectionArgs parses the command flags followed by the collection and an optional filter
+func collectionArgs(e *env, flags *flag.FlagSet, args []string) (*mdb.Collection, bson.D, error) {
+	flags.SetOutput(e.out)
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if flags.NArg() == 0 || flags.NArg() > 2 {
+		return nil, nil, fmt.Errorf("mdb: %s expects a collection and an optional filter", flags.Name())
+	}
+
+	var filter bson.D
+	if flags.NArg() == 2 {
+		var err error
+		if filter, err = mdb.UnmarshalExtJSON([]byte(flags.Arg(1))); err != nil {
+			return nil, nil, fmt.Errorf("mdb: invalid filter: %v", err)
+		}
+	}
+
+	return e.db.C(flags.Arg(0)), filter, nil
+}
+
+func parseFormat(name string, fields string) (mdb.Format, error) {
+	switch name {
+	case "jsonl":
+		return mdb.JSONLines, nil
+	case "canonical-jsonl":
+		return mdb.CanonicalJSONLines, nil
+	case "json":
+		return mdb.RelaxedJSON, nil
+	case "canonical-json":
+		return mdb.CanonicalJSON, nil
+	case "bson":
+		return mdb.BSONDump, nil
+	case "csv":
+		var names []string
+		if fields != "" {
+			names = strings.Split(fields, ",")
+		}
+		return mdb.CSV(names...), nil
+	}
+
+	return mdb.Format{}, fmt.Errorf("mdb: unknown format %q", name)
+}
+
+func parseColumnTypes(s string) (map[string]mdb.ColumnType, error) {
+	names := map[string]mdb.ColumnType{
+		"string": mdb.ColumnString,
+		"int":    mdb.ColumnInt,
+		"float":  mdb.ColumnFloat,
+		"bool":   mdb.ColumnBool,
+		"number": mdb.ColumnNumber,
+	}
+
+	types := map[string]mdb.ColumnType{}
+	for _, column := range strings.Split(s, ",") {
+		if column == "" {
+			continue
+		}
+		i := strings.IndexByte(column, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("mdb: invalid column type %q", column)
+		}
+		t, ok := names[column[i+1:]]
+		if !ok {
+			return nil, fmt.Errorf("mdb: unknown column type %q", column[i+1:])
+		}
+		types[column[:i]] = t
+	}
+
+	return types, nil
+}
+
+func printDocument(w io.Writer, doc bson.D, canonical bool) error {
+	data, err := mdb.MarshalExtJSON(doc, canonical)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
@@ -0,0 +1,63 @@
+package mdb
+
+import (
+	"sync"
+)
+
+//WithCoalescing returns the collection sharing one round trip between identical
+//concurrent One, Count and Distinct calls, each caller gets its own copy of the result
+func (c *Collection) WithCoalescing() *Collection {
+	nc := c.clone()
+	nc.coalesce = true
+	return nc
+}
+
+//Coalesce shares one round trip between identical concurrent One, Count and Distinct calls,
+//see Collection.WithCoalescing
+func (q *Query) Coalesce() *Query {
+	q.coalesce = true
+	return q
+}
+
+func (q *Query) coalescing() bool {
+	return q.coalesce && q.session.flights != nil
+}
+
+//flightGroup runs one call per key at a time, callers arriving meanwhile wait for its result
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+//do returns the encoded result of f, copied for every caller
+func (g *flightGroup) do(key string, f func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flight{}
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return append([]byte(nil), call.data...), call.err
+	}
+
+	call := &flight{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.data, call.err = f()
+	return append([]byte(nil), call.data...), call.err
+}
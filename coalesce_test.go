@@ -0,0 +1,59 @@
+package mdb
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestCoalescing(t *testing.T) {
+	server := newFakeServer(t)
+
+	var calls int32
+	server.Handle(func(op *fakeOp) []bson.M {
+		if _, ok := op.Query["distinct"]; ok {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(200 * time.Millisecond)
+			return []bson.M{{"ok": 1, "values": []interface{}{"a", "b"}}}
+		}
+		return []bson.M{{"ok": 1}}
+	})
+
+	session := server.Dial(0)
+	c := session.DB("test").C("people").WithCoalescing()
+
+	const callers = 5
+	results := make([][]string, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := c.Find(bson.M{"age": 30}).Distinct("name", &results[i]); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected one round trip, got %d", n)
+	}
+
+	results[0][0] = "changed"
+	for i := 1; i < callers; i++ {
+		if len(results[i]) != 2 || results[i][0] != "a" {
+			t.Fatalf("expected every caller to get its own copy, got %v", results[i])
+		}
+	}
+
+	if err := c.Find(bson.M{"age": 30}).Distinct("name", &results[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected a later call to reach the server, got %d", n)
+	}
+}
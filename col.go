@@ -1,6 +1,9 @@
 package mdb
 
 import (
+	"context"
+	"time"
+
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 )
@@ -10,6 +13,16 @@ type Collection struct {
 	Database         *Database
 	session          *Session
 	originCollection *mgo.Collection
+	versionField     string
+	cacheTTL         time.Duration
+	coalesce         bool
+	deletedField     string
+	deletedScope     deletedScope
+	timestamps       *Timestamps
+	ctx              context.Context
+	crypt            *fieldCrypt
+	validator        Validator
+	timeout          time.Duration
 }
 
 //Origin returns origin mgo collection
@@ -19,17 +32,49 @@ func (c *Collection) Origin() *mgo.Collection {
 
 func (c *Collection) With(s *mgo.Session) *Collection {
 	mgoCollection := c.originCollection.With(s)
-	return &Collection{
-		Name:             c.Name,
-		Database:         c.Database.with(mgoCollection.Database),
-		originCollection: mgoCollection,
-		session:          c.session.with(s),
+	nc := c.clone()
+	nc.Database = c.Database.with(mgoCollection.Database)
+	nc.originCollection = mgoCollection
+	nc.session = c.session.with(s)
+	return nc
+}
+
+//clone returns a copy keeping the collection options
+func (c *Collection) clone() *Collection {
+	nc := *c
+	return &nc
+}
+
+//prepareInserts sets the timestamps, validates and encrypts the fields of the documents
+func (c *Collection) prepareInserts(docs []interface{}) ([]interface{}, error) {
+	docs, err := c.stampInserts(docs)
+	if err != nil {
+		return nil, err
 	}
+	if err := c.validateInserts(docs); err != nil {
+		return nil, err
+	}
+
+	return c.encryptInserts(docs)
+}
+
+//prepareUpdate sets the timestamps, validates and encrypts the fields of an update
+func (c *Collection) prepareUpdate(update interface{}, upsert bool) (interface{}, error) {
+	update, err := c.stampUpdate(update, upsert)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.validateUpdate(update); err != nil {
+		return nil, err
+	}
+
+	return c.encryptUpdate(update)
 }
 
 func (c *Collection) Repair() *Iter {
 	iter := &Iter{session: c.session.with(c.Database.originDB.Session)}
-	c.session.execWithRetry(func() error {
+	iter.err = c.exec(c.operation(OpRepair), func(op *Operation, origin *mgo.Collection) error {
+		//the iterator outlives the session of the attempt
 		iter.originIter = c.originCollection.Repair()
 		return iter.originIter.Err()
 	})
@@ -38,18 +83,31 @@ func (c *Collection) Repair() *Iter {
 }
 
 func (c *Collection) Insert(docs ...interface{}) error {
-	lastErr := c.session.execWithRetry(func() error {
-		return c.originCollection.Insert(docs...)
+	docs, err := c.prepareInserts(docs)
+	if err != nil {
+		return err
+	}
+
+	op := c.operation(OpInsert)
+	op.Docs = docs
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
+		return origin.Insert(op.Docs...)
 	})
 
+	c.invalidateCache()
+
 	return lastErr
 }
 
 func (c *Collection) Count() (int, error) {
+	if c.softDelete() {
+		return c.Find(nil).Count()
+	}
+
 	var n int
-	lastErr := c.session.execWithRetry(func() error {
+	lastErr := c.exec(c.operation(OpCount), func(op *Operation, origin *mgo.Collection) error {
 		var err error
-		n, err = c.originCollection.Count()
+		n, err = origin.Count()
 		return err
 	})
 
@@ -57,66 +115,90 @@ func (c *Collection) Count() (int, error) {
 }
 
 func (c *Collection) Create(info *mgo.CollectionInfo) error {
-	lastErr := c.session.execWithRetry(func() error {
-		return c.originCollection.Create(info)
+	op := c.operation(OpCreate)
+	op.Options = bson.M{"info": info}
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
+		return origin.Create(info)
 	})
 
 	return lastErr
 }
 
 func (c *Collection) DropCollection() error {
-	lastErr := c.session.execWithRetry(func() error {
-		return c.originCollection.DropCollection()
+	lastErr := c.exec(c.operation(OpDrop), func(op *Operation, origin *mgo.Collection) error {
+		return origin.DropCollection()
 	})
 
+	c.invalidateCache()
+
 	return lastErr
 }
 
 func (c *Collection) DropIndexName(name string) error {
-	lastErr := c.session.execWithRetry(func() error {
-		return c.originCollection.DropIndexName(name)
+	op := c.operation(OpDropIndex)
+	op.Options = bson.M{"name": name}
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
+		return origin.DropIndexName(name)
 	})
 
 	return lastErr
 }
 
 func (c *Collection) DropAllIndexes() error {
-	lastErr := c.session.execWithRetry(func() error {
-		return c.originCollection.DropAllIndexes()
+	op := c.operation(OpDropIndex)
+	op.Options = bson.M{"all": true}
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
+		return origin.DropAllIndexes()
 	})
 
 	return lastErr
 }
 
 func (c *Collection) DropIndex(key ...string) error {
-	lastErr := c.session.execWithRetry(func() error {
-		return c.originCollection.DropIndex(key...)
+	op := c.operation(OpDropIndex)
+	op.Options = bson.M{"key": key}
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
+		return origin.DropIndex(key...)
 	})
 
 	return lastErr
 }
 
 func (c *Collection) EnsureIndex(index mgo.Index) error {
-	lastErr := c.session.execWithRetry(func() error {
-		return c.originCollection.EnsureIndex(index)
+	op := c.operation(OpEnsureIndex)
+	op.Options = bson.M{"index": index}
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
+		return origin.EnsureIndex(index)
 	})
 
 	return lastErr
 }
 
 func (c *Collection) Pipe(pipe interface{}) *Pipe {
+	pipe = c.scopedPipeline(pipe)
 	p := c.originCollection.Pipe(pipe)
 	return &Pipe{
 		session:    c.session.with(c.Database.originDB.Session),
+		collection: c,
+		pipeline:   pipe,
 		originPipe: p,
+		timeout:    c.timeout,
 	}
 }
 
 func (c *Collection) Remove(selector interface{}) error {
-	lastErr := c.session.execWithRetry(func() error {
-		return c.originCollection.Remove(selector)
+	if c.softDelete() {
+		return c.Update(c.deletedFilter(selector, excludeDeleted), c.markDeleted())
+	}
+
+	op := c.operation(OpRemove)
+	op.Filter = selector
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
+		return origin.Remove(op.Filter)
 	})
 
+	c.invalidateCache()
+
 	return lastErr
 }
 
@@ -126,9 +208,9 @@ func (c *Collection) RemoveId(id interface{}) error {
 
 func (c *Collection) Indexes() ([]mgo.Index, error) {
 	var indexes []mgo.Index
-	lastErr := c.session.execWithRetry(func() error {
+	lastErr := c.exec(c.operation(OpIndexes), func(op *Operation, origin *mgo.Collection) error {
 		var err error
-		indexes, err = c.originCollection.Indexes()
+		indexes, err = origin.Indexes()
 		return err
 	})
 
@@ -136,13 +218,25 @@ func (c *Collection) Indexes() ([]mgo.Index, error) {
 }
 
 func (c *Collection) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	if c.softDelete() {
+		info, err := c.UpdateAll(c.deletedFilter(selector, excludeDeleted), c.markDeleted())
+		if info != nil {
+			info = &mgo.ChangeInfo{Removed: info.Updated, Matched: info.Matched}
+		}
+		return info, err
+	}
+
 	var info *mgo.ChangeInfo
-	lastErr := c.session.execWithRetry(func() error {
+	op := c.operation(OpRemoveAll)
+	op.Filter = selector
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
 		var err error
-		info, err = c.originCollection.RemoveAll(selector)
+		info, err = origin.RemoveAll(op.Filter)
 		return err
 	})
 
+	c.invalidateCache()
+
 	return info, lastErr
 }
 
@@ -151,43 +245,79 @@ func (c *Collection) UpdateId(id interface{}, update interface{}) (err error) {
 }
 
 func (c *Collection) Update(selector interface{}, update interface{}) error {
-	lastErr := c.session.execWithRetry(func() error {
-		return c.originCollection.Update(selector, update)
+	update, err := c.prepareUpdate(update, false)
+	if err != nil {
+		return err
+	}
+
+	op := c.operation(OpUpdate)
+	op.Filter, op.Update = selector, update
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
+		return origin.Update(op.Filter, op.Update)
 	})
 
+	c.invalidateCache()
+
 	return lastErr
 }
 
 func (c *Collection) UpdateAll(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	update, err := c.prepareUpdate(update, false)
+	if err != nil {
+		return nil, err
+	}
+
 	var info *mgo.ChangeInfo
-	lastErr := c.session.execWithRetry(func() error {
+	op := c.operation(OpUpdateAll)
+	op.Filter, op.Update = selector, update
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
 		var err error
-		info, err = c.originCollection.UpdateAll(selector, update)
+		info, err = origin.UpdateAll(op.Filter, op.Update)
 		return err
 	})
 
+	c.invalidateCache()
+
 	return info, lastErr
 }
 
 func (c *Collection) Upsert(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	update, err := c.prepareUpdate(update, true)
+	if err != nil {
+		return nil, err
+	}
+
 	var info *mgo.ChangeInfo
-	lastErr := c.session.execWithRetry(func() error {
+	op := c.operation(OpUpsert)
+	op.Filter, op.Update = selector, update
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
 		var err error
-		info, err = c.originCollection.Upsert(selector, update)
+		info, err = origin.Upsert(op.Filter, op.Update)
 		return err
 	})
 
+	c.invalidateCache()
+
 	return info, lastErr
 }
 
 func (c *Collection) UpsertId(id interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	update, err := c.prepareUpdate(update, true)
+	if err != nil {
+		return nil, err
+	}
+
 	var info *mgo.ChangeInfo
-	lastErr := c.session.execWithRetry(func() error {
+	op := c.operation(OpUpsert)
+	op.Filter, op.Update = bson.D{{"_id", id}}, update
+	lastErr := c.exec(op, func(op *Operation, origin *mgo.Collection) error {
 		var err error
-		info, err = c.originCollection.UpsertId(id, update)
+		info, err = origin.Upsert(op.Filter, op.Update)
 		return err
 	})
 
+	c.invalidateCache()
+
 	return info, lastErr
 }
 
@@ -200,9 +330,15 @@ func (c *Collection) FindId(id interface{}) *Query {
 }
 
 func (c *Collection) Find(query interface{}) *Query {
+	query = c.scoped(query)
 	return &Query{
 		session:     c.session.with(c.Database.originDB.Session),
+		collection:  c,
+		spec:        querySpec{filter: query},
 		originQuery: c.originCollection.Find(query),
+		cacheTTL:    c.cacheTTL,
+		coalesce:    c.coalesce,
+		timeout:     c.timeout,
 	}
 }
 
@@ -0,0 +1,318 @@
+package mdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const DefaultCopyBatchSize = 1000
+
+//CopyOptions controls CopyCollection
+type CopyOptions struct {
+	//Filter selects the source documents, all by default
+	Filter interface{}
+	//Parallel is the number of _id ranges copied concurrently
+	Parallel int
+	//BatchSize is the number of documents per bulk write, DefaultCopyBatchSize by default
+	BatchSize int
+	//Checkpoint stores the progress of every range, so an interrupted copy resumes where it stopped
+	Checkpoint *Collection
+	//Name identifies the copy in the checkpoint collection, source and destination names by default
+	Name string
+	//MaxDocsPerSecond throttles the copy, unlimited if 0
+	MaxDocsPerSecond int
+	//Verify compares counts and hashes of every range after copying
+	Verify bool
+}
+
+//CopyRange is an _id range [Lo, Hi) of the copy
+type CopyRange struct {
+	Partition int
+	Lo        interface{}
+	Hi        interface{}
+	Copied    int
+	//set by the verification pass
+	SourceCount int
+	DestCount   int
+	Match       bool
+}
+
+type CopyReport struct {
+	Copied   int
+	Ranges   []CopyRange
+	Verified bool
+	//Mismatched lists the partitions whose documents differ
+	Mismatched []int
+}
+
+type copyCheckpoint struct {
+	Id        string      `bson:"_id"`
+	Copy      string      `bson:"copy"`
+	Partition int         `bson:"partition"`
+	Lo        interface{} `bson:"lo"`
+	Hi        interface{} `bson:"hi"`
+	Last      interface{} `bson:"last"`
+	Copied    int         `bson:"copied"`
+	Done      bool        `bson:"done"`
+}
+
+//CopyCollection copies the documents matching opts.Filter from src to dst,
+//which may belong to sessions of different clusters. Documents are replaced by _id,
+//so copying again or resuming after an interruption doesn't duplicate them.
+func CopyCollection(src, dst *Collection, opts CopyOptions) (*CopyReport, error) {
+	if opts.Parallel <= 0 {
+		opts.Parallel = 1
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultCopyBatchSize
+	}
+	if opts.Name == "" {
+		opts.Name = src.Database.Name + "." + src.Name + "->" + dst.Database.Name + "." + dst.Name
+	}
+
+	ranges, err := copyRanges(src, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &throttle{rate: opts.MaxDocsPerSecond}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, r := range ranges {
+		if r.Done {
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *copyCheckpoint) {
+			defer wg.Done()
+			err := copyRange(src, dst, r, opts, t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return firstErr != nil
+			})
+
+			mu.Lock()
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("mdb: copy partition %d: %v", r.Partition, err)
+			}
+			mu.Unlock()
+		}(r)
+	}
+	wg.Wait()
+
+	report := &CopyReport{}
+	for _, r := range ranges {
+		report.Copied += r.Copied
+		report.Ranges = append(report.Ranges, CopyRange{Partition: r.Partition, Lo: r.Lo, Hi: r.Hi, Copied: r.Copied})
+	}
+	if firstErr != nil || !opts.Verify {
+		return report, firstErr
+	}
+
+	for i := range report.Ranges {
+		if err := verifyRange(src, dst, &report.Ranges[i], opts.Filter); err != nil {
+			return report, err
+		}
+		if !report.Ranges[i].Match {
+			report.Mismatched = append(report.Mismatched, report.Ranges[i].Partition)
+		}
+	}
+	report.Verified = true
+
+	return report, nil
+}
+
+//copyRanges loads the checkpointed ranges or splits the source in opts.Parallel ranges of similar size
+func copyRanges(src *Collection, opts CopyOptions) ([]*copyCheckpoint, error) {
+	if opts.Checkpoint != nil {
+		var ranges []*copyCheckpoint
+		if err := opts.Checkpoint.Find(bson.M{"copy": opts.Name}).Sort("partition").All(&ranges); err != nil {
+			return nil, err
+		}
+		if len(ranges) > 0 {
+			return ranges, nil
+		}
+	}
+
+	bounds := []interface{}{bson.MinKey}
+	if opts.Parallel > 1 {
+		n, err := src.Find(opts.Filter).Count()
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 1; i < opts.Parallel && n > 0; i++ {
+			var doc struct {
+				Id interface{} `bson:"_id"`
+			}
+			err := src.Find(opts.Filter).Sort("_id").Skip(n * i / opts.Parallel).Select(bson.M{"_id": 1}).One(&doc)
+			if err != nil {
+				return nil, err
+			}
+
+			last, _ := canonicalBson(bounds[len(bounds)-1])
+			if current, _ := canonicalBson(doc.Id); !bytes.Equal(last, current) {
+				bounds = append(bounds, doc.Id)
+			}
+		}
+	}
+	bounds = append(bounds, bson.MaxKey)
+
+	ranges := make([]*copyCheckpoint, 0, len(bounds)-1)
+	for i := 0; i < len(bounds)-1; i++ {
+		r := &copyCheckpoint{
+			Id:        fmt.Sprintf("%s:%d", opts.Name, i),
+			Copy:      opts.Name,
+			Partition: i,
+			Lo:        bounds[i],
+			Hi:        bounds[i+1],
+		}
+		if opts.Checkpoint != nil {
+			if _, err := opts.Checkpoint.UpsertId(r.Id, r); err != nil {
+				return nil, err
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	return ranges, nil
+}
+
+func copyRange(src, dst *Collection, r *copyCheckpoint, opts CopyOptions, t *throttle, stopped func() bool) error {
+	for !stopped() {
+		var docs []bson.D
+		if err := src.Find(r.filter(opts.Filter)).Sort("_id").Limit(opts.BatchSize).All(&docs); err != nil {
+			return err
+		}
+
+		if len(docs) == 0 {
+			r.Done = true
+			return r.save(opts.Checkpoint)
+		}
+
+		t.wait(len(docs))
+		if err := dst.replaceAll(docs); err != nil {
+			return err
+		}
+
+		r.Last, _ = documentId(docs[len(docs)-1])
+		r.Copied += len(docs)
+		if err := r.save(opts.Checkpoint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//replaceAll upserts the documents by _id with an unordered bulk write
+func (c *Collection) replaceAll(docs []bson.D) error {
+	defer c.invalidateCache()
+
+	op := c.operation(OpBulkUpsert)
+	for _, doc := range docs {
+		op.Docs = append(op.Docs, doc)
+	}
+
+	return c.exec(op, func(op *Operation, origin *mgo.Collection) error {
+		bulk := origin.Bulk()
+		bulk.Unordered()
+		for _, doc := range op.Docs {
+			d, ok := doc.(bson.D)
+			if !ok {
+				return fmt.Errorf("mdb: bulk upsert document is %T, not bson.D", doc)
+			}
+			id, _ := documentId(d)
+			bulk.Upsert(bson.M{"_id": id}, d)
+		}
+
+		_, err := bulk.Run()
+		return err
+	})
+}
+
+//filter matches the range after the last copied document
+func (r *copyCheckpoint) filter(filter interface{}) bson.M {
+	idRange := bson.M{"$gte": r.Lo, "$lt": r.Hi}
+	if r.Copied > 0 {
+		idRange = bson.M{"$gt": r.Last, "$lt": r.Hi}
+	}
+
+	return bson.M{"$and": []interface{}{nonNilFilter(filter), bson.M{"_id": idRange}}}
+}
+
+func (r *copyCheckpoint) save(checkpoint *Collection) error {
+	if checkpoint == nil {
+		return nil
+	}
+
+	return checkpoint.UpdateId(r.Id, r)
+}
+
+func verifyRange(src, dst *Collection, r *CopyRange, filter interface{}) error {
+	full := &copyCheckpoint{Lo: r.Lo, Hi: r.Hi}
+
+	srcCount, srcHash, err := hashRange(src, full.filter(filter))
+	if err != nil {
+		return err
+	}
+	dstCount, dstHash, err := hashRange(dst, full.filter(filter))
+	if err != nil {
+		return err
+	}
+
+	r.SourceCount, r.DestCount = srcCount, dstCount
+	r.Match = srcCount == dstCount && bytes.Equal(srcHash, dstHash)
+	return nil
+}
+
+func hashRange(c *Collection, filter bson.M) (int, []byte, error) {
+	h := sha256.New()
+	n := 0
+
+	iter := c.Find(filter).Sort("_id").Iter()
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		h.Write(raw.Data)
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return 0, nil, err
+	}
+
+	return n, h.Sum(nil), nil
+}
+
+//throttle spaces batches to keep under rate documents per second
+type throttle struct {
+	rate int
+	mu   sync.Mutex
+	next time.Time
+}
+
+func (t *throttle) wait(n int) {
+	if t.rate <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	at := t.next
+	t.next = t.next.Add(time.Duration(n) * time.Second / time.Duration(t.rate))
+	t.mu.Unlock()
+
+	time.Sleep(at.Sub(now))
+}
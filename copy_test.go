@@ -0,0 +1,45 @@
+package mdb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestCopyRangeFilter(t *testing.T) {
+	r := &copyCheckpoint{Lo: bson.MinKey, Hi: 100}
+	filter := bson.M{"active": true}
+
+	expected := bson.M{"$and": []interface{}{filter, bson.M{"_id": bson.M{"$gte": bson.MinKey, "$lt": 100}}}}
+	if f := r.filter(filter); !reflect.DeepEqual(f, expected) {
+		t.Fatalf("unexpected filter %v", f)
+	}
+
+	r.Last, r.Copied = 42, 10
+	expected = bson.M{"$and": []interface{}{bson.M{}, bson.M{"_id": bson.M{"$gt": 42, "$lt": 100}}}}
+	if f := r.filter(nil); !reflect.DeepEqual(f, expected) {
+		t.Fatalf("resumed range must start after the last copied document, got %v", f)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	th := &throttle{rate: 1000}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		th.wait(20)
+	}
+	//the third batch waits for the first two, 40 documents at 1000/s
+	if elapsed := time.Since(start); elapsed < time.Millisecond*35 {
+		t.Fatalf("expected throttling, took %v", elapsed)
+	}
+
+	unlimited := &throttle{}
+	start = time.Now()
+	unlimited.wait(1000000)
+	if elapsed := time.Since(start); elapsed > time.Millisecond*10 {
+		t.Fatalf("expected no throttling, took %v", elapsed)
+	}
+}
@@ -81,18 +81,22 @@ func (db *Database) RemoveUser(user string) error {
 }
 
 func (db *Database) DropDatabase() error {
-	lastErr := db.Session.execWithRetry(func() error {
-		return db.originDB.DropDatabase()
+	op := &Operation{Kind: OpDropDatabase, DB: db.Name}
+	lastErr := db.Session.intercept(op, func(op *Operation) error {
+		return db.Session.execWithRetry(countRetries(op, func() error {
+			return db.originDB.DropDatabase()
+		}))
 	})
 
 	return lastErr
 }
 
 func (db *Database) FindRef(ref *mgo.DBRef) *Query {
-	return &Query{
-		session:     db.Session,
-		originQuery: db.originDB.FindRef(ref),
+	if ref.Database == "" {
+		return db.C(ref.Collection).FindId(ref.Id)
 	}
+
+	return db.Session.DB(ref.Database).C(ref.Collection).FindId(ref.Id)
 }
 
 func (db *Database) CollectionNames() ([]string, error) {
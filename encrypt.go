@@ -0,0 +1,550 @@
+package mdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	//EncryptedSubtype is the bson binary subtype of encrypted values
+	EncryptedSubtype byte = 0x80
+
+	encryptedVersion        = 1
+	randomEncryption        = 0
+	deterministicEncryption = 1
+	nonceSize               = 12
+)
+
+var ErrUnknownKey = errors.New("mdb: unknown encryption key")
+
+//KeyProvider gives the AES keys of field encryption, 16, 24 or 32 bytes long
+type KeyProvider interface {
+	//CurrentKey returns the key encrypting new values and its id, stored with the ciphertext
+	CurrentKey() (id string, key []byte, err error)
+	//Key returns the key with the id, ErrUnknownKey if there is none
+	Key(id string) ([]byte, error)
+}
+
+//StaticKeys is a KeyProvider over fixed keys, current is the id of the key encrypting new values
+func StaticKeys(current string, keys map[string][]byte) KeyProvider {
+	return &staticKeys{current: current, keys: keys}
+}
+
+type staticKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (k *staticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.current)
+	return k.current, key, err
+}
+
+func (k *staticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+//fieldCrypt encrypts the fields of a model, paths maps the encrypted paths to deterministic encryption
+type fieldCrypt struct {
+	keys  KeyProvider
+	paths map[string]bool
+}
+
+//WithEncryption returns the collection encrypting the fields of model tagged `mdb:"encrypt"`
+//with AES-GCM on Insert, Update, UpdateAll, Upsert and Query.Apply, and decrypting them
+//in Query.One, Query.All, Query.Apply results and Iter.
+//Fields tagged `mdb:"encrypt,deterministic"` encrypt equal values to equal ciphertexts
+//for equality queries, see EncryptValue.
+//Tagged fields of slice elements are encrypted too. Updates writing encrypted fields
+//with operators other than $set, $setOnInsert, $push and $addToSet fail.
+func (c *Collection) WithEncryption(model interface{}, keys KeyProvider) *Collection {
+	crypt := &fieldCrypt{keys: keys, paths: map[string]bool{}}
+	for _, field := range taggedFields(reflect.TypeOf(model), "", nil) {
+		if field.options.has("encrypt") {
+			crypt.paths[field.path] = field.options.has("deterministic")
+		}
+	}
+
+	nc := c.clone()
+	nc.crypt = crypt
+	return nc
+}
+
+//EncryptValue encrypts the value of the field path with the current key,
+//to query deterministic fields by equality
+func (c *Collection) EncryptValue(path string, value interface{}) (interface{}, error) {
+	if c.crypt == nil {
+		return nil, errors.New("mdb: collection without encryption")
+	}
+	deterministic, ok := c.crypt.paths[path]
+	if !ok {
+		return nil, fmt.Errorf("mdb: field %s isn't encrypted", path)
+	}
+
+	return c.crypt.encrypt(value, deterministic)
+}
+
+func (f *fieldCrypt) encrypt(value interface{}, deterministic bool) (bson.Binary, error) {
+	id, key, err := f.keys.CurrentKey()
+	if err != nil {
+		return bson.Binary{}, err
+	}
+	if len(id) > 255 {
+		return bson.Binary{}, fmt.Errorf("mdb: encryption key id %q too long", id)
+	}
+
+	plaintext, err := bson.Marshal(bson.D{{"v", value}})
+	if err != nil {
+		return bson.Binary{}, err
+	}
+
+	return sealValue(id, key, plaintext, deterministic)
+}
+
+//sealValue encrypts the plaintext as version, mode, key id length, key id, nonce and ciphertext.
+//Deterministic values take the nonce from an HMAC of the plaintext.
+func sealValue(id string, key []byte, plaintext []byte, deterministic bool) (bson.Binary, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return bson.Binary{}, err
+	}
+
+	mode := byte(randomEncryption)
+	nonce := make([]byte, nonceSize)
+	if deterministic {
+		mode = deterministicEncryption
+		mac := hmac.New(sha256.New, nonceKey(key))
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return bson.Binary{}, err
+	}
+
+	header := append([]byte{encryptedVersion, mode, byte(len(id))}, id...)
+	data := append(append(header, nonce...), gcm.Seal(nil, nonce, plaintext, header)...)
+	return bson.Binary{Kind: EncryptedSubtype, Data: data}, nil
+}
+
+//openValue returns the key id, the mode and the plaintext of an encrypted value
+func (f *fieldCrypt) openValue(data []byte) (string, byte, []byte, error) {
+	if len(data) < 3 || data[0] != encryptedVersion {
+		return "", 0, nil, errors.New("mdb: invalid encrypted value")
+	}
+	idEnd := 3 + int(data[2])
+	if len(data) < idEnd+nonceSize {
+		return "", 0, nil, errors.New("mdb: invalid encrypted value")
+	}
+
+	id := string(data[3:idEnd])
+	key, err := f.keys.Key(id)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("mdb: encryption key %q: %v", id, err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	nonce := data[idEnd : idEnd+nonceSize]
+	plaintext, err := gcm.Open(nil, nonce, data[idEnd+nonceSize:], data[:idEnd])
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("mdb: decrypt with key %q: %v", id, err)
+	}
+
+	return id, data[1], plaintext, nil
+}
+
+func (f *fieldCrypt) decrypt(data []byte) (interface{}, error) {
+	_, _, plaintext, err := f.openValue(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.D
+	if err := bson.Unmarshal(plaintext, &doc); err != nil || len(doc) != 1 {
+		return nil, errors.New("mdb: invalid encrypted value")
+	}
+
+	return doc[0].Value, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+//nonceKey derives the key of the deterministic nonces, so the encryption key isn't used for both
+func nonceKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("mdb deterministic nonce"))
+	return mac.Sum(nil)
+}
+
+//encryptFields encrypts the values of doc at the encrypted paths, prefix is the path of doc
+func (f *fieldCrypt) encryptFields(doc bson.D, prefix string) error {
+	for i, e := range doc {
+		value, err := f.encryptValue(e.Value, fieldPath(prefix, e.Name))
+		if err != nil {
+			return err
+		}
+		doc[i].Value = value
+	}
+
+	return nil
+}
+
+//encryptValue encrypts v if path is encrypted, else the encrypted values nested in v.
+//Array elements share the path of the array.
+func (f *fieldCrypt) encryptValue(v interface{}, path string) (interface{}, error) {
+	if deterministic, ok := f.paths[path]; ok {
+		if b, ok := v.(bson.Binary); ok && b.Kind == EncryptedSubtype {
+			return v, nil
+		}
+		return f.encrypt(v, deterministic)
+	}
+
+	switch v := v.(type) {
+	case bson.D:
+		return v, f.encryptFields(v, path)
+	case []interface{}:
+		for i := range v {
+			value, err := f.encryptValue(v[i], path)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = value
+		}
+	}
+
+	return v, nil
+}
+
+//touches reports if path is an encrypted path, a parent or a child of one
+func (f *fieldCrypt) touches(path string) bool {
+	for p := range f.paths {
+		if p == path || strings.HasPrefix(p, path+".") || strings.HasPrefix(path, p+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+//inside reports if the dotted name is a part of an encrypted value, like an element of an encrypted array
+func (f *fieldCrypt) inside(name string) bool {
+	parts := strings.Split(name, ".")
+	path := ""
+	for _, part := range parts[:len(parts)-1] {
+		path = fieldPath(path, part)
+		if _, ok := f.paths[path]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+//fieldPath joins the dotted name to prefix without array indexes and positional operators,
+//so addresses.0.street and addresses.$[].street are the path addresses.street
+func fieldPath(prefix, name string) string {
+	path := prefix
+	for _, part := range strings.Split(name, ".") {
+		if strings.HasPrefix(part, "$") || isIndex(part) {
+			continue
+		}
+		path = joinPath(path, part)
+	}
+
+	return path
+}
+
+func isIndex(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+//encryptInserts encrypts the fields of the documents
+func (c *Collection) encryptInserts(docs []interface{}) ([]interface{}, error) {
+	if c.crypt == nil {
+		return docs, nil
+	}
+
+	encrypted := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		d, err := toD(doc)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.crypt.encryptFields(d, ""); err != nil {
+			return nil, err
+		}
+		encrypted[i] = d
+	}
+
+	return encrypted, nil
+}
+
+//encryptUpdate encrypts the fields of a replacement document, of $set and $setOnInsert
+//and the values added by $push and $addToSet.
+//Other operators writing encrypted fields fail, the server can't compute on ciphertexts.
+func (c *Collection) encryptUpdate(update interface{}) (interface{}, error) {
+	if c.crypt == nil || update == nil {
+		return update, nil
+	}
+
+	doc, err := toD(update)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isOperatorUpdateD(doc) {
+		return doc, c.crypt.encryptFields(doc, "")
+	}
+
+	for _, e := range doc {
+		fields, err := operatorFields(doc, e.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.crypt.encryptOperator(e.Name, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+//encryptOperator encrypts the fields of the update operator, or fails if it would write an encrypted field in plaintext
+func (f *fieldCrypt) encryptOperator(operator string, fields bson.D) error {
+	for i, e := range fields {
+		path := fieldPath("", e.Name)
+		switch operator {
+		case "$unset", "$pop":
+			continue
+		case "$set", "$setOnInsert":
+			if f.inside(e.Name) {
+				return fmt.Errorf("mdb: %s can't update a part of the encrypted field %s", operator, e.Name)
+			}
+			value, err := f.encryptValue(e.Value, path)
+			if err != nil {
+				return err
+			}
+			fields[i].Value = value
+			continue
+		case "$push", "$addToSet":
+			//an encrypted array is a single ciphertext, its elements can't be added to
+			if _, ok := f.paths[path]; !ok && !f.inside(e.Name) {
+				value, err := f.encryptElements(e.Value, path)
+				if err != nil {
+					return err
+				}
+				fields[i].Value = value
+				continue
+			}
+		case "$rename":
+			if to, ok := e.Value.(string); ok && f.touches(fieldPath("", to)) {
+				return fmt.Errorf("mdb: %s can't update the encrypted field %s", operator, to)
+			}
+		}
+
+		if f.touches(path) {
+			return fmt.Errorf("mdb: %s can't update the encrypted field %s", operator, e.Name)
+		}
+	}
+
+	return nil
+}
+
+//encryptElements encrypts the fields of the element added to the array at path, or of its $each elements
+func (f *fieldCrypt) encryptElements(v interface{}, path string) (interface{}, error) {
+	if d, ok := v.(bson.D); ok {
+		if i := fieldIndex(d, "$each"); i >= 0 {
+			each, err := f.encryptValue(d[i].Value, path)
+			d[i].Value = each
+			return d, err
+		}
+	}
+
+	return f.encryptValue(v, path)
+}
+
+//decryptValue replaces the encrypted values nested in v
+func (f *fieldCrypt) decryptValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case bson.Binary:
+		if v.Kind == EncryptedSubtype {
+			return f.decrypt(v.Data)
+		}
+	case bson.D:
+		for i := range v {
+			value, err := f.decryptValue(v[i].Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", v[i].Name, err)
+			}
+			v[i].Value = value
+		}
+	case []interface{}:
+		for i := range v {
+			value, err := f.decryptValue(v[i])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = value
+		}
+	}
+
+	return v, nil
+}
+
+//decryptRaw returns the document with the encrypted values replaced
+func (f *fieldCrypt) decryptRaw(raw bson.Raw) (bson.Raw, error) {
+	var doc bson.D
+	if err := raw.Unmarshal(&doc); err != nil {
+		return bson.Raw{}, err
+	}
+	if _, err := f.decryptValue(doc); err != nil {
+		return bson.Raw{}, err
+	}
+
+	data, err := bson.Marshal(doc)
+	return bson.Raw{Kind: 0x03, Data: data}, err
+}
+
+//decode unmarshals the decrypted document into result
+func (f *fieldCrypt) decode(raw bson.Raw, result interface{}) error {
+	decrypted, err := f.decryptRaw(raw)
+	if err != nil {
+		return err
+	}
+
+	return decrypted.Unmarshal(result)
+}
+
+//decodeAll unmarshals the decrypted documents into result, a pointer to a slice
+func (f *fieldCrypt) decodeAll(docs []bson.Raw, result interface{}) error {
+	decrypted := make([]bson.Raw, len(docs))
+	for i, raw := range docs {
+		var err error
+		if decrypted[i], err = f.decryptRaw(raw); err != nil {
+			return err
+		}
+	}
+
+	return decodeDocuments(decrypted, result)
+}
+
+//RotateEncryptionKeys re-encrypts with the current key the values of the documents matching filter,
+//soft deleted ones included, encrypted with other keys, and returns the number of updated documents.
+//A document changed meanwhile is skipped, its new values have the current key.
+//Until the rotation is over, deterministic fields of not yet rotated documents don't match EncryptValue.
+func (c *Collection) RotateEncryptionKeys(filter interface{}) (int, error) {
+	if c.crypt == nil {
+		return 0, errors.New("mdb: collection without encryption")
+	}
+	current, _, err := c.crypt.keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	//reads the ciphertexts and writes them as they are, soft deleted documents included
+	raw := c.clone()
+	raw.crypt, raw.timestamps, raw.validator = nil, nil, nil
+	raw.deletedField = ""
+
+	n := 0
+	iter := raw.Find(filter).Iter()
+	var doc bson.D
+	for iter.Next(&doc) {
+		selector := bson.M{}
+		set := bson.M{}
+		if err := c.crypt.rotate(doc, "", current, selector, set); err != nil {
+			iter.Close()
+			return n, err
+		}
+		id, _ := documentId(doc)
+		doc = nil
+		if len(set) == 0 {
+			continue
+		}
+
+		selector["_id"] = id
+		err := raw.Update(selector, bson.M{"$set": set})
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			iter.Close()
+			return n, err
+		}
+		n++
+	}
+
+	return n, iter.Close()
+}
+
+//rotate collects in set the values of v not encrypted with the current key, re-encrypted,
+//and in selector their current ciphertexts
+func (f *fieldCrypt) rotate(v interface{}, path string, current string, selector, set bson.M) error {
+	switch v := v.(type) {
+	case bson.Binary:
+		if v.Kind != EncryptedSubtype {
+			return nil
+		}
+		id, mode, plaintext, err := f.openValue(v.Data)
+		if err != nil || id == current {
+			return err
+		}
+		_, key, err := f.keys.CurrentKey()
+		if err != nil {
+			return err
+		}
+		rotated, err := sealValue(current, key, plaintext, mode == deterministicEncryption)
+		if err != nil {
+			return err
+		}
+		selector[path] = v
+		set[path] = rotated
+	case bson.D:
+		for _, e := range v {
+			if err := f.rotate(e.Value, joinPath(path, e.Name), current, selector, set); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if err := f.rotate(e, joinPath(path, strconv.Itoa(i)), current, selector, set); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func joinPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "." + name
+}
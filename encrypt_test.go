@@ -0,0 +1,186 @@
+package mdb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ZloyDyadka/mdb/internal/mongotest"
+	"github.com/globalsign/mgo/bson"
+)
+
+type encryptedAddress struct {
+	Street string `bson:"street" mdb:"encrypt"`
+}
+
+type encryptedPerson struct {
+	Id      int              `bson:"_id"`
+	Name    string           `bson:"name"`
+	SSN     string           `bson:"ssn" mdb:"encrypt,deterministic"`
+	Age     int              `bson:"age" mdb:"encrypt"`
+	Address encryptedAddress `bson:"address"`
+}
+
+func TestFieldEncryption(t *testing.T) {
+	keys := map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32), "k2": bytes.Repeat([]byte{2}, 32)}
+	person := encryptedPerson{Id: 1, Name: "Ale", SSN: "123", Age: 30, Address: encryptedAddress{Street: "Main"}}
+
+	server := newFakeServer(t)
+	c := server.Dial(0).DB("test").C("people").WithEncryption(encryptedPerson{}, StaticKeys("k1", keys))
+
+	docs, err := c.encryptInserts([]interface{}{person})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := docs[0].(bson.D).Map()
+	if doc["name"] != "Ale" {
+		t.Fatalf("expected plain fields to be kept, got %v", doc)
+	}
+	for _, v := range []interface{}{doc["ssn"], doc["age"], doc["address"].(bson.D).Map()["street"]} {
+		if b, ok := v.(bson.Binary); !ok || b.Kind != EncryptedSubtype {
+			t.Fatalf("expected encrypted fields, got %v", doc)
+		}
+	}
+
+	ssn, err := c.EncryptValue("ssn", "123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ssn.(bson.Binary).Data, doc["ssn"].(bson.Binary).Data) {
+		t.Fatal("expected deterministic fields to encrypt equal values equally")
+	}
+	if again, _ := c.crypt.encrypt(30, false); bytes.Equal(again.Data, doc["age"].(bson.Binary).Data) {
+		t.Fatal("expected random encryption of other fields")
+	}
+
+	server.Handle(func(op *fakeOp) []bson.M {
+		return []bson.M{doc}
+	})
+	var loaded encryptedPerson
+	if err := c.FindId(1).One(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded != person {
+		t.Fatalf("expected the decrypted document, got %+v", loaded)
+	}
+
+	update, err := c.encryptUpdate(bson.M{"$set": bson.M{"address.street": "Side", "name": "Bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set := update.(bson.D).Map()["$set"].(bson.D).Map(); set["name"] != "Bob" || set["address.street"] == "Side" {
+		t.Fatalf("expected the dotted encrypted field to be encrypted, got %v", set)
+	}
+
+	rotated := c.WithEncryption(encryptedPerson{}, StaticKeys("k2", keys))
+	var raw bson.D
+	data, _ := bson.Marshal(doc)
+	bson.Unmarshal(data, &raw)
+	selector, set := bson.M{}, bson.M{}
+	if err := rotated.crypt.rotate(raw, "", "k2", selector, set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 3 || selector["address.street"] == nil {
+		t.Fatalf("expected the 3 encrypted fields to be rotated, got %v", set)
+	}
+	if street, err := rotated.crypt.decrypt(set["address.street"].(bson.Binary).Data); err != nil || street != "Main" {
+		t.Fatalf("expected the rotated value to decrypt, got %v %v", street, err)
+	}
+}
+
+type encryptedCustomer struct {
+	Id        int                `bson:"_id"`
+	Addresses []encryptedAddress `bson:"addresses"`
+	Tags      []string           `bson:"tags" mdb:"encrypt"`
+	Age       int                `bson:"age" mdb:"encrypt"`
+}
+
+func isEncrypted(v interface{}) bool {
+	b, ok := v.(bson.Binary)
+	return ok && b.Kind == EncryptedSubtype
+}
+
+func TestEncryptArrays(t *testing.T) {
+	keys := StaticKeys("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	c := (&Collection{}).WithEncryption(encryptedCustomer{}, keys)
+
+	docs, err := c.encryptInserts([]interface{}{encryptedCustomer{
+		Id:        1,
+		Addresses: []encryptedAddress{{"Main"}, {"Side"}},
+		Tags:      []string{"vip"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := docs[0].(bson.D).Map()
+	for _, address := range doc["addresses"].([]interface{}) {
+		if !isEncrypted(address.(bson.D).Map()["street"]) {
+			t.Fatalf("expected the fields of array elements encrypted, got %v", doc)
+		}
+	}
+	if !isEncrypted(doc["tags"]) {
+		t.Fatalf("expected the encrypted array as one value, got %v", doc)
+	}
+
+	update, err := c.encryptUpdate(bson.M{
+		"$set":      bson.M{"addresses.1.street": "Other"},
+		"$push":     bson.M{"addresses": bson.M{"street": "New"}},
+		"$addToSet": bson.M{"addresses": bson.M{"$each": []interface{}{bson.M{"street": "Each"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := update.(bson.D).Map()
+	if !isEncrypted(fields["$set"].(bson.D).Map()["addresses.1.street"]) {
+		t.Fatalf("expected the indexed field encrypted, got %v", fields["$set"])
+	}
+	if !isEncrypted(fields["$push"].(bson.D).Map()["addresses"].(bson.D).Map()["street"]) {
+		t.Fatalf("expected the pushed element encrypted, got %v", fields["$push"])
+	}
+	each := fields["$addToSet"].(bson.D).Map()["addresses"].(bson.D).Map()["$each"].([]interface{})
+	if !isEncrypted(each[0].(bson.D).Map()["street"]) {
+		t.Fatalf("expected the $each elements encrypted, got %v", each)
+	}
+
+	for _, update := range []bson.M{
+		{"$push": bson.M{"tags": "new"}},
+		{"$inc": bson.M{"age": 1}},
+		{"$pull": bson.M{"addresses": bson.M{"street": "Main"}}},
+		{"$rename": bson.M{"name": "age"}},
+		{"$set": bson.M{"tags.0": "vip"}},
+	} {
+		if _, err := c.encryptUpdate(update); err == nil {
+			t.Fatalf("expected %v to fail on the encrypted field", update)
+		}
+	}
+	if _, err := c.encryptUpdate(bson.M{"$unset": bson.M{"age": ""}, "$inc": bson.M{"visits": 1}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateEncryptionKeysOfDeletedDocuments(t *testing.T) {
+	keys := map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32), "k2": bytes.Repeat([]byte{2}, 32)}
+	server := mongotest.NewServer(t)
+	c := Wrap(server.Dial(), 0, time.Millisecond).DB("test").C("people").WithSoftDelete("")
+
+	old := c.WithEncryption(encryptedPerson{}, StaticKeys("k1", keys))
+	for id := 1; id <= 2; id++ {
+		if err := old.Insert(encryptedPerson{Id: id, SSN: "123"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := old.RemoveId(2); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := c.WithEncryption(encryptedPerson{}, StaticKeys("k2", keys))
+	if n, err := rotated.RotateEncryptionKeys(nil); err != nil || n != 2 {
+		t.Fatalf("expected the 2 documents rotated, got %d %v", n, err)
+	}
+	for _, doc := range server.Docs("test.people", nil) {
+		id, _, _, err := rotated.crypt.openValue(doc.Map()["ssn"].(bson.Binary).Data)
+		if err != nil || id != "k2" {
+			t.Fatalf("expected the current key, got %q %v in %v", id, err, doc)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package mdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	DefaultImportBatchSize = 1000
+	maxDocumentSize        = 16 * 1024 * 1024
+)
+
+type formatKind int
+
+const (
+	formatJSONLines formatKind = iota
+	formatJSONArray
+	formatCSV
+	formatBSON
+)
+
+//Format is the file format of Collection.Export and Collection.Import
+type Format struct {
+	kind      formatKind
+	canonical bool
+	fields    []string
+}
+
+var (
+	//JSONLines is one relaxed extended JSON document per line
+	JSONLines = Format{kind: formatJSONLines}
+	//CanonicalJSONLines is one canonical extended JSON document per line
+	CanonicalJSONLines = Format{kind: formatJSONLines, canonical: true}
+	//RelaxedJSON is an array of relaxed extended JSON documents
+	RelaxedJSON = Format{kind: formatJSONArray}
+	//CanonicalJSON is an array of canonical extended JSON documents
+	CanonicalJSON = Format{kind: formatJSONArray, canonical: true}
+	//BSONDump is the mongodump .bson format
+	BSONDump = Format{kind: formatBSON}
+)
+
+//CSV exports the fields, which may be dotted paths, with a header line.
+//Imports read the field names from the header line, values are imported as strings
+//unless converted with ImportOptions.ColumnTypes, and empty values are left out.
+func CSV(fields ...string) Format {
+	return Format{kind: formatCSV, fields: fields}
+}
+
+//ImportOptions controls Collection.Import
+type ImportOptions struct {
+	//BatchSize is the number of documents per insert, DefaultImportBatchSize by default
+	BatchSize int
+	//Resume skips documents whose _id is already in the collection,
+	//so an interrupted import can be run again
+	Resume bool
+	//ColumnTypes converts the values of the named CSV columns, the others are strings
+	ColumnTypes map[string]ColumnType
+}
+
+//ColumnType converts the values of a CSV column on import
+type ColumnType int
+
+const (
+	ColumnString ColumnType = iota
+	//ColumnInt is an int, or an int64 if it doesn't fit 32 bits
+	ColumnInt
+	ColumnFloat
+	ColumnBool
+	//ColumnNumber is a ColumnInt if the value is integral, a ColumnFloat otherwise
+	ColumnNumber
+)
+
+type ImportResult struct {
+	Inserted int
+	//Skipped documents were already imported
+	Skipped int
+}
+
+//Export writes the documents matching query to w and returns how many were written
+func (c *Collection) Export(w io.Writer, query interface{}, format Format) (int, error) {
+	if format.kind == formatCSV && len(format.fields) == 0 {
+		return 0, errors.New("mdb: csv export requires fields")
+	}
+
+	bw := bufio.NewWriter(w)
+	var cw *csv.Writer
+	switch format.kind {
+	case formatCSV:
+		cw = csv.NewWriter(bw)
+		if err := cw.Write(format.fields); err != nil {
+			return 0, err
+		}
+	case formatJSONArray:
+		bw.WriteString("[")
+	}
+
+	n := 0
+	iter := c.Find(query).Iter()
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		if err := exportDocument(bw, cw, raw, format, n); err != nil {
+			iter.Close()
+			return n, err
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return n, err
+	}
+
+	switch format.kind {
+	case formatCSV:
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return n, err
+		}
+	case formatJSONArray:
+		bw.WriteString("\n]\n")
+	}
+
+	return n, bw.Flush()
+}
+
+func exportDocument(w *bufio.Writer, cw *csv.Writer, raw bson.Raw, format Format, i int) error {
+	switch format.kind {
+	case formatBSON:
+		_, err := w.Write(raw.Data)
+		return err
+	case formatCSV:
+		var doc bson.M
+		if err := raw.Unmarshal(&doc); err != nil {
+			return err
+		}
+		record := make([]string, len(format.fields))
+		for j, field := range format.fields {
+			v, _ := lookupPath(doc, field)
+			s, err := csvValue(v)
+			if err != nil {
+				return err
+			}
+			record[j] = s
+		}
+		return cw.Write(record)
+	}
+
+	var doc bson.D
+	if err := raw.Unmarshal(&doc); err != nil {
+		return err
+	}
+	data, err := marshalExtJSON(doc, format.canonical)
+	if err != nil {
+		return err
+	}
+
+	if format.kind == formatJSONArray {
+		if i > 0 {
+			w.WriteString(",")
+		}
+		w.WriteString("\n")
+	}
+	w.Write(data)
+	if format.kind == formatJSONLines {
+		w.WriteString("\n")
+	}
+
+	return nil
+}
+
+func csvValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bson.ObjectId:
+		return v.Hex(), nil
+	case time.Time:
+		return v.UTC().Format("2006-01-02T15:04:05.000Z07:00"), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	}
+
+	//nested documents are unordered bson.M, keys are sorted to keep the output stable
+	var buf bytes.Buffer
+	err := writeExtJSON(&buf, sortedKeys(v), false)
+	return buf.String(), err
+}
+
+//Import inserts the documents read from r in batches
+func (c *Collection) Import(r io.Reader, format Format, opts ImportOptions) (*ImportResult, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultImportBatchSize
+	}
+
+	next, err := documentReader(r, format, opts.ColumnTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{}
+	batch := make([]bson.D, 0, opts.BatchSize)
+	for {
+		doc, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("mdb: import document %d: %v", result.Inserted+result.Skipped+len(batch)+1, err)
+		}
+
+		batch = append(batch, doc)
+		if len(batch) == opts.BatchSize {
+			if err := c.importBatch(batch, opts.Resume, result); err != nil {
+				return result, err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := c.importBatch(batch, opts.Resume, result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+func (c *Collection) importBatch(batch []bson.D, resume bool, result *ImportResult) error {
+	docs := batch
+	if resume {
+		var err error
+		if docs, err = c.notImported(batch); err != nil {
+			return err
+		}
+	}
+
+	err := c.insertDocuments(docs)
+	if resume && mgo.IsDup(err) {
+		//part of the batch was inserted before a retry
+		if docs, err = c.notImported(batch); err != nil {
+			return err
+		}
+		err = c.insertDocuments(docs)
+	}
+	if err != nil {
+		return err
+	}
+
+	result.Inserted += len(docs)
+	result.Skipped += len(batch) - len(docs)
+	return nil
+}
+
+func (c *Collection) insertDocuments(docs []bson.D) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	values := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		values[i] = doc
+	}
+
+	return c.Insert(values...)
+}
+
+//notImported filters out documents whose _id is already in the collection,
+//documents without _id are always kept
+func (c *Collection) notImported(batch []bson.D) ([]bson.D, error) {
+	var ids []interface{}
+	for _, doc := range batch {
+		if id, ok := documentId(doc); ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return batch, nil
+	}
+
+	var existing []struct {
+		Id interface{} `bson:"_id"`
+	}
+	err := c.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).All(&existing)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := make(map[string]bool, len(existing))
+	for _, doc := range existing {
+		key, err := canonicalBson(doc.Id)
+		if err != nil {
+			return nil, err
+		}
+		imported[string(key)] = true
+	}
+
+	docs := make([]bson.D, 0, len(batch))
+	for _, doc := range batch {
+		if id, ok := documentId(doc); ok {
+			key, err := canonicalBson(id)
+			if err != nil {
+				return nil, err
+			}
+			if imported[string(key)] {
+				continue
+			}
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+func documentId(doc bson.D) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Name == "_id" {
+			return e.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+//documentReader returns a function reading the next document, io.EOF at the end
+func documentReader(r io.Reader, format Format, types map[string]ColumnType) (func() (bson.D, error), error) {
+	br := bufio.NewReader(r)
+
+	switch format.kind {
+	case formatBSON:
+		return func() (bson.D, error) {
+			var size [4]byte
+			if _, err := io.ReadFull(br, size[:]); err != nil {
+				if err == io.ErrUnexpectedEOF {
+					return nil, errors.New("mdb: truncated bson document")
+				}
+				return nil, err
+			}
+
+			n := binary.LittleEndian.Uint32(size[:])
+			if n < 5 || n > maxDocumentSize {
+				return nil, fmt.Errorf("mdb: invalid bson document size %d", n)
+			}
+			data := make([]byte, n)
+			copy(data, size[:])
+			if _, err := io.ReadFull(br, data[4:]); err != nil {
+				return nil, errors.New("mdb: truncated bson document")
+			}
+
+			var doc bson.D
+			err := bson.Unmarshal(data, &doc)
+			return doc, err
+		}, nil
+
+	case formatJSONLines:
+		scanner := bufio.NewScanner(br)
+		scanner.Buffer(make([]byte, 64*1024), maxDocumentSize*2)
+		return func() (bson.D, error) {
+			for scanner.Scan() {
+				line := bytes.TrimSpace(scanner.Bytes())
+				if len(line) == 0 {
+					continue
+				}
+				return UnmarshalExtJSON(line)
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}, nil
+
+	case formatJSONArray:
+		dec := json.NewDecoder(br)
+		if token, err := dec.Token(); err != nil || token != json.Delim('[') {
+			return nil, errors.New("mdb: json import expects an array of documents")
+		}
+		return func() (bson.D, error) {
+			if !dec.More() {
+				return nil, io.EOF
+			}
+			var data json.RawMessage
+			if err := dec.Decode(&data); err != nil {
+				return nil, err
+			}
+			return UnmarshalExtJSON(data)
+		}, nil
+
+	case formatCSV:
+		cr := csv.NewReader(br)
+		header, err := cr.Read()
+		if err == io.EOF {
+			return func() (bson.D, error) { return nil, io.EOF }, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func() (bson.D, error) {
+			record, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+
+			var doc bson.D
+			for i, value := range record {
+				if value == "" || i >= len(header) {
+					continue
+				}
+				v, err := csvImportValue(value, types[header[i]])
+				if err != nil {
+					return nil, fmt.Errorf("column %s: %v", header[i], err)
+				}
+				doc = setPath(doc, strings.Split(header[i], "."), v)
+			}
+			return doc, nil
+		}, nil
+	}
+
+	return nil, errors.New("mdb: unknown format")
+}
+
+func csvImportValue(s string, t ColumnType) (interface{}, error) {
+	switch t {
+	case ColumnString:
+		return s, nil
+	case ColumnBool:
+		return strconv.ParseBool(s)
+	case ColumnFloat:
+		return strconv.ParseFloat(s, 64)
+	}
+
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		if int64(int32(i)) == i {
+			return int(i), nil
+		}
+		return i, nil
+	}
+	if t == ColumnNumber {
+		return strconv.ParseFloat(s, 64)
+	}
+
+	return nil, err
+}
+
+//setPath sets the dotted path in doc, creating nested documents
+func setPath(doc bson.D, path []string, value interface{}) bson.D {
+	for i, e := range doc {
+		if e.Name != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			doc[i].Value = value
+			return doc
+		}
+		nested, _ := e.Value.(bson.D)
+		doc[i].Value = setPath(nested, path[1:], value)
+		return doc
+	}
+
+	if len(path) == 1 {
+		return append(doc, bson.DocElem{Name: path[0], Value: value})
+	}
+
+	return append(doc, bson.DocElem{Name: path[0], Value: setPath(nil, path[1:], value)})
+}
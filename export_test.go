@@ -0,0 +1,144 @@
+package mdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func extJSONDocument() bson.D {
+	return bson.D{
+		{"_id", bson.ObjectIdHex("5a934e000102030405000000")},
+		{"name", "Ale"},
+		{"age", 33},
+		{"visits", int64(1) << 40},
+		{"score", 1.0},
+		{"born", time.Date(1985, 4, 12, 23, 20, 50, 520*int(time.Millisecond), time.UTC)},
+		{"photo", []byte("png")},
+		{"tags", []interface{}{"a", bson.D{{"b", math.Inf(1)}}}},
+		{"pattern", bson.RegEx{Pattern: "^a", Options: "i"}},
+		{"missing", nil},
+	}
+}
+
+func TestExtJSONRoundTrip(t *testing.T) {
+	doc := extJSONDocument()
+
+	for _, canonical := range []bool{true, false} {
+		data, err := marshalExtJSON(doc, canonical)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := UnmarshalExtJSON(data)
+		if err != nil {
+			t.Fatalf("canonical %v: %v in %s", canonical, err, data)
+		}
+
+		born := decoded[5].Value.(time.Time)
+		if !born.Equal(doc[5].Value.(time.Time)) {
+			t.Fatalf("canonical %v: unexpected date %v", canonical, born)
+		}
+		decoded[5].Value = doc[5].Value
+
+		if !reflect.DeepEqual(decoded, doc) {
+			t.Fatalf("canonical %v: round trip changed the document\n%#v\n%s", canonical, decoded, data)
+		}
+	}
+
+	data, _ := marshalExtJSON(bson.D{{"n", 1}, {"f", 2.0}}, true)
+	if string(data) != `{"n":{"$numberInt":"1"},"f":{"$numberDouble":"2.0"}}` {
+		t.Fatalf("unexpected canonical json %s", data)
+	}
+	data, _ = marshalExtJSON(bson.D{{"n", 1}, {"f", 2.0}}, false)
+	if string(data) != `{"n":1,"f":2.0}` {
+		t.Fatalf("unexpected relaxed json %s", data)
+	}
+}
+
+func TestExportImportFormats(t *testing.T) {
+	doc := bson.D{{"_id", 1}, {"name", "Ale"}, {"address", bson.D{{"city", "Pelotas"}}}}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := bson.Raw{Kind: 3, Data: data}
+
+	for _, format := range []Format{JSONLines, CanonicalJSONLines, BSONDump, CSV("_id", "name", "address.city")} {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		cw := csv.NewWriter(w)
+		if format.kind == formatCSV {
+			cw.Write(format.fields)
+		}
+		for i := 0; i < 2; i++ {
+			if err := exportDocument(w, cw, raw, format, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cw.Flush()
+		w.Flush()
+
+		next, err := documentReader(&buf, format, map[string]ColumnType{"_id": ColumnInt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			imported, err := next()
+			if err != nil {
+				t.Fatalf("format %+v: %v", format, err)
+			}
+			if !reflect.DeepEqual(imported, doc) {
+				t.Fatalf("format %+v: unexpected document %#v", format, imported)
+			}
+		}
+		if _, err := next(); err != io.EOF {
+			t.Fatalf("format %+v: expected EOF, got %v", format, err)
+		}
+	}
+
+	next, err := documentReader(strings.NewReader(`[{"_id": 1}, {"_id": {"$oid": "5a934e000102030405000000"}}]`), RelaxedJSON, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := next(); err != nil || doc[0].Value != 1 {
+		t.Fatalf("unexpected first document %v %v", doc, err)
+	}
+	if doc, err := next(); err != nil || doc[0].Value != bson.ObjectIdHex("5a934e000102030405000000") {
+		t.Fatalf("unexpected second document %v %v", doc, err)
+	}
+}
+
+func TestImportCSVColumnTypes(t *testing.T) {
+	input := "zip,age,score,ratio,active\n007,41,3,0.5,true\n"
+	types := map[string]ColumnType{"age": ColumnInt, "score": ColumnNumber, "ratio": ColumnNumber, "active": ColumnBool}
+
+	next, err := documentReader(strings.NewReader(input), CSV(), types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{"zip", "007"}, {"age", 41}, {"score", 3}, {"ratio", 0.5}, {"active", true}}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("unexpected document %#v", doc)
+	}
+
+	next, err = documentReader(strings.NewReader("age\nunknown\n"), CSV(), types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := next(); err == nil || !strings.Contains(err.Error(), "column age") {
+		t.Fatalf("expected a conversion error, got %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+package mdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+//extended JSON v2, see https://github.com/mongodb/specifications/blob/master/source/extended-json.rst
+
+//MarshalExtJSON encodes a document of any type as canonical or relaxed extended JSON
+func MarshalExtJSON(doc interface{}, canonical bool) ([]byte, error) {
+	d, ok := doc.(bson.D)
+	if !ok {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		if err := bson.Unmarshal(data, &d); err != nil {
+			return nil, err
+		}
+	}
+
+	return marshalExtJSON(d, canonical)
+}
+
+func marshalExtJSON(doc bson.D, canonical bool) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeExtJSON(&buf, doc, canonical); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeExtJSON(buf *bytes.Buffer, v interface{}, canonical bool) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case string:
+		writeJSONString(buf, v)
+	case bson.D:
+		buf.WriteByte('{')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, e.Name)
+			buf.WriteByte(':')
+			if err := writeExtJSON(buf, e.Value, canonical); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeExtJSON(buf, e, canonical); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case int:
+		if canonical {
+			fmt.Fprintf(buf, `{"$numberInt":"%d"}`, v)
+		} else {
+			buf.WriteString(strconv.Itoa(v))
+		}
+	case int64:
+		if canonical {
+			fmt.Fprintf(buf, `{"$numberLong":"%d"}`, v)
+		} else {
+			buf.WriteString(strconv.FormatInt(v, 10))
+		}
+	case float64:
+		writeExtDouble(buf, v, canonical)
+	case bson.Decimal128:
+		fmt.Fprintf(buf, `{"$numberDecimal":"%s"}`, v.String())
+	case bson.ObjectId:
+		fmt.Fprintf(buf, `{"$oid":"%s"}`, v.Hex())
+	case time.Time:
+		ms := v.UnixNano() / int64(time.Millisecond)
+		if !canonical && v.Year() >= 1970 && v.Year() <= 9999 {
+			fmt.Fprintf(buf, `{"$date":"%s"}`, v.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		} else {
+			fmt.Fprintf(buf, `{"$date":{"$numberLong":"%d"}}`, ms)
+		}
+	case []byte:
+		writeExtBinary(buf, v, 0)
+	case bson.Binary:
+		writeExtBinary(buf, v.Data, v.Kind)
+	case bson.RegEx:
+		buf.WriteString(`{"$regularExpression":{"pattern":`)
+		writeJSONString(buf, v.Pattern)
+		buf.WriteString(`,"options":`)
+		writeJSONString(buf, v.Options)
+		buf.WriteString("}}")
+	case bson.MongoTimestamp:
+		fmt.Fprintf(buf, `{"$timestamp":{"t":%d,"i":%d}}`, uint64(v)>>32, uint32(v))
+	case bson.JavaScript:
+		buf.WriteString(`{"$code":`)
+		writeJSONString(buf, v.Code)
+		if v.Scope != nil {
+			buf.WriteString(`,"$scope":`)
+			if err := writeExtJSON(buf, v.Scope, canonical); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case bson.Symbol:
+		buf.WriteString(`{"$symbol":`)
+		writeJSONString(buf, string(v))
+		buf.WriteByte('}')
+	default:
+		switch v {
+		case bson.MinKey:
+			buf.WriteString(`{"$minKey":1}`)
+		case bson.MaxKey:
+			buf.WriteString(`{"$maxKey":1}`)
+		case bson.Undefined:
+			buf.WriteString(`{"$undefined":true}`)
+		default:
+			return fmt.Errorf("mdb: can't encode %T as extended JSON", v)
+		}
+	}
+
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	data, _ := json.Marshal(s)
+	buf.Write(data)
+}
+
+func writeExtDouble(buf *bytes.Buffer, f float64, canonical bool) {
+	var s string
+	switch {
+	case math.IsNaN(f):
+		s = "NaN"
+	case math.IsInf(f, 1):
+		s = "Infinity"
+	case math.IsInf(f, -1):
+		s = "-Infinity"
+	default:
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+		if !bytes.ContainsAny([]byte(s), ".eE") {
+			s += ".0"
+		}
+		if !canonical {
+			buf.WriteString(s)
+			return
+		}
+	}
+
+	fmt.Fprintf(buf, `{"$numberDouble":"%s"}`, s)
+}
+
+func writeExtBinary(buf *bytes.Buffer, data []byte, kind byte) {
+	fmt.Fprintf(buf, `{"$binary":{"base64":"%s","subType":"%02x"}}`, base64.StdEncoding.EncodeToString(data), kind)
+}
+
+//UnmarshalExtJSON decodes a canonical or relaxed extended JSON document
+func UnmarshalExtJSON(data []byte) (bson.D, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	v, err := readExtJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, ok := v.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("mdb: extended JSON value is %T, not a document", v)
+	}
+
+	return doc, nil
+}
+
+func readExtJSON(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := token.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			var doc bson.D
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := readExtJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				doc = append(doc, bson.DocElem{Name: key.(string), Value: value})
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return extValue(doc)
+		case '[':
+			values := []interface{}{}
+			for dec.More() {
+				value, err := readExtJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, value)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return values, nil
+		}
+	case json.Number:
+		return relaxedNumber(t)
+	case nil, bool, string:
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("mdb: unexpected extended JSON token %v", token)
+}
+
+//relaxedNumber gives int32 range integers as int, like bson.Unmarshal does
+func relaxedNumber(n json.Number) (interface{}, error) {
+	if i, err := n.Int64(); err == nil {
+		if i >= math.MinInt32 && i <= math.MaxInt32 {
+			return int(i), nil
+		}
+		return i, nil
+	}
+
+	return n.Float64()
+}
+
+//extValue converts a document with a type wrapper key like $oid to the value
+func extValue(doc bson.D) (interface{}, error) {
+	if len(doc) == 0 || len(doc[0].Name) == 0 || doc[0].Name[0] != '$' {
+		return doc, nil
+	}
+
+	m := doc.Map()
+	str := func(key string) (string, error) {
+		s, ok := m[key].(string)
+		if !ok {
+			return "", fmt.Errorf("mdb: invalid extended JSON %s", key)
+		}
+		return s, nil
+	}
+
+	switch doc[0].Name {
+	case "$oid":
+		s, err := str("$oid")
+		if err != nil || !bson.IsObjectIdHex(s) {
+			return nil, fmt.Errorf("mdb: invalid extended JSON $oid")
+		}
+		return bson.ObjectIdHex(s), nil
+	case "$numberInt":
+		s, err := str("$numberInt")
+		if err != nil {
+			return nil, err
+		}
+		i, err := strconv.ParseInt(s, 10, 32)
+		return int(i), err
+	case "$numberLong":
+		s, err := str("$numberLong")
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case "$numberDouble":
+		s, err := str("$numberDouble")
+		if err != nil {
+			return nil, err
+		}
+		switch s {
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		case "NaN":
+			return math.NaN(), nil
+		}
+		return strconv.ParseFloat(s, 64)
+	case "$numberDecimal":
+		s, err := str("$numberDecimal")
+		if err != nil {
+			return nil, err
+		}
+		return bson.ParseDecimal128(s)
+	case "$date":
+		switch d := m["$date"].(type) {
+		case string:
+			return time.Parse(time.RFC3339Nano, d)
+		case int64:
+			return time.Unix(0, d*int64(time.Millisecond)), nil
+		case int:
+			return time.Unix(0, int64(d)*int64(time.Millisecond)), nil
+		}
+		return nil, fmt.Errorf("mdb: invalid extended JSON $date")
+	case "$binary":
+		b, ok := m["$binary"].(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("mdb: invalid extended JSON $binary")
+		}
+		bm := b.Map()
+		encoded, _ := bm["base64"].(string)
+		subType, _ := bm["subType"].(string)
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		kind, err := hex.DecodeString(subType)
+		if err != nil || len(kind) != 1 {
+			return nil, fmt.Errorf("mdb: invalid extended JSON binary subType %q", subType)
+		}
+		if kind[0] == 0 {
+			return data, nil
+		}
+		return bson.Binary{Kind: kind[0], Data: data}, nil
+	case "$regularExpression":
+		r, ok := m["$regularExpression"].(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("mdb: invalid extended JSON $regularExpression")
+		}
+		rm := r.Map()
+		pattern, _ := rm["pattern"].(string)
+		options, _ := rm["options"].(string)
+		return bson.RegEx{Pattern: pattern, Options: options}, nil
+	case "$timestamp":
+		ts, ok := m["$timestamp"].(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("mdb: invalid extended JSON $timestamp")
+		}
+		tm := ts.Map()
+		t, _ := toInt64(tm["t"])
+		i, _ := toInt64(tm["i"])
+		return bson.MongoTimestamp(t<<32 | i), nil
+	case "$code":
+		code, err := str("$code")
+		if err != nil {
+			return nil, err
+		}
+		js := bson.JavaScript{Code: code}
+		if scope, ok := m["$scope"]; ok {
+			js.Scope = scope
+		}
+		return js, nil
+	case "$symbol":
+		s, err := str("$symbol")
+		return bson.Symbol(s), err
+	case "$minKey":
+		return bson.MinKey, nil
+	case "$maxKey":
+		return bson.MaxKey, nil
+	case "$undefined":
+		return bson.Undefined, nil
+	}
+
+	//a query operator like $gt, not a type wrapper
+	return doc, nil
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,50 @@
+package mdb
+
+import (
+	"sync"
+	"time"
+)
+
+const maxRecentFailures = 32
+
+const (
+	RetryFailure   = "retry"
+	RefreshFailure = "refresh"
+	TimeoutFailure = "timeout"
+)
+
+//Failure is an operation that failed after all retries, an operation that exhausted its timeout
+//or a failed connection refresh
+type Failure struct {
+	Kind string
+	Err  error
+	Time time.Time
+}
+
+type failureLog struct {
+	mu       sync.Mutex
+	failures []Failure
+}
+
+func (l *failureLog) add(kind string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.failures) == maxRecentFailures {
+		copy(l.failures, l.failures[1:])
+		l.failures = l.failures[:maxRecentFailures-1]
+	}
+	l.failures = append(l.failures, Failure{Kind: kind, Err: err, Time: time.Now()})
+}
+
+func (l *failureLog) recent() []Failure {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]Failure(nil), l.failures...)
+}
+
+//RecentFailures returns the last retry, timeout and refresh failures, oldest first
+func (s *Session) RecentFailures() []Failure {
+	return s.failures.recent()
+}
@@ -0,0 +1,69 @@
+package mdb
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFailureLogTrim(t *testing.T) {
+	l := &failureLog{}
+	for i := 0; i < maxRecentFailures+5; i++ {
+		l.add(RetryFailure, errors.New(string(rune('a'+i))))
+	}
+
+	failures := l.recent()
+	if len(failures) != maxRecentFailures {
+		t.Fatalf("expected %d failures, got %d", maxRecentFailures, len(failures))
+	}
+	if failures[0].Err.Error() != "f" || failures[maxRecentFailures-1].Err.Error() != string(rune('a'+maxRecentFailures+4)) {
+		t.Fatalf("expected the oldest failures to be dropped, got %v ... %v", failures[0].Err, failures[maxRecentFailures-1].Err)
+	}
+}
+
+func TestExecWithRetryRecordsLastError(t *testing.T) {
+	server := newFakeServer(t)
+	s := server.Dial(2)
+
+	last := errors.New("closed explicitly")
+	calls := 0
+	err := s.execWithRetry(func() error {
+		calls++
+		if calls == 3 {
+			return last
+		}
+		return io.EOF
+	})
+
+	if err != io.EOF || calls != 3 {
+		t.Fatalf("expected 3 calls returning EOF, got %d %v", calls, err)
+	}
+
+	failures := s.RecentFailures()
+	if len(failures) != 1 || failures[0].Kind != RetryFailure || failures[0].Err != last {
+		t.Fatalf("expected the last attempt to be recorded, got %+v", failures)
+	}
+
+	if err := s.execWithRetry(func() error { return nil }); err != nil || len(s.RecentFailures()) != 1 {
+		t.Fatalf("successful call must not be recorded, got %v %+v", err, s.RecentFailures())
+	}
+}
+
+func TestRefreshRecordsFailure(t *testing.T) {
+	server := newFakeServer(t)
+	s := server.Dial(2)
+	db := s.DB("test")
+	server.Close()
+
+	db.Session.execWithRetry(func() error {
+		return io.EOF
+	})
+
+	var kinds []string
+	for _, f := range s.RecentFailures() {
+		kinds = append(kinds, f.Kind)
+	}
+	if len(kinds) != 2 || kinds[0] != RefreshFailure || kinds[1] != RetryFailure {
+		t.Fatalf("expected refresh and retry failures, got %v", kinds)
+	}
+}
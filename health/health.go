@@ -0,0 +1,214 @@
+// Package health provides an http.Handler reporting
+// health and readiness of an mdb session as JSON.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ZloyDyadka/mdb"
+	"github.com/globalsign/mgo"
+)
+
+//Session is the part of *mdb.Session used by the handler
+type Session interface {
+	Ping() error
+	LiveServers() []string
+	Mode() mgo.Mode
+	RecentFailures() []mdb.Failure
+}
+
+type Option func(h *Handler)
+
+type Handler struct {
+	session        Session
+	maxPingLatency time.Duration
+	minLiveServers int
+	maxFailures    int
+	failureWindow  time.Duration
+	checks         map[string]func() error
+	stats          func() mgo.Stats
+	now            func() time.Time
+}
+
+type Failure struct {
+	Kind  string    `json:"kind"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+type Report struct {
+	Status         string            `json:"status"`
+	Reasons        []string          `json:"reasons,omitempty"`
+	PingLatencyMS  float64           `json:"ping_latency_ms"`
+	PingError      string            `json:"ping_error,omitempty"`
+	LiveServers    []string          `json:"live_servers"`
+	Mode           string            `json:"mode"`
+	Pool           *mgo.Stats        `json:"pool,omitempty"`
+	RecentFailures []Failure         `json:"recent_failures"`
+	Checks         map[string]string `json:"checks,omitempty"`
+}
+
+const (
+	StatusOK        = "ok"
+	StatusUnhealthy = "unhealthy"
+)
+
+//MaxPingLatency marks the session unhealthy when ping takes longer
+func MaxPingLatency(d time.Duration) Option {
+	return func(h *Handler) {
+		h.maxPingLatency = d
+	}
+}
+
+//MinLiveServers marks the session unhealthy when fewer servers are alive
+func MinLiveServers(n int) Option {
+	return func(h *Handler) {
+		h.minLiveServers = n
+	}
+}
+
+//MaxFailures marks the session unhealthy when more than n retry or refresh failures happened within window
+func MaxFailures(n int, window time.Duration) Option {
+	return func(h *Handler) {
+		h.maxFailures = n
+		h.failureWindow = window
+	}
+}
+
+//Check adds a named readiness check, e.g. Monitor.Ready
+func Check(name string, check func() error) Option {
+	return func(h *Handler) {
+		h.checks[name] = check
+	}
+}
+
+//Stats enables pool stats in the report, usually Stats(mgo.GetStats).
+//mgo.GetStats must only be used after mgo.SetStats(true), it panics otherwise.
+func Stats(stats func() mgo.Stats) Option {
+	return func(h *Handler) {
+		h.stats = stats
+	}
+}
+
+//NewHandler creates a handler responding 200 when the session is healthy and 503 otherwise
+func NewHandler(session Session, opts ...Option) *Handler {
+	h := &Handler{
+		session:        session,
+		minLiveServers: 1,
+		maxFailures:    -1,
+		checks:         map[string]func() error{},
+		now:            time.Now,
+	}
+
+	for _, o := range opts {
+		o(h)
+	}
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := h.Report()
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+//Report runs the checks
+func (h *Handler) Report() Report {
+	report := Report{
+		Status:         StatusOK,
+		LiveServers:    h.session.LiveServers(),
+		Mode:           modeName(h.session.Mode()),
+		RecentFailures: []Failure{},
+	}
+
+	if h.stats != nil {
+		stats := h.stats()
+		report.Pool = &stats
+	}
+
+	start := h.now()
+	err := h.session.Ping()
+	latency := h.now().Sub(start)
+	report.PingLatencyMS = float64(latency) / float64(time.Millisecond)
+
+	if err != nil {
+		report.PingError = err.Error()
+		report.unhealthy("ping failed: %v", err)
+	} else if h.maxPingLatency > 0 && latency > h.maxPingLatency {
+		report.unhealthy("ping latency %s exceeds %s", latency, h.maxPingLatency)
+	}
+
+	if len(report.LiveServers) < h.minLiveServers {
+		report.unhealthy("%d live servers, %d required", len(report.LiveServers), h.minLiveServers)
+	}
+
+	inWindow := 0
+	for _, f := range h.session.RecentFailures() {
+		report.RecentFailures = append(report.RecentFailures, Failure{Kind: f.Kind, Error: f.Err.Error(), Time: f.Time})
+		if h.failureWindow == 0 || h.now().Sub(f.Time) <= h.failureWindow {
+			inWindow++
+		}
+	}
+
+	if h.maxFailures >= 0 && inWindow > h.maxFailures {
+		report.unhealthy("%d recent failures, %d allowed", inWindow, h.maxFailures)
+	}
+
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if report.Checks == nil {
+			report.Checks = map[string]string{}
+		}
+
+		if err := h.checks[name](); err != nil {
+			report.Checks[name] = err.Error()
+			report.unhealthy("%s: %v", name, err)
+			continue
+		}
+
+		report.Checks[name] = StatusOK
+	}
+
+	return report
+}
+
+func (r *Report) unhealthy(format string, args ...interface{}) {
+	r.Status = StatusUnhealthy
+	r.Reasons = append(r.Reasons, fmt.Sprintf(format, args...))
+}
+
+func modeName(mode mgo.Mode) string {
+	switch mode {
+	case mgo.Primary:
+		return "primary"
+	case mgo.PrimaryPreferred:
+		return "primaryPreferred"
+	case mgo.Secondary:
+		return "secondary"
+	case mgo.SecondaryPreferred:
+		return "secondaryPreferred"
+	case mgo.Nearest:
+		return "nearest"
+	case mgo.Eventual:
+		return "eventual"
+	case mgo.Monotonic:
+		return "monotonic"
+	}
+
+	return fmt.Sprintf("mode(%d)", mode)
+}
@@ -0,0 +1,77 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ZloyDyadka/mdb"
+	"github.com/globalsign/mgo"
+)
+
+type fakeSession struct {
+	pingErr  error
+	servers  []string
+	failures []mdb.Failure
+}
+
+func (s *fakeSession) Ping() error                   { return s.pingErr }
+func (s *fakeSession) LiveServers() []string         { return s.servers }
+func (s *fakeSession) Mode() mgo.Mode                { return mgo.SecondaryPreferred }
+func (s *fakeSession) RecentFailures() []mdb.Failure { return s.failures }
+
+func serve(t *testing.T, h http.Handler) (int, Report) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec.Code, report
+}
+
+func TestHandlerHealthy(t *testing.T) {
+	s := &fakeSession{servers: []string{"127.0.0.1:27017"}}
+	code, report := serve(t, NewHandler(s, Stats(func() mgo.Stats { return mgo.Stats{SocketsAlive: 3} })))
+
+	if code != http.StatusOK || report.Status != StatusOK {
+		t.Fatalf("expected healthy, got %d %+v", code, report)
+	}
+	if report.Mode != "secondaryPreferred" || report.Pool == nil || report.Pool.SocketsAlive != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestHandlerUnhealthy(t *testing.T) {
+	now := time.Now()
+	s := &fakeSession{
+		servers: []string{"127.0.0.1:27017"},
+		failures: []mdb.Failure{
+			{Kind: mdb.RetryFailure, Err: errors.New("EOF"), Time: now.Add(-time.Hour)},
+			{Kind: mdb.RetryFailure, Err: errors.New("EOF"), Time: now},
+			{Kind: mdb.RefreshFailure, Err: errors.New("no reachable servers"), Time: now},
+		},
+	}
+
+	h := NewHandler(s, MaxFailures(2, time.Minute), Stats(func() mgo.Stats { return mgo.Stats{} }))
+	if code, report := serve(t, h); code != http.StatusOK || len(report.RecentFailures) != 3 {
+		t.Fatalf("expected healthy with 3 failures, got %d %+v", code, report)
+	}
+
+	h = NewHandler(s, MaxFailures(1, time.Minute), Check("monitor", func() error { return mdb.ErrNoPrimary }))
+	code, report := serve(t, h)
+	if code != http.StatusServiceUnavailable || len(report.Reasons) != 2 {
+		t.Fatalf("expected unhealthy with 2 reasons, got %d %+v", code, report)
+	}
+
+	s.pingErr = errors.New("no reachable servers")
+	s.failures = nil
+	if code, report := serve(t, NewHandler(s)); code != http.StatusServiceUnavailable || report.PingError == "" {
+		t.Fatalf("expected ping failure, got %d %+v", code, report)
+	}
+}
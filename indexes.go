@@ -0,0 +1,292 @@
+package mdb
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const idIndexName = "_id_"
+
+//SyncOptions controls Collection.SyncIndexes
+type SyncOptions struct {
+	//DryRun only computes the report
+	DryRun bool
+	//DropUndeclared drops existing indexes missing from the spec, except _id
+	DropUndeclared bool
+	//RecreateMismatched drops and recreates indexes whose options differ from the spec
+	RecreateMismatched bool
+	//Foreground disables background index builds
+	Foreground bool
+	//Retries is how many times a failed index operation is retried,
+	//on top of the session's retries on connection errors
+	Retries       int
+	RetryInterval time.Duration
+}
+
+//IndexMismatch is an existing index with the same key as a declared one but different options
+type IndexMismatch struct {
+	Existing mgo.Index
+	Desired  mgo.Index
+	Fields   []string
+}
+
+//IndexReport is the difference between declared and existing indexes
+type IndexReport struct {
+	Create     []mgo.Index
+	Drop       []mgo.Index
+	Mismatched []IndexMismatch
+	Unchanged  []mgo.Index
+}
+
+func (r *IndexReport) String() string {
+	var b strings.Builder
+	for _, index := range r.Create {
+		fmt.Fprintf(&b, "create %v\n", index.Key)
+	}
+	for _, m := range r.Mismatched {
+		fmt.Fprintf(&b, "mismatch %s: %s\n", m.Existing.Name, strings.Join(m.Fields, ", "))
+	}
+	for _, index := range r.Drop {
+		fmt.Fprintf(&b, "drop %s\n", index.Name)
+	}
+
+	return b.String()
+}
+
+//IndexSpec declares the indexes of each collection of a database
+type IndexSpec map[string][]mgo.Index
+
+//SyncIndexes syncs the indexes of every collection in spec, see Collection.SyncIndexes
+func (db *Database) SyncIndexes(spec IndexSpec, opts SyncOptions) (map[string]*IndexReport, error) {
+	names := make([]string, 0, len(spec))
+	for name := range spec {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reports := make(map[string]*IndexReport, len(spec))
+	for _, name := range names {
+		report, err := db.C(name).SyncIndexes(spec[name], opts)
+		if report != nil {
+			reports[name] = report
+		}
+		if err != nil {
+			return reports, fmt.Errorf("mdb: sync indexes of %s: %v", name, err)
+		}
+	}
+
+	return reports, nil
+}
+
+//SyncIndexes makes the collection indexes match the declared ones.
+//Missing indexes are created, mismatched and undeclared ones are only
+//changed if enabled in opts. The report is returned even if applying fails.
+func (c *Collection) SyncIndexes(desired []mgo.Index, opts SyncOptions) (*IndexReport, error) {
+	existing, err := c.Indexes()
+	if err != nil && !IsNamespaceNotFound(err) {
+		return nil, err
+	}
+
+	report, err := diffIndexes(existing, desired)
+	if err != nil || opts.DryRun {
+		return report, err
+	}
+
+	retry := func(f func() error) error {
+		err := f()
+		for i := 0; err != nil && i < opts.Retries; i++ {
+			time.Sleep(opts.RetryInterval)
+			err = f()
+		}
+		return err
+	}
+
+	create := report.Create
+	if opts.RecreateMismatched {
+		for _, m := range report.Mismatched {
+			name := m.Existing.Name
+			if err := retry(func() error { return c.DropIndexName(name) }); err != nil {
+				return report, err
+			}
+			create = append(create, m.Desired)
+		}
+	}
+
+	for _, index := range create {
+		index.Background = !opts.Foreground
+		if err := retry(func() error { return c.EnsureIndex(index) }); err != nil {
+			return report, err
+		}
+	}
+
+	if opts.DropUndeclared {
+		for _, index := range report.Drop {
+			name := index.Name
+			if err := retry(func() error { return c.DropIndexName(name) }); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func diffIndexes(existing, desired []mgo.Index) (*IndexReport, error) {
+	report := &IndexReport{}
+
+	byKey := make(map[string]mgo.Index, len(existing))
+	for _, index := range existing {
+		byKey[indexKeyString(index.Key)] = index
+	}
+
+	declared := make(map[string]bool, len(desired))
+	for _, index := range desired {
+		key := indexKeyString(index.Key)
+		if key == "" {
+			return nil, fmt.Errorf("mdb: index without key")
+		}
+		if declared[key] {
+			return nil, fmt.Errorf("mdb: index %v declared twice", index.Key)
+		}
+		declared[key] = true
+
+		current, ok := byKey[key]
+		if !ok {
+			report.Create = append(report.Create, index)
+			continue
+		}
+
+		if fields := indexMismatch(current, index); len(fields) > 0 {
+			report.Mismatched = append(report.Mismatched, IndexMismatch{Existing: current, Desired: index, Fields: fields})
+			continue
+		}
+
+		report.Unchanged = append(report.Unchanged, current)
+	}
+
+	for _, index := range existing {
+		if index.Name == idIndexName || declared[indexKeyString(index.Key)] {
+			continue
+		}
+
+		report.Drop = append(report.Drop, index)
+	}
+
+	return report, nil
+}
+
+//indexKeyString normalizes an index key the way the server reports it,
+//text fields are unordered
+func indexKeyString(key []string) string {
+	var fields, text []string
+	for _, field := range key {
+		field = strings.TrimPrefix(field, "+")
+		if strings.HasPrefix(field, "$text:") {
+			text = append(text, field)
+			continue
+		}
+		fields = append(fields, field)
+	}
+
+	sort.Strings(text)
+	return strings.Join(append(fields, text...), ",")
+}
+
+//indexMismatch lists options of desired differing from existing.
+//Flags and TTL are always compared, other options only when set in desired.
+func indexMismatch(existing, desired mgo.Index) []string {
+	var fields []string
+	if existing.Unique != desired.Unique {
+		fields = append(fields, "unique")
+	}
+	if existing.Sparse != desired.Sparse {
+		fields = append(fields, "sparse")
+	}
+	if existing.ExpireAfter/time.Second != desired.ExpireAfter/time.Second {
+		fields = append(fields, "expireAfter")
+	}
+	if !sameDocument(existing.PartialFilter, desired.PartialFilter) {
+		fields = append(fields, "partialFilter")
+	}
+	if desired.Name != "" && existing.Name != desired.Name {
+		fields = append(fields, "name")
+	}
+	if desired.Collation != nil && !reflect.DeepEqual(existing.Collation, desired.Collation) {
+		fields = append(fields, "collation")
+	}
+	if len(desired.Weights) > 0 && !reflect.DeepEqual(existing.Weights, desired.Weights) {
+		fields = append(fields, "weights")
+	}
+	if desired.DefaultLanguage != "" && existing.DefaultLanguage != desired.DefaultLanguage {
+		fields = append(fields, "defaultLanguage")
+	}
+	if desired.LanguageOverride != "" && existing.LanguageOverride != desired.LanguageOverride {
+		fields = append(fields, "languageOverride")
+	}
+	if desired.Bits != 0 && existing.Bits != desired.Bits {
+		fields = append(fields, "bits")
+	}
+	if desired.BucketSize != 0 && existing.BucketSize != desired.BucketSize {
+		fields = append(fields, "bucketSize")
+	}
+
+	return fields
+}
+
+//sameDocument compares documents after a bson round trip with numbers as float64,
+//so number types don't matter
+func sameDocument(a, b bson.M) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+
+	return reflect.DeepEqual(normalizeDocument(a), normalizeDocument(b))
+}
+
+func normalizeDocument(doc bson.M) interface{} {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return doc
+	}
+
+	var normalized bson.M
+	if err := bson.Unmarshal(data, &normalized); err != nil {
+		return doc
+	}
+
+	return normalizeNumbers(normalized)
+}
+
+func normalizeNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		for k, e := range v {
+			v[k] = normalizeNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalizeNumbers(e)
+		}
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+
+	return v
+}
+
+//IsNamespaceNotFound reports if err is the error of a command on a missing collection
+func IsNamespaceNotFound(err error) bool {
+	if e, ok := err.(*mgo.QueryError); ok {
+		return e.Code == 26 || e.Message == "ns not found"
+	}
+
+	return false
+}
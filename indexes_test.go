@@ -0,0 +1,70 @@
+package mdb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestDiffIndexes(t *testing.T) {
+	existing := []mgo.Index{
+		{Name: "_id_", Key: []string{"_id"}},
+		{Name: "email_1", Key: []string{"email"}, Unique: true},
+		{Name: "createdAt_1", Key: []string{"createdAt"}, ExpireAfter: time.Hour},
+		{Name: "name_1_-age_1", Key: []string{"name", "-age"}},
+		{Name: "bio_text_title_text", Key: []string{"$text:title", "$text:bio"}, Weights: map[string]int{"bio": 1, "title": 1}},
+		{Name: "status_1", Key: []string{"status"}, PartialFilter: bson.M{"deleted": bson.M{"$exists": int64(0)}}},
+		{Name: "legacy_1", Key: []string{"legacy"}},
+	}
+
+	desired := []mgo.Index{
+		{Key: []string{"+email"}, Unique: true},
+		{Key: []string{"createdAt"}, ExpireAfter: 2 * time.Hour},
+		{Key: []string{"name", "-age"}, Sparse: true},
+		{Key: []string{"$text:bio", "$text:title"}},
+		{Key: []string{"status"}, PartialFilter: bson.M{"deleted": bson.M{"$exists": 0}}},
+		{Key: []string{"tags"}},
+	}
+
+	report, err := diffIndexes(existing, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(indexes []mgo.Index) []string {
+		var names []string
+		for _, index := range indexes {
+			names = append(names, index.Name)
+		}
+		return names
+	}
+
+	if len(report.Create) != 1 || report.Create[0].Key[0] != "tags" {
+		t.Errorf("unexpected creations %+v", report.Create)
+	}
+	if got := names(report.Drop); !reflect.DeepEqual(got, []string{"legacy_1"}) {
+		t.Errorf("unexpected drops %v", got)
+	}
+	if got := names(report.Unchanged); !reflect.DeepEqual(got, []string{"email_1", "bio_text_title_text", "status_1"}) {
+		t.Errorf("unexpected unchanged %v", got)
+	}
+
+	mismatched := map[string][]string{}
+	for _, m := range report.Mismatched {
+		mismatched[m.Existing.Name] = m.Fields
+	}
+	expected := map[string][]string{
+		"createdAt_1":   {"expireAfter"},
+		"name_1_-age_1": {"sparse"},
+	}
+	if !reflect.DeepEqual(mismatched, expected) {
+		t.Errorf("unexpected mismatches %v", mismatched)
+	}
+
+	if _, err := diffIndexes(nil, []mgo.Index{{Key: []string{"a"}}, {Key: []string{"+a"}}}); err == nil {
+		t.Error("expected error for index declared twice")
+	}
+}
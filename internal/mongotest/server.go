@@ -0,0 +1,931 @@
+// Package mongotest provides an in-memory mongod for tests.
+// It speaks the OP_QUERY protocol with write commands and implements
+// queries, inserts, updates, deletes, counts and findAndModify
+// with the common query and update operators, enough to test code
+// relying on atomic single-document operations without a real server.
+package mongotest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	opReply = 1
+	opQuery = 2004
+
+	codeDuplicateKey = 11000
+	codeNsNotFound   = 26
+)
+
+//Server stores the documents of every namespace in memory, operations are serialized
+type Server struct {
+	t        testing.TB
+	listener net.Listener
+
+	mu          sync.Mutex
+	conns       []net.Conn
+	collections map[string][]bson.D
+}
+
+func NewServer(t testing.TB) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{t: t, listener: l, collections: map[string][]bson.D{}}
+	go s.accept()
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+//Dial returns a session to the server with short timeouts, closed with the test
+func (s *Server) Dial() *mgo.Session {
+	sess, err := mgo.DialWithTimeout(s.Addr(), time.Second)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	sess.SetSyncTimeout(time.Second)
+	sess.SetSocketTimeout(time.Second)
+	s.t.Cleanup(sess.Close)
+
+	return sess
+}
+
+func (s *Server) Close() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+//Docs returns the documents of the namespace matching filter
+func (s *Server) Docs(namespace string, filter bson.D) []bson.D {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var docs []bson.D
+	for _, doc := range s.collections[namespace] {
+		if match(doc, filter) {
+			docs = append(docs, doc)
+		}
+	}
+
+	return docs
+}
+
+//Delete removes the documents of the namespace matching filter, like a TTL monitor would
+func (s *Server) Delete(namespace string, filter bson.D) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.delete(namespace, filter, 0)
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		body := make([]byte, int(binary.LittleEndian.Uint32(header))-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		if binary.LittleEndian.Uint32(header[12:]) != opQuery {
+			continue
+		}
+
+		requestID := binary.LittleEndian.Uint32(header[4:])
+		if err := reply(conn, requestID, s.answer(body)); err != nil {
+			return
+		}
+	}
+}
+
+func reply(conn net.Conn, responseTo uint32, docs []interface{}) error {
+	msg := make([]byte, 36)
+	binary.LittleEndian.PutUint32(msg[8:], responseTo)
+	binary.LittleEndian.PutUint32(msg[12:], opReply)
+	binary.LittleEndian.PutUint32(msg[32:], uint32(len(docs)))
+
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		msg = append(msg, data...)
+	}
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+
+	_, err := conn.Write(msg)
+	return err
+}
+
+func (s *Server) answer(body []byte) []interface{} {
+	body = body[4:]
+	end := strings.IndexByte(string(body), 0)
+	namespace := string(body[:end])
+	body = body[end+1:]
+	skip := int(int32(binary.LittleEndian.Uint32(body)))
+	limit := int(int32(binary.LittleEndian.Uint32(body[4:])))
+	body = body[8:]
+
+	var query bson.D
+	n := binary.LittleEndian.Uint32(body)
+	if err := bson.Unmarshal(body[:n], &query); err != nil {
+		return []interface{}{failure(2, err.Error())}
+	}
+
+	var order bson.D
+	if q, ok := get(query, "$query"); ok {
+		order, _ = lookupD(query, "$orderby")
+		query, _ = q.(bson.D)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	db := namespace[:strings.IndexByte(namespace, '.')]
+	if strings.HasSuffix(namespace, ".$cmd") {
+		return []interface{}{s.command(db, query)}
+	}
+
+	docs := s.find(namespace, query, order)
+	if skip > len(docs) {
+		skip = len(docs)
+	}
+	docs = docs[skip:]
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+
+	result := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		result[i] = doc
+	}
+
+	return result
+}
+
+func failure(code int, msg string) bson.M {
+	return bson.M{"ok": 0, "code": code, "errmsg": msg}
+}
+
+func (s *Server) command(db string, cmd bson.D) interface{} {
+	if len(cmd) == 0 {
+		return failure(59, "empty command")
+	}
+
+	name := cmd[0].Name
+	collection, _ := cmd[0].Value.(string)
+	namespace := db + "." + collection
+
+	switch name {
+	case "ismaster", "isMaster":
+		return bson.M{"ok": 1, "ismaster": true, "maxWireVersion": 2, "me": s.Addr()}
+	case "ping", "getnonce", "create", "createIndexes", "collMod", "dropIndexes":
+		return bson.M{"ok": 1, "nonce": "2375531c32080ae8"}
+
+	case "insert":
+		docs, _ := get(cmd, "documents")
+		var n int
+		var writeErrors []bson.M
+		for i, doc := range docs.([]interface{}) {
+			if err := s.insert(namespace, doc.(bson.D)); err != nil {
+				writeErrors = append(writeErrors, bson.M{"index": i, "code": codeDuplicateKey, "errmsg": err.Error()})
+				break
+			}
+			n++
+		}
+		return writeResult(bson.M{"ok": 1, "n": n}, writeErrors)
+
+	case "update":
+		updates, _ := get(cmd, "updates")
+		result := bson.M{"ok": 1}
+		var n, modified int
+		var upserted []bson.M
+		var writeErrors []bson.M
+		for i, u := range updates.([]interface{}) {
+			spec := u.(bson.D)
+			q, _ := lookupD(spec, "q")
+			update, _ := lookupD(spec, "u")
+			multi, _ := get(spec, "multi")
+			upsert, _ := get(spec, "upsert")
+
+			matched, id, err := s.update(namespace, q, update, multi == true, upsert == true)
+			if err != nil {
+				writeErrors = append(writeErrors, bson.M{"index": i, "code": errorCode(err), "errmsg": err.Error()})
+				break
+			}
+			if id != nil {
+				upserted = append(upserted, bson.M{"index": i, "_id": id})
+				n++
+				continue
+			}
+			n += matched
+			modified += matched
+		}
+		result["n"], result["nModified"] = n, modified
+		if len(upserted) > 0 {
+			result["upserted"] = upserted
+		}
+		return writeResult(result, writeErrors)
+
+	case "delete":
+		deletes, _ := get(cmd, "deletes")
+		var n int
+		for _, d := range deletes.([]interface{}) {
+			spec := d.(bson.D)
+			q, _ := lookupD(spec, "q")
+			limit, _ := get(spec, "limit")
+			n += s.delete(namespace, q, int(number(limit)))
+		}
+		return bson.M{"ok": 1, "n": n}
+
+	case "findAndModify", "findandmodify":
+		return s.findAndModify(namespace, cmd)
+
+	case "count":
+		q, _ := lookupD(cmd, "query")
+		return bson.M{"ok": 1, "n": len(s.find(namespace, q, nil))}
+
+	case "drop":
+		if _, ok := s.collections[namespace]; !ok {
+			return failure(codeNsNotFound, "ns not found")
+		}
+		delete(s.collections, namespace)
+		return bson.M{"ok": 1}
+
+	case "dropDatabase":
+		for ns := range s.collections {
+			if strings.HasPrefix(ns, db+".") {
+				delete(s.collections, ns)
+			}
+		}
+		return bson.M{"ok": 1}
+	}
+
+	return bson.M{"ok": 1}
+}
+
+func writeResult(result bson.M, writeErrors []bson.M) bson.M {
+	if len(writeErrors) > 0 {
+		result["writeErrors"] = writeErrors
+	}
+
+	return result
+}
+
+type serverError struct {
+	code int
+	msg  string
+}
+
+func (e *serverError) Error() string {
+	return e.msg
+}
+
+func errorCode(err error) int {
+	if e, ok := err.(*serverError); ok {
+		return e.code
+	}
+
+	return 2
+}
+
+func (s *Server) findAndModify(namespace string, cmd bson.D) interface{} {
+	q, _ := lookupD(cmd, "query")
+	order, _ := lookupD(cmd, "sort")
+	update, _ := lookupD(cmd, "update")
+	remove, _ := get(cmd, "remove")
+	returnNew, _ := get(cmd, "new")
+	upsert, _ := get(cmd, "upsert")
+
+	docs := s.find(namespace, q, order)
+	if len(docs) == 0 {
+		if upsert != true {
+			return bson.M{"ok": 1, "value": nil, "lastErrorObject": bson.M{"n": 0}}
+		}
+
+		doc, err := upsertDoc(q, update)
+		if err == nil {
+			err = s.insert(namespace, doc)
+		}
+		if err != nil {
+			return failure(errorCode(err), err.Error())
+		}
+		var value interface{}
+		if returnNew == true {
+			value = doc
+		}
+		return bson.M{"ok": 1, "value": value, "lastErrorObject": bson.M{"n": 1, "updatedExisting": false, "upserted": idOf(doc)}}
+	}
+
+	old := docs[0]
+	if remove == true {
+		s.deleteDoc(namespace, old)
+		return bson.M{"ok": 1, "value": old, "lastErrorObject": bson.M{"n": 1}}
+	}
+
+	doc, err := applyUpdate(old, update, false)
+	if err != nil {
+		return failure(errorCode(err), err.Error())
+	}
+	if err := s.replaceDoc(namespace, old, doc); err != nil {
+		return failure(errorCode(err), err.Error())
+	}
+
+	value := old
+	if returnNew == true {
+		value = doc
+	}
+	return bson.M{"ok": 1, "value": value, "lastErrorObject": bson.M{"n": 1, "updatedExisting": true}}
+}
+
+func (s *Server) find(namespace string, filter, order bson.D) []bson.D {
+	var docs []bson.D
+	for _, doc := range s.collections[namespace] {
+		if match(doc, filter) {
+			docs = append(docs, doc)
+		}
+	}
+
+	if len(order) > 0 {
+		sort.SliceStable(docs, func(i, j int) bool {
+			for _, field := range order {
+				a, _ := lookup(docs[i], field.Name)
+				b, _ := lookup(docs[j], field.Name)
+				c := compareValues(a, b)
+				if number(field.Value) < 0 {
+					c = -c
+				}
+				if c != 0 {
+					return c < 0
+				}
+			}
+			return false
+		})
+	}
+
+	return docs
+}
+
+func (s *Server) insert(namespace string, doc bson.D) error {
+	if _, ok := get(doc, "_id"); !ok {
+		doc = append(bson.D{{"_id", bson.NewObjectId()}}, doc...)
+	}
+
+	id := idOf(doc)
+	for _, existing := range s.collections[namespace] {
+		if equal(idOf(existing), id) {
+			return &serverError{codeDuplicateKey, fmt.Sprintf("E11000 duplicate key error collection: %s index: _id_ dup key: { : %v }", namespace, id)}
+		}
+	}
+
+	s.collections[namespace] = append(s.collections[namespace], doc)
+	return nil
+}
+
+//update returns the number of matched documents, or the _id of the upserted one
+func (s *Server) update(namespace string, filter, update bson.D, multi, upsert bool) (int, interface{}, error) {
+	docs := s.find(namespace, filter, nil)
+	if len(docs) == 0 {
+		if !upsert {
+			return 0, nil, nil
+		}
+		doc, err := upsertDoc(filter, update)
+		if err == nil {
+			err = s.insert(namespace, doc)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return 0, idOf(doc), nil
+	}
+
+	if !multi {
+		docs = docs[:1]
+	}
+	for _, old := range docs {
+		doc, err := applyUpdate(old, update, false)
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := s.replaceDoc(namespace, old, doc); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return len(docs), nil, nil
+}
+
+func (s *Server) delete(namespace string, filter bson.D, limit int) int {
+	n := 0
+	kept := s.collections[namespace][:0:0]
+	for _, doc := range s.collections[namespace] {
+		if (limit == 0 || n < limit) && match(doc, filter) {
+			n++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	s.collections[namespace] = kept
+
+	return n
+}
+
+func (s *Server) deleteDoc(namespace string, doc bson.D) {
+	s.delete(namespace, bson.D{{"_id", idOf(doc)}}, 1)
+}
+
+func (s *Server) replaceDoc(namespace string, old, doc bson.D) error {
+	if !equal(idOf(old), idOf(doc)) {
+		return &serverError{66, "the _id field cannot be changed"}
+	}
+
+	for i, existing := range s.collections[namespace] {
+		if equal(idOf(existing), idOf(old)) {
+			s.collections[namespace][i] = doc
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func idOf(doc bson.D) interface{} {
+	id, _ := get(doc, "_id")
+	return id
+}
+
+//upsertDoc builds the inserted document from the equality conditions of filter and the update
+func upsertDoc(filter, update bson.D) (bson.D, error) {
+	var doc bson.D
+	if !isOperatorUpdate(update) {
+		if id, ok := get(filter, "_id"); ok {
+			doc = bson.D{{"_id", id}}
+		}
+		return mergeReplacement(doc, update), nil
+	}
+
+	for _, e := range filter {
+		if strings.HasPrefix(e.Name, "$") {
+			continue
+		}
+		if cond, ok := e.Value.(bson.D); ok && isOperatorUpdate(cond) {
+			continue
+		}
+		doc = setPath(doc, e.Name, e.Value)
+	}
+
+	return applyUpdate(doc, update, true)
+}
+
+func isOperatorUpdate(update bson.D) bool {
+	return len(update) > 0 && strings.HasPrefix(update[0].Name, "$")
+}
+
+func mergeReplacement(doc, replacement bson.D) bson.D {
+	id, hasId := get(doc, "_id")
+	result := bson.D{}
+	if hasId {
+		result = append(result, bson.DocElem{Name: "_id", Value: id})
+	}
+	for _, e := range replacement {
+		if e.Name == "_id" && hasId {
+			continue
+		}
+		result = append(result, e)
+	}
+
+	return result
+}
+
+//applyUpdate returns a copy of doc with the update applied
+func applyUpdate(doc, update bson.D, insert bool) (bson.D, error) {
+	if !isOperatorUpdate(update) {
+		return mergeReplacement(doc, update), nil
+	}
+
+	doc = copyD(doc)
+	for _, op := range update {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, &serverError{9, fmt.Sprintf("%s takes a document", op.Name)}
+		}
+
+		for _, f := range fields {
+			current, exists := lookup(doc, f.Name)
+			switch op.Name {
+			case "$set":
+				doc = setPath(doc, f.Name, f.Value)
+			case "$setOnInsert":
+				if insert {
+					doc = setPath(doc, f.Name, f.Value)
+				}
+			case "$unset":
+				doc = unsetPath(doc, f.Name)
+			case "$inc":
+				doc = setPath(doc, f.Name, add(current, f.Value))
+			case "$currentDate":
+				doc = setPath(doc, f.Name, time.Now())
+			case "$push", "$addToSet":
+				values, _ := current.([]interface{})
+				items := []interface{}{f.Value}
+				if each, ok := f.Value.(bson.D); ok && len(each) > 0 && each[0].Name == "$each" {
+					items, _ = each[0].Value.([]interface{})
+				}
+				for _, item := range items {
+					if op.Name == "$addToSet" && contains(values, item) {
+						continue
+					}
+					values = append(values, item)
+				}
+				doc = setPath(doc, f.Name, values)
+			case "$pull":
+				values, _ := current.([]interface{})
+				var kept []interface{}
+				for _, v := range values {
+					if !equal(v, f.Value) {
+						kept = append(kept, v)
+					}
+				}
+				if exists {
+					doc = setPath(doc, f.Name, kept)
+				}
+			default:
+				return nil, &serverError{9, "unknown modifier " + op.Name}
+			}
+		}
+	}
+
+	return doc, nil
+}
+
+func contains(values []interface{}, v interface{}) bool {
+	for _, e := range values {
+		if equal(e, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func add(a, b interface{}) interface{} {
+	switch a := a.(type) {
+	case nil:
+		return b
+	case int:
+		if b, ok := b.(int); ok {
+			return a + b
+		}
+	case int64:
+		switch b := b.(type) {
+		case int:
+			return a + int64(b)
+		case int64:
+			return a + b
+		}
+	}
+
+	return number(a) + number(b)
+}
+
+func copyD(doc bson.D) bson.D {
+	c := make(bson.D, len(doc))
+	for i, e := range doc {
+		if nested, ok := e.Value.(bson.D); ok {
+			e.Value = copyD(nested)
+		}
+		c[i] = e
+	}
+
+	return c
+}
+
+func setPath(doc bson.D, path string, value interface{}) bson.D {
+	name, rest := path, ""
+	if i := strings.IndexByte(path, '.'); i >= 0 {
+		name, rest = path[:i], path[i+1:]
+	}
+
+	for i, e := range doc {
+		if e.Name != name {
+			continue
+		}
+		if rest == "" {
+			doc[i].Value = value
+			return doc
+		}
+		nested, _ := e.Value.(bson.D)
+		doc[i].Value = setPath(nested, rest, value)
+		return doc
+	}
+
+	if rest == "" {
+		return append(doc, bson.DocElem{Name: name, Value: value})
+	}
+
+	return append(doc, bson.DocElem{Name: name, Value: setPath(nil, rest, value)})
+}
+
+func unsetPath(doc bson.D, path string) bson.D {
+	name, rest := path, ""
+	if i := strings.IndexByte(path, '.'); i >= 0 {
+		name, rest = path[:i], path[i+1:]
+	}
+
+	for i, e := range doc {
+		if e.Name != name {
+			continue
+		}
+		if rest == "" {
+			return append(doc[:i:i], doc[i+1:]...)
+		}
+		if nested, ok := e.Value.(bson.D); ok {
+			doc[i].Value = unsetPath(nested, rest)
+		}
+		return doc
+	}
+
+	return doc
+}
+
+func get(doc bson.D, name string) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Name == name {
+			return e.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+func lookupD(doc bson.D, name string) (bson.D, bool) {
+	v, ok := get(doc, name)
+	d, isD := v.(bson.D)
+	return d, ok && isD
+}
+
+//lookup returns the value at the dotted path, indexes select array elements
+func lookup(doc bson.D, path string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		switch current := v.(type) {
+		case bson.D:
+			var ok bool
+			if v, ok = get(current, name); !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(current) {
+				return nil, false
+			}
+			v = current[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+func match(doc, filter bson.D) bool {
+	for _, e := range filter {
+		switch e.Name {
+		case "$and", "$or", "$nor":
+			conditions, _ := e.Value.([]interface{})
+			matched := 0
+			for _, c := range conditions {
+				if c, ok := c.(bson.D); ok && match(doc, c) {
+					matched++
+				}
+			}
+			if e.Name == "$and" && matched != len(conditions) || e.Name == "$or" && matched == 0 || e.Name == "$nor" && matched > 0 {
+				return false
+			}
+			continue
+		}
+
+		v, exists := lookup(doc, e.Name)
+		if cond, ok := e.Value.(bson.D); ok && isOperatorUpdate(cond) {
+			for _, op := range cond {
+				if !matchOperator(v, exists, op.Name, op.Value) {
+					return false
+				}
+			}
+			continue
+		}
+		if !matchValue(v, exists, e.Value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//matchValue matches equality, with arrays matching if any element does
+func matchValue(v interface{}, exists bool, cond interface{}) bool {
+	if !exists {
+		return cond == nil
+	}
+	if equal(v, cond) {
+		return true
+	}
+	if values, ok := v.([]interface{}); ok {
+		return contains(values, cond)
+	}
+
+	return false
+}
+
+func matchOperator(v interface{}, exists bool, op string, arg interface{}) bool {
+	switch op {
+	case "$eq":
+		return matchValue(v, exists, arg)
+	case "$ne":
+		return !matchValue(v, exists, arg)
+	case "$in", "$nin":
+		values, _ := arg.([]interface{})
+		in := false
+		for _, value := range values {
+			if matchValue(v, exists, value) {
+				in = true
+				break
+			}
+		}
+		return in == (op == "$in")
+	case "$exists":
+		want, _ := arg.(bool)
+		if n, ok := arg.(int); ok {
+			want = n != 0
+		}
+		return exists == want
+	case "$gt", "$gte", "$lt", "$lte":
+		if !exists || typeRank(v) != typeRank(arg) {
+			return false
+		}
+		c := compareValues(v, arg)
+		switch op {
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		default:
+			return c <= 0
+		}
+	}
+
+	return false
+}
+
+func equal(a, b interface{}) bool {
+	if typeRank(a) != typeRank(b) {
+		return false
+	}
+	if isNumber(a) {
+		return number(a) == number(b)
+	}
+	if ta, ok := a.(time.Time); ok {
+		return ta.Equal(b.(time.Time))
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int32, int64, float64:
+		return true
+	}
+
+	return false
+}
+
+func number(v interface{}) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+
+	return 0
+}
+
+//typeRank orders values of different types the way the server sorts them
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case int, int32, int64, float64:
+		return 2
+	case string:
+		return 3
+	case bson.D:
+		return 4
+	case []interface{}:
+		return 5
+	case []byte, bson.Binary:
+		return 6
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	}
+
+	return 10
+}
+
+func compareValues(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+
+	switch a := a.(type) {
+	case int, int32, int64, float64:
+		x, y := number(a), number(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	case string:
+		return strings.Compare(a, b.(string))
+	case bson.ObjectId:
+		return strings.Compare(string(a), string(b.(bson.ObjectId)))
+	case bool:
+		if a != b.(bool) {
+			if a {
+				return 1
+			}
+			return -1
+		}
+	case time.Time:
+		switch {
+		case a.Before(b.(time.Time)):
+			return -1
+		case a.After(b.(time.Time)):
+			return 1
+		}
+	}
+
+	return 0
+}
@@ -8,6 +8,13 @@ import (
 type Iter struct {
 	originIter *mgo.Iter
 	session    *Session
+	//owned is set when the iterator runs on its own session copy,
+	//which is closed together with the iterator
+	owned bool
+	//err is set when the middleware denied the operation, originIter is nil then
+	err error
+	//crypt decrypts the documents of an encrypting collection
+	crypt *fieldCrypt
 }
 
 //Origin returns origin mgo iter
@@ -16,37 +23,71 @@ func (i *Iter) Origin() *mgo.Iter {
 }
 
 func (i *Iter) Err() (err error) {
+	if i.originIter == nil || i.err != nil {
+		return i.err
+	}
+
 	return i.originIter.Err()
 }
 
 func (i *Iter) Close() error {
+	if i.originIter == nil {
+		return i.err
+	}
+
 	lastErr := i.session.execWithRetry(func() error {
 		return i.originIter.Close()
 	})
+	i.release()
+	if lastErr == nil {
+		lastErr = i.err
+	}
 
 	return lastErr
 }
 
 func (i *Iter) State() (int64, []bson.Raw) {
+	if i.originIter == nil {
+		return 0, nil
+	}
+
 	return i.originIter.State()
 }
 
 func (q *Query) Collation(collation *mgo.Collation) *Query {
-	return &Query{
-		session:     q.session,
-		originQuery: q.originQuery.Collation(collation),
-	}
+	q.spec.collation = collation
+	q.originQuery = q.originQuery.Collation(collation)
+	return q
 }
 
 func (i *Iter) Done() bool {
+	if i.originIter == nil {
+		return true
+	}
+
 	return i.originIter.Done()
 }
 
 func (i *Iter) Timeout() bool {
+	if i.originIter == nil {
+		return false
+	}
+
 	return i.originIter.Timeout()
 }
 
 func (i *Iter) Next(result interface{}) bool {
+	if i.originIter == nil {
+		return false
+	}
+	if i.crypt != nil {
+		return i.nextDecrypted(result)
+	}
+
+	return i.next(result)
+}
+
+func (i *Iter) next(result interface{}) bool {
 	var next bool
 	i.session.execWithRetry(func() error {
 		next = i.originIter.Next(result)
@@ -56,18 +97,73 @@ func (i *Iter) Next(result interface{}) bool {
 	return next
 }
 
+//nextDecrypted decodes the decrypted document, a decryption failure stops the iteration with Err set
+func (i *Iter) nextDecrypted(result interface{}) bool {
+	if i.err != nil {
+		return false
+	}
+
+	var raw bson.Raw
+	if !i.next(&raw) {
+		return false
+	}
+	if err := i.crypt.decode(raw, result); err != nil {
+		i.err = err
+		return false
+	}
+
+	return true
+}
+
 func (i *Iter) For(result interface{}, f func() error) error {
+	if i.originIter == nil {
+		return i.err
+	}
+	if i.crypt != nil {
+		for i.Next(result) {
+			if err := f(); err != nil {
+				i.Close()
+				return err
+			}
+		}
+		return i.Close()
+	}
+
 	lastErr := i.session.execWithRetry(func() error {
 		return i.originIter.For(result, f)
 	})
+	i.release()
 
 	return lastErr
 }
 
 func (i *Iter) All(result interface{}) error {
+	if i.originIter == nil {
+		return i.err
+	}
+	if i.crypt != nil {
+		var docs []bson.Raw
+		lastErr := i.session.execWithRetry(func() error {
+			return i.originIter.All(&docs)
+		})
+		i.release()
+		if lastErr != nil {
+			return lastErr
+		}
+		return i.crypt.decodeAll(docs, result)
+	}
+
 	lastErr := i.session.execWithRetry(func() error {
 		return i.originIter.All(result)
 	})
+	i.release()
 
 	return lastErr
 }
+
+func (i *Iter) release() {
+	if i.owned {
+		i.owned = false
+		i.session.Close()
+	}
+}
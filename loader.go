@@ -0,0 +1,150 @@
+package mdb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	DefaultLoaderWait      = time.Millisecond
+	DefaultLoaderBatchSize = 100
+)
+
+type LoaderOption func(l *Loader)
+
+//LoaderWait is how long the loader collects ids before querying them
+func LoaderWait(d time.Duration) LoaderOption {
+	return func(l *Loader) {
+		l.wait = d
+	}
+}
+
+//LoaderBatchSize is the max number of ids per query, a full batch is queried at once
+func LoaderBatchSize(n int) LoaderOption {
+	return func(l *Loader) {
+		l.batchSize = n
+	}
+}
+
+//Loader batches the ids of concurrent Load calls into one $in query
+type Loader struct {
+	c         *Collection
+	wait      time.Duration
+	batchSize int
+
+	mu    sync.Mutex
+	batch *loaderBatch
+}
+
+type loaderBatch struct {
+	ids   []interface{}
+	keys  map[string]bool
+	timer *time.Timer
+	done  chan struct{}
+	docs  map[string]bson.Raw
+	err   error
+}
+
+//Loader returns a loader of the collection documents by _id
+func (c *Collection) Loader(opts ...LoaderOption) *Loader {
+	l := &Loader{c: c, wait: DefaultLoaderWait, batchSize: DefaultLoaderBatchSize}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.batchSize <= 0 {
+		l.batchSize = DefaultLoaderBatchSize
+	}
+
+	return l
+}
+
+//Load unmarshals the document with the id into result like FindId(id).One(result),
+//it returns mgo.ErrNotFound if the batch has no such document
+func (l *Loader) Load(id interface{}, result interface{}) error {
+	key, err := canonicalBson(id)
+	if err != nil {
+		return err
+	}
+
+	b := l.add(id, string(key))
+	<-b.done
+	if b.err != nil {
+		return b.err
+	}
+
+	raw, ok := b.docs[string(key)]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+
+	return raw.Unmarshal(result)
+}
+
+//add puts the id in the pending batch, which is sent when full or after the wait
+func (l *Loader) add(id interface{}, key string) *loaderBatch {
+	l.mu.Lock()
+	b := l.batch
+	if b == nil {
+		b = &loaderBatch{keys: map[string]bool{}, done: make(chan struct{})}
+		b.timer = time.AfterFunc(l.wait, func() {
+			l.dispatch(b)
+		})
+		l.batch = b
+	}
+	if !b.keys[key] {
+		b.keys[key] = true
+		b.ids = append(b.ids, id)
+	}
+	full := len(b.ids) >= l.batchSize
+	if full {
+		l.batch = nil
+	}
+	l.mu.Unlock()
+
+	if full {
+		b.timer.Stop()
+		b.load(l.c)
+	}
+
+	return b
+}
+
+//dispatch loads the batch after the wait unless it was loaded when full
+func (l *Loader) dispatch(b *loaderBatch) {
+	l.mu.Lock()
+	if l.batch != b {
+		l.mu.Unlock()
+		return
+	}
+	l.batch = nil
+	l.mu.Unlock()
+
+	b.load(l.c)
+}
+
+func (b *loaderBatch) load(c *Collection) {
+	defer close(b.done)
+
+	var docs []bson.Raw
+	if b.err = c.Find(bson.M{"_id": bson.M{"$in": b.ids}}).All(&docs); b.err != nil {
+		return
+	}
+
+	b.docs = make(map[string]bson.Raw, len(docs))
+	for _, raw := range docs {
+		var doc struct {
+			Id interface{} `bson:"_id"`
+		}
+		if b.err = raw.Unmarshal(&doc); b.err != nil {
+			return
+		}
+		key, err := canonicalBson(doc.Id)
+		if b.err = err; b.err != nil {
+			return
+		}
+		b.docs[string(key)] = raw
+	}
+}
@@ -0,0 +1,73 @@
+package mdb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestLoader(t *testing.T) {
+	server := newFakeServer(t)
+
+	var (
+		mu      sync.Mutex
+		batches [][]interface{}
+	)
+	server.Handle(func(op *fakeOp) []bson.M {
+		id, ok := op.Query["_id"].(bson.M)
+		if !ok {
+			return []bson.M{{"ok": 1}}
+		}
+		ids := id["$in"].([]interface{})
+
+		mu.Lock()
+		batches = append(batches, ids)
+		mu.Unlock()
+
+		var docs []bson.M
+		for _, id := range ids {
+			if id != 3 {
+				docs = append(docs, bson.M{"_id": id, "n": id.(int) * 10})
+			}
+		}
+		return docs
+	})
+
+	loader := server.Dial(0).DB("test").C("people").Loader(LoaderWait(50*time.Millisecond), LoaderBatchSize(3))
+
+	ids := []int{1, 2, 3, 1, 4}
+	results := make([]int, len(ids))
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i, id int) {
+			defer wg.Done()
+			var doc struct {
+				N int `bson:"n"`
+			}
+			errs[i] = loader.Load(id, &doc)
+			results[i] = doc.N
+		}(i, id)
+	}
+	wg.Wait()
+
+	for i, id := range ids {
+		if id == 3 {
+			if errs[i] != mgo.ErrNotFound {
+				t.Fatalf("expected not found for 3, got %v", errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil || results[i] != id*10 {
+			t.Fatalf("expected %d for %d, got %d %v", id*10, id, results[i], errs[i])
+		}
+	}
+
+	if len(batches) != 2 || len(batches[0]) != 3 {
+		t.Fatalf("expected a full batch and a timed one, got %v", batches)
+	}
+}
@@ -0,0 +1,208 @@
+package mdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const DefaultLockPollInterval = time.Millisecond * 500
+
+var (
+	ErrLocked   = errors.New("mdb: lock is held by another owner")
+	ErrLockLost = errors.New("mdb: lock lost")
+)
+
+//Locker provides named leases stored in a collection.
+//A lock document holds the fencing token counter, so it's kept after the lock expires
+//and taken over by the next acquisition instead of being removed by a TTL index.
+type Locker struct {
+	//PollInterval is how often Lock retries a held lock
+	PollInterval time.Duration
+
+	c *Collection
+}
+
+//Lease is a held lock, it is renewed in the background until unlocked or lost
+type Lease struct {
+	Name string
+	//Token is the fencing token, it increases with every acquisition of the lock
+	Token int64
+
+	owner  string
+	ttl    time.Duration
+	locker *Locker
+	lost   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	mu        sync.Mutex
+	expiresAt time.Time
+}
+
+type lockDocument struct {
+	Name      string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+	Token     int64     `bson:"token"`
+}
+
+//lockAttempts bounds the acquisitions retried when the lock document is removed meanwhile
+const lockAttempts = 3
+
+func NewLocker(c *Collection) *Locker {
+	return &Locker{PollInterval: DefaultLockPollInterval, c: c}
+}
+
+//Lock acquires the lock, waiting until it's free or ctx is done
+func (l *Locker) Lock(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	for {
+		lease, err := l.TryLock(name, ttl)
+		if err != ErrLocked {
+			return lease, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.PollInterval):
+		}
+	}
+}
+
+//TryLock acquires the lock or returns ErrLocked
+func (l *Locker) TryLock(name string, ttl time.Duration) (*Lease, error) {
+	if ttl < time.Millisecond {
+		return nil, errors.New("mdb: lock ttl is too short")
+	}
+
+	owner := bson.NewObjectId().Hex()
+	expiresAt := time.Now().Add(ttl)
+
+	var doc lockDocument
+	var err error
+	for attempt := 0; attempt < lockAttempts; attempt++ {
+		//the token is incremented by the update acquiring the lock, so holders get increasing tokens
+		_, err = l.c.Find(bson.M{"_id": name, "expiresAt": bson.M{"$lt": time.Now()}}).Apply(mgo.Change{
+			Update: bson.M{
+				"$set": bson.M{"owner": owner, "expiresAt": expiresAt},
+				"$inc": bson.M{"token": int64(1)},
+			},
+			Upsert:    true,
+			ReturnNew: true,
+		}, &doc)
+		if !mgo.IsDup(err) {
+			break
+		}
+
+		//the lock is held, possibly by us if a retried upsert succeeded before the connection broke
+		err = l.c.FindId(name).One(&doc)
+		if err == nil && doc.Owner != owner {
+			return nil, ErrLocked
+		}
+		if err != mgo.ErrNotFound {
+			break
+		}
+		//the lock document was removed after the upsert failed, acquire again
+		err = ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{
+		Name:      name,
+		Token:     doc.Token,
+		owner:     owner,
+		ttl:       ttl,
+		locker:    l,
+		expiresAt: expiresAt,
+		lost:      make(chan struct{}),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go lease.renew()
+
+	return lease, nil
+}
+
+//Unlock stops renewal and releases the lock, it returns ErrLockLost if the lease was lost before
+func (l *Locker) Unlock(lease *Lease) error {
+	lease.once.Do(func() {
+		close(lease.stop)
+	})
+	<-lease.done
+
+	select {
+	case <-lease.lost:
+		return ErrLockLost
+	default:
+	}
+
+	err := l.release(lease.Name, lease.owner)
+	if err == mgo.ErrNotFound {
+		return ErrLockLost
+	}
+
+	return err
+}
+
+//release expires the lock instead of removing it, so a retry after a broken connection still matches
+func (l *Locker) release(name, owner string) error {
+	return l.c.Update(
+		bson.M{"_id": name, "owner": owner},
+		bson.M{"$set": bson.M{"expiresAt": time.Unix(0, 0)}},
+	)
+}
+
+//Lost is closed when the lease couldn't be renewed before expiring
+func (le *Lease) Lost() <-chan struct{} {
+	return le.lost
+}
+
+//ExpiresAt returns when the lease expires unless renewed
+func (le *Lease) ExpiresAt() time.Time {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	return le.expiresAt
+}
+
+func (le *Lease) renew() {
+	defer close(le.done)
+
+	ticker := time.NewTicker(le.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-le.stop:
+			return
+		case <-ticker.C:
+		}
+
+		expiresAt := time.Now().Add(le.ttl)
+		err := le.locker.c.Update(
+			bson.M{"_id": le.Name, "owner": le.owner},
+			bson.M{"$set": bson.M{"expiresAt": expiresAt}},
+		)
+
+		if err == nil {
+			le.mu.Lock()
+			le.expiresAt = expiresAt
+			le.mu.Unlock()
+			continue
+		}
+
+		//connection errors are retried until the lease expires
+		if err == mgo.ErrNotFound || time.Now().After(le.ExpiresAt()) {
+			close(le.lost)
+			return
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package mdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ZloyDyadka/mdb/internal/mongotest"
+	"github.com/globalsign/mgo/bson"
+)
+
+func newTestLocker(t *testing.T) (*mongotest.Server, *Locker) {
+	server := mongotest.NewServer(t)
+	locker := NewLocker(Wrap(server.Dial(), 0, time.Millisecond).DB("test").C("locks"))
+	locker.PollInterval = time.Millisecond
+
+	return server, locker
+}
+
+func TestLockerTryLock(t *testing.T) {
+	_, locker := newTestLocker(t)
+
+	lease, err := locker.TryLock("job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Token != 1 {
+		t.Fatalf("expected token 1, got %d", lease.Token)
+	}
+
+	if _, err := locker.TryLock("job", time.Minute); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if _, err := locker.Lock(ctx, "job", time.Minute); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	if err := locker.Unlock(lease); err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err = locker.Lock(context.Background(), "job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Token != 2 {
+		t.Fatalf("expected token 2, got %d", lease.Token)
+	}
+	if err := locker.Unlock(lease); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockerTakesOverExpiredLock(t *testing.T) {
+	_, locker := newTestLocker(t)
+
+	stale, err := locker.TryLock("job", time.Millisecond*30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the holder stops renewing without releasing, like a paused process
+	stale.once.Do(func() {
+		close(stale.stop)
+	})
+	<-stale.done
+
+	lease, err := locker.Lock(context.Background(), "job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Token <= stale.Token {
+		t.Fatalf("expected the new holder's token %d to exceed %d", lease.Token, stale.Token)
+	}
+
+	if err := locker.Unlock(stale); err != ErrLockLost {
+		t.Fatalf("expected ErrLockLost for the stale holder, got %v", err)
+	}
+	if err := locker.Unlock(lease); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	server, locker := newTestLocker(t)
+
+	lease, err := locker.TryLock("job", time.Millisecond*30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Delete("test.locks", bson.D{{"_id", "job"}})
+
+	select {
+	case <-lease.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("expected the lease to be lost when renewal matches nothing")
+	}
+
+	if err := locker.Unlock(lease); err != ErrLockLost {
+		t.Fatalf("expected ErrLockLost, got %v", err)
+	}
+}
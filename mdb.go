@@ -17,6 +17,19 @@ const (
 	DefaultRetryInterval = time.Second * 2
 )
 
+type Mode = mgo.Mode
+
+const (
+	Primary            = mgo.Primary
+	PrimaryPreferred   = mgo.PrimaryPreferred
+	Secondary          = mgo.Secondary
+	SecondaryPreferred = mgo.SecondaryPreferred
+	Nearest            = mgo.Nearest
+	Eventual           = mgo.Eventual
+	Monotonic          = mgo.Monotonic
+	Strong             = mgo.Strong
+)
+
 type Option func(session *Session)
 
 func Dial(mgoUrl string, opts ...Option) (*Session, error) {
@@ -61,6 +74,8 @@ func Wrap(sess *mgo.Session, maxRetries int, retryInterval time.Duration) *Sessi
 		MaxConnectRetries: maxRetries,
 		originSession:     sess,
 		refreshing:        0,
+		failures:          &failureLog{},
+		flights:           &flightGroup{},
 	}
 }
 
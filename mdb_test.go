@@ -23,7 +23,7 @@ func TestRefresh(t *testing.T) {
 		Phone string
 	}
 
-	c := db.C("people")
+	c := db.DB("").C("people")
 	err = c.Insert(&Person{"Ale", "+55 53 8116 9639"},
 		&Person{"Cla", "+55 53 8402 8510"})
 	if err != nil {
@@ -33,7 +33,7 @@ func TestRefresh(t *testing.T) {
 	for i := 0; i < 100; i++ {
 
 		go func() {
-			c := db.C("people")
+			c := db.DB("").C("people")
 			for i := 0; i < 900; i++ {
 				err = c.Insert(&Person{"Ale", "+55 53 8116 9639"},
 					&Person{"Cla", "+55 53 8402 8510"})
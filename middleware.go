@@ -0,0 +1,174 @@
+package mdb
+
+import (
+	"context"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type OpKind string
+
+const (
+	OpFind         OpKind = "find"
+	OpCount        OpKind = "count"
+	OpDistinct     OpKind = "distinct"
+	OpMapReduce    OpKind = "mapReduce"
+	OpExplain      OpKind = "explain"
+	OpAggregate    OpKind = "aggregate"
+	OpInsert       OpKind = "insert"
+	OpUpdate       OpKind = "update"
+	OpUpdateAll    OpKind = "updateAll"
+	OpUpsert       OpKind = "upsert"
+	OpRemove       OpKind = "remove"
+	OpRemoveAll    OpKind = "removeAll"
+	OpApply        OpKind = "findAndModify"
+	OpBulkUpsert   OpKind = "bulkUpsert"
+	OpCreate       OpKind = "create"
+	OpDrop         OpKind = "drop"
+	OpDropDatabase OpKind = "dropDatabase"
+	OpEnsureIndex  OpKind = "ensureIndex"
+	OpDropIndex    OpKind = "dropIndex"
+	OpIndexes      OpKind = "indexes"
+	OpRepair       OpKind = "repair"
+)
+
+//Operation describes a collection operation to the middleware.
+//Filter, Update, Docs and the pipeline option may be rewritten, the other options are informational.
+type Operation struct {
+	Kind       OpKind
+	DB         string
+	Collection string
+	Filter     interface{}
+	Update     interface{}
+	Docs       []interface{}
+	//Options holds the other arguments, like sort, skip and limit of queries
+	//or the pipeline of aggregations
+	Options bson.M
+	//Context is the context of the collection, see Collection.WithContext
+	Context context.Context
+	//Retries is the number of times the operation was retried after a network error,
+	//set when the handler returns
+	Retries int
+
+	collection *Collection
+	//applied is the document returned by findAndModify, set when an OpApply handler returns
+	applied bson.Raw
+}
+
+type Handler func(op *Operation) error
+
+//Middleware wraps the handler of the operations,
+//it may inspect or rewrite the operation, or deny it by returning an error without calling next
+type Middleware func(next Handler) Handler
+
+//Use adds middleware to the operations of the session, the first is the outermost.
+//The handler called by the last middleware runs the operation with retry.
+func Use(middleware ...Middleware) func(session *Session) {
+	return func(s *Session) {
+		s.middleware = append(append([]Middleware(nil), s.middleware...), middleware...)
+	}
+}
+
+//intercept passes op through the session middleware to exec
+func (s *Session) intercept(op *Operation, exec Handler) error {
+	h := exec
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+
+	return h(op)
+}
+
+func (c *Collection) operation(kind OpKind) *Operation {
+	return &Operation{Kind: kind, DB: c.Database.Name, Collection: c.Name, Context: c.ctx, collection: c}
+}
+
+//exec runs f with retry within the collection timeout after the session middleware,
+//origin is the mgo collection of the attempt
+func (c *Collection) exec(op *Operation, f func(op *Operation, origin *mgo.Collection) error) error {
+	d := newDeadline(c.timeout)
+	return c.session.intercept(op, func(op *Operation) error {
+		return c.session.execWithDeadline(d, countRetries(op, func() error {
+			return c.session.attempt(d, func(s *Session) error {
+				return f(op, c.on(s))
+			})
+		}))
+	})
+}
+
+//on returns the mgo collection bound to the given session
+func (c *Collection) on(s *Session) *mgo.Collection {
+	if s == c.session {
+		return c.originCollection
+	}
+
+	return c.originCollection.With(s.originSession)
+}
+
+//countRetries counts the calls of f after the first in op.Retries, op may be nil
+func countRetries(op *Operation, f func() error) func() error {
+	first := true
+	return func() error {
+		if !first && op != nil {
+			op.Retries++
+		}
+		first = false
+		return f()
+	}
+}
+
+//operation describes the query, options are added to its sort, skip, limit and selector
+func (q *Query) operation(kind OpKind, options bson.M) *Operation {
+	op := q.collection.operation(kind)
+	op.Filter = q.spec.filter
+	op.Options = bson.M{"selector": q.spec.selector, "sort": q.spec.sort, "skip": q.spec.skip, "limit": q.spec.limit}
+	for k, v := range options {
+		op.Options[k] = v
+	}
+
+	return op
+}
+
+//intercept passes op through the session middleware,
+//f runs a copy of the query using the filter of the operation
+func (q *Query) intercept(op *Operation, f func(q *Query, op *Operation) error) error {
+	if len(q.session.middleware) == 0 {
+		return f(q, op)
+	}
+
+	return q.session.intercept(op, func(op *Operation) error {
+		vq := *q
+		vq.spec.filter = op.Filter
+		vq.originQuery = vq.spec.build(q.collection.originCollection)
+		return f(&vq, op)
+	})
+}
+
+//intercept passes the pipeline through the session middleware,
+//f runs a copy using the pipeline option of the operation, op is nil without middleware
+func (p *Pipe) intercept(f func(p *Pipe, op *Operation) error) error {
+	if len(p.session.middleware) == 0 {
+		return f(p, nil)
+	}
+
+	op := p.collection.operation(OpAggregate)
+	op.Options = bson.M{"pipeline": p.pipeline}
+
+	return p.session.intercept(op, func(op *Operation) error {
+		np := *p
+		np.pipeline = op.Options["pipeline"]
+		np.originPipe = np.rebuild(p.collection.originCollection)
+		return f(&np, op)
+	})
+}
+
+//interceptedIter returns iter, or an iterator yielding no documents and err
+//if the middleware didn't let it open
+func interceptedIter(s *Session, iter *Iter, err error) *Iter {
+	if iter == nil {
+		return &Iter{session: s, err: err}
+	}
+
+	return iter
+}
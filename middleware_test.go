@@ -0,0 +1,106 @@
+package mdb
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestMiddleware(t *testing.T) {
+	server := newFakeServer(t)
+
+	var (
+		mu      sync.Mutex
+		queries []bson.M
+	)
+	server.Handle(func(op *fakeOp) []bson.M {
+		mu.Lock()
+		queries = append(queries, op.Query)
+		mu.Unlock()
+		return []bson.M{{"_id": 1}}
+	})
+
+	errDenied := errors.New("denied")
+	var kinds []OpKind
+	record := func(next Handler) Handler {
+		return func(op *Operation) error {
+			kinds = append(kinds, op.Kind)
+			return next(op)
+		}
+	}
+	tenant := func(next Handler) Handler {
+		return func(op *Operation) error {
+			if op.Collection == "secrets" {
+				return errDenied
+			}
+			switch op.Kind {
+			case OpRemove, OpRemoveAll:
+				return errDenied
+			case OpFind:
+				op.Filter = bson.M{"$and": []interface{}{nonNilFilter(op.Filter), bson.M{"tenant": "a"}}}
+			}
+			return next(op)
+		}
+	}
+
+	session := server.Dial(0)
+	Use(record, tenant)(session)
+	c := session.DB("test").C("people")
+
+	var doc bson.M
+	if err := c.Find(bson.M{"name": "Ale"}).One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	last := queries[len(queries)-1]
+	mu.Unlock()
+	if and, ok := last["$and"].([]interface{}); !ok || len(and) != 2 {
+		t.Fatalf("expected the rewritten filter, got %v", last)
+	}
+
+	if err := c.RemoveId(1); err != errDenied {
+		t.Fatalf("expected the remove to be denied, got %v", err)
+	}
+
+	iter := session.DB("test").C("secrets").Find(nil).Iter()
+	if iter.Next(&doc) {
+		t.Fatal("expected a denied iterator to be empty")
+	}
+	if err := iter.Close(); err != errDenied {
+		t.Fatalf("expected the find to be denied, got %v", err)
+	}
+
+	if len(kinds) != 3 || kinds[0] != OpFind || kinds[1] != OpRemove || kinds[2] != OpFind {
+		t.Fatalf("expected every operation to reach the middleware, got %v", kinds)
+	}
+}
+
+func TestIterCountsRetries(t *testing.T) {
+	server := newFakeServer(t)
+	session := server.Dial(3)
+	c := session.DB("test").C("people")
+	//binds the socket NewIter takes the server from
+	if err := session.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	op := c.operation(OpFind)
+	iter := session.iter(nil, deadline{}, op, func(s *Session) *mgo.Iter {
+		calls++
+		if calls == 1 {
+			return c.originCollection.NewIter(s.originSession, nil, 0, io.EOF)
+		}
+		return c.originCollection.NewIter(s.originSession, nil, 0, nil)
+	})
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || op.Retries != 1 {
+		t.Fatalf("expected the reopened iterator counted as a retry, got %d calls and %d retries", calls, op.Retries)
+	}
+}
@@ -0,0 +1,107 @@
+package migrate
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ZloyDyadka/mdb"
+)
+
+const usage = `usage: %s [flags] up [version] | down [version] | status
+
+up applies the migrations up to version, all pending ones without it.
+down rolls back the migrations above version, the last applied one without it.
+
+flags:
+`
+
+//Main implements the mdb-migrate command over the given migrations and exits
+func Main(migrations []Migration) {
+	if err := Command(os.Args[0], os.Args[1:], migrations, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+//Command parses args, dials with mdb.Dial and runs up, down or status
+func Command(name string, args []string, migrations []Migration, out io.Writer) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	url := flags.String("url", "mongodb://127.0.0.1:27017/test", "mongodb url")
+	dbName := flags.String("db", "", "database, the one from url if empty")
+	dryRun := flags.Bool("dry-run", false, "print steps without applying them")
+	retries := flags.Int("retries", mdb.DefaultMaxRetries, "max retries on connection errors")
+	retryInterval := flags.Duration("retry-interval", mdb.DefaultRetryInterval, "interval between retries")
+	lockTTL := flags.Duration("lock-ttl", DefaultLockTTL, "migration lock ttl")
+	flags.Usage = func() {
+		fmt.Fprintf(out, usage, name)
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 || flags.NArg() > 2 {
+		flags.Usage()
+		return fmt.Errorf("migrate: expected a command")
+	}
+
+	var target int64
+	if flags.NArg() == 2 {
+		var err error
+		if target, err = strconv.ParseInt(flags.Arg(1), 10, 64); err != nil {
+			return fmt.Errorf("migrate: invalid version %q", flags.Arg(1))
+		}
+	}
+
+	session, err := mdb.Dial(*url, mdb.MaxRetries(*retries), mdb.RetryInterval(*retryInterval))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	m, err := New(session.DB(*dbName), migrations, DryRun(*dryRun), Output(out), LockTTL(*lockTTL))
+	if err != nil {
+		return err
+	}
+
+	switch flags.Arg(0) {
+	case "up":
+		return m.Up(target)
+	case "down":
+		if flags.NArg() == 1 {
+			return m.Rollback(1)
+		}
+		return m.Down(target)
+	case "status":
+		return printStatus(m, out)
+	}
+
+	flags.Usage()
+	return fmt.Errorf("migrate: unknown command %q", flags.Arg(0))
+}
+
+func printStatus(m *Migrator, out io.Writer) error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tAPPLIED\tDESCRIPTION")
+	for _, status := range statuses {
+		applied := "pending"
+		if status.Applied {
+			applied = status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", status.Migration.Version, applied, status.Migration.Description)
+	}
+
+	return w.Flush()
+}
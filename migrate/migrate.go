@@ -0,0 +1,422 @@
+// Package migrate applies versioned, ordered schema migrations
+// to a database and records them in a history collection.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ZloyDyadka/mdb"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	DefaultHistoryCollection = "migrations"
+	DefaultLockCollection    = "migrations_lock"
+	DefaultLockTTL           = time.Minute * 10
+)
+
+var (
+	ErrLocked       = errors.New("migrate: another instance is migrating")
+	ErrIrreversible = errors.New("migrate: migration has no down steps")
+	//ErrLockLost is returned when the lock could not be renewed and another instance may have taken it over
+	ErrLockLost = errors.New("migrate: lock lost")
+)
+
+type Migration struct {
+	Version     int64
+	Description string
+	Up          []Step
+	//Down reverts Up, the migration can't be rolled back if empty
+	Down []Step
+}
+
+//Record is a history entry of an applied migration
+type Record struct {
+	Version     int64     `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+type Status struct {
+	Migration Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Option func(m *Migrator)
+
+type Migrator struct {
+	db         *mdb.Database
+	migrations []Migration
+	history    string
+	lock       string
+	lockTTL    time.Duration
+	dryRun     bool
+	out        io.Writer
+	owner      string
+	lease      *lease
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []Migration
+)
+
+//Register adds a migration to the global list returned by Registered,
+//usually from an init function
+func Register(m Migration) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry = append(registry, m)
+}
+
+func Registered() []Migration {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	return append([]Migration(nil), registry...)
+}
+
+func HistoryCollection(name string) Option {
+	return func(m *Migrator) {
+		m.history = name
+	}
+}
+
+func LockCollection(name string) Option {
+	return func(m *Migrator) {
+		m.lock = name
+	}
+}
+
+//LockTTL is how long the lock is held without renewal before another instance may take it over.
+//The lock is renewed every third of ttl while migrating.
+func LockTTL(ttl time.Duration) Option {
+	return func(m *Migrator) {
+		m.lockTTL = ttl
+	}
+}
+
+//DryRun prints the steps instead of applying them
+func DryRun(dryRun bool) Option {
+	return func(m *Migrator) {
+		m.dryRun = dryRun
+	}
+}
+
+//Output sets where progress and dry-run steps are printed, discarded by default
+func Output(w io.Writer) Option {
+	return func(m *Migrator) {
+		m.out = w
+	}
+}
+
+func New(db *mdb.Database, migrations []Migration, opts ...Option) (*Migrator, error) {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	for i, migration := range sorted {
+		if migration.Version <= 0 {
+			return nil, fmt.Errorf("migrate: invalid version %d", migration.Version)
+		}
+		if i > 0 && sorted[i-1].Version == migration.Version {
+			return nil, fmt.Errorf("migrate: duplicate version %d", migration.Version)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	m := &Migrator{
+		db:         db,
+		migrations: sorted,
+		history:    DefaultHistoryCollection,
+		lock:       DefaultLockCollection,
+		lockTTL:    DefaultLockTTL,
+		out:        ioutil.Discard,
+		owner:      fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), bson.NewObjectId().Hex()),
+	}
+
+	for _, o := range opts {
+		o(m)
+	}
+
+	return m, nil
+}
+
+//Status lists all known migrations and whether they are applied
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		record, ok := applied[migration.Version]
+		statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: record.AppliedAt})
+	}
+
+	return statuses, nil
+}
+
+//Up applies pending migrations up to and including target, all of them if target is zero
+func (m *Migrator) Up(target int64) error {
+	return m.locked(func() error {
+		applied, err := m.applied()
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if target > 0 && migration.Version > target {
+				break
+			}
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			fmt.Fprintf(m.out, "up %d %s\n", migration.Version, migration.Description)
+			err := m.run(migration.Up)
+			if err == ErrLockLost {
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("migrate: up %d: %v", migration.Version, err)
+			}
+			if m.dryRun {
+				continue
+			}
+			if err := m.checkLease(); err != nil {
+				return err
+			}
+
+			record := Record{Version: migration.Version, Description: migration.Description, AppliedAt: time.Now()}
+			if err := m.db.C(m.history).Insert(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//Down rolls back applied migrations with version greater than target, newest first
+func (m *Migrator) Down(target int64) error {
+	return m.down(func(migration Migration, rolledBack int) bool {
+		return migration.Version > target
+	})
+}
+
+//Rollback rolls back the last n applied migrations, newest first
+func (m *Migrator) Rollback(n int) error {
+	return m.down(func(migration Migration, rolledBack int) bool {
+		return rolledBack < n
+	})
+}
+
+//down rolls back applied migrations, newest first, while next returns true
+func (m *Migrator) down(next func(migration Migration, rolledBack int) bool) error {
+	return m.locked(func() error {
+		applied, err := m.applied()
+		if err != nil {
+			return err
+		}
+
+		rolledBack := 0
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if !next(migration, rolledBack) {
+				break
+			}
+			rolledBack++
+			if len(migration.Down) == 0 {
+				return fmt.Errorf("migrate: down %d: %v", migration.Version, ErrIrreversible)
+			}
+
+			fmt.Fprintf(m.out, "down %d %s\n", migration.Version, migration.Description)
+			err := m.run(migration.Down)
+			if err == ErrLockLost {
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("migrate: down %d: %v", migration.Version, err)
+			}
+			if m.dryRun {
+				continue
+			}
+			if err := m.checkLease(); err != nil {
+				return err
+			}
+
+			if err := m.db.C(m.history).RemoveId(migration.Version); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (m *Migrator) run(steps []Step) error {
+	for _, step := range steps {
+		if m.dryRun {
+			fmt.Fprintf(m.out, "  %s\n", step.Describe())
+			continue
+		}
+
+		if err := m.checkLease(); err != nil {
+			return err
+		}
+		if err := step.Apply(m.db); err != nil {
+			return fmt.Errorf("%s: %v", step.Describe(), err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) applied() (map[int64]Record, error) {
+	var records []Record
+	if err := m.db.C(m.history).Find(nil).All(&records); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]Record, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+
+	return applied, nil
+}
+
+type lockDoc struct {
+	Name      string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+const lockName = "migrate"
+
+//locked runs f holding the migration lock, dry runs don't take it
+func (m *Migrator) locked(f func() error) error {
+	if m.dryRun {
+		return f()
+	}
+
+	if err := m.acquire(); err != nil {
+		return err
+	}
+	m.lease = m.renew()
+	defer func() {
+		m.lease.stop()
+		m.lease = nil
+		m.release()
+	}()
+
+	return f()
+}
+
+//lease renews the lock in the background until stopped
+type lease struct {
+	mu      sync.Mutex
+	renewed time.Time
+	lost    bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (m *Migrator) renew() *lease {
+	l := &lease{renewed: time.Now(), done: make(chan struct{})}
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+
+		ticker := time.NewTicker(m.lockTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+			}
+
+			now := time.Now()
+			err := m.db.C(m.lock).Update(
+				bson.M{"_id": lockName, "owner": m.owner},
+				bson.M{"$set": bson.M{"expiresAt": now.Add(m.lockTTL)}},
+			)
+
+			l.mu.Lock()
+			switch err {
+			case nil:
+				l.renewed = now
+			case mgo.ErrNotFound:
+				l.lost = true
+			}
+			l.mu.Unlock()
+		}
+	}()
+
+	return l
+}
+
+func (l *lease) stop() {
+	close(l.done)
+	l.wg.Wait()
+}
+
+//checkLease fails once the lock was taken over or not renewed for a whole ttl
+func (m *Migrator) checkLease() error {
+	if m.lease == nil {
+		return nil
+	}
+
+	m.lease.mu.Lock()
+	defer m.lease.mu.Unlock()
+
+	if m.lease.lost || time.Since(m.lease.renewed) >= m.lockTTL {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+func (m *Migrator) acquire() error {
+	c := m.db.C(m.lock)
+	now := time.Now()
+
+	err := c.Insert(lockDoc{Name: lockName, Owner: m.owner, ExpiresAt: now.Add(m.lockTTL)})
+	if !mgo.IsDup(err) {
+		return err
+	}
+
+	//take over an expired lock
+	err = c.Update(
+		bson.M{"_id": lockName, "expiresAt": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": m.owner, "expiresAt": now.Add(m.lockTTL)}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrLocked
+	}
+
+	return err
+}
+
+func (m *Migrator) release() {
+	m.db.C(m.lock).Remove(bson.M{"_id": lockName, "owner": m.owner})
+}
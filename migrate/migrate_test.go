@@ -0,0 +1,188 @@
+package migrate
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZloyDyadka/mdb"
+	"github.com/ZloyDyadka/mdb/internal/mongotest"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestNewValidatesVersions(t *testing.T) {
+	if _, err := New(nil, []Migration{{Version: 1}, {Version: 1}}); err == nil {
+		t.Fatal("expected duplicate version error")
+	}
+	if _, err := New(nil, []Migration{{Version: 0}}); err == nil {
+		t.Fatal("expected invalid version error")
+	}
+
+	m, err := New(nil, []Migration{{Version: 3}, {Version: 1}, {Version: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range m.migrations {
+		if migration.Version != int64(i+1) {
+			t.Fatalf("expected migrations sorted by version, got %+v", m.migrations)
+		}
+	}
+}
+
+func TestDryRunPrintsSteps(t *testing.T) {
+	var out bytes.Buffer
+	m, err := New(nil, nil, DryRun(true), Output(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.run([]Step{
+		CreateCollection("people", &mgo.CollectionInfo{}),
+		EnsureIndex("people", mgo.Index{Key: []string{"name"}}),
+		UpdateAll("people", bson.M{"active": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"active": true}}),
+		CreateView("active_people", "people", []bson.M{{"$match": bson.M{"active": true}}}, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[0], "create collection people") || !strings.Contains(lines[3], "create view active_people") {
+		t.Fatalf("unexpected dry-run output:\n%s", out.String())
+	}
+}
+
+func testDB(t *testing.T) (*mongotest.Server, *mdb.Database) {
+	server := mongotest.NewServer(t)
+	return server, mdb.Wrap(server.Dial(), 0, time.Millisecond).DB("test")
+}
+
+func TestUpDownRecordsHistory(t *testing.T) {
+	server, db := testDB(t)
+
+	var applied []string
+	step := func(name string) []Step {
+		return []Step{Func(name, func(db *mdb.Database) error {
+			applied = append(applied, name)
+			return nil
+		})}
+	}
+	migrations := []Migration{
+		{Version: 1, Description: "one", Up: step("up 1"), Down: step("down 1")},
+		{Version: 2, Description: "two", Up: step("up 2"), Down: step("down 2")},
+		{Version: 3, Description: "three", Up: step("up 3"), Down: step("down 3")},
+	}
+
+	m, err := New(db, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := func() []int64 {
+		var versions []int64
+		for _, doc := range server.Docs("test."+DefaultHistoryCollection, nil) {
+			versions = append(versions, doc.Map()["_id"].(int64))
+		}
+		return versions
+	}
+
+	if err := m.Up(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := history(); !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Fatalf("expected versions 1-3 recorded, got %v", got)
+	}
+
+	if err := m.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	if got := history(); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Fatalf("expected version 3 rolled back, got %v", got)
+	}
+
+	if err := m.Down(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := history(); len(got) != 0 {
+		t.Fatalf("expected empty history, got %v", got)
+	}
+
+	expected := []string{"up 1", "up 2", "up 3", "down 3", "down 2", "down 1"}
+	if !reflect.DeepEqual(applied, expected) {
+		t.Fatalf("expected steps %v, got %v", expected, applied)
+	}
+	if docs := server.Docs("test."+DefaultLockCollection, nil); len(docs) != 0 {
+		t.Fatalf("expected lock released, got %v", docs)
+	}
+}
+
+func TestLock(t *testing.T) {
+	_, db := testDB(t)
+
+	ttl := 300 * time.Millisecond
+	second, err := New(db, []Migration{{Version: 1}}, LockTTL(ttl))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []error
+	slow := Func("slow", func(*mdb.Database) error {
+		errs = append(errs, second.Up(0))
+		//the lock outlives its ttl while renewed
+		time.Sleep(ttl * 2)
+		errs = append(errs, second.Up(0))
+		return nil
+	})
+
+	first, err := New(db, []Migration{{Version: 1, Up: []Step{slow}}}, LockTTL(ttl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 2 || errs[0] != ErrLocked || errs[1] != ErrLocked {
+		t.Fatalf("expected ErrLocked while migrating, got %v", errs)
+	}
+	if err := second.Up(0); err != nil {
+		t.Fatalf("expected the lock released, got %v", err)
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	server, db := testDB(t)
+
+	ttl := 300 * time.Millisecond
+	var ran bool
+	m, err := New(db, []Migration{{Version: 1, Up: []Step{
+		Func("steal", func(*mdb.Database) error {
+			//another instance takes over the lock
+			server.Delete("test."+DefaultLockCollection, nil)
+			time.Sleep(ttl / 2)
+			return nil
+		}),
+		Func("next", func(*mdb.Database) error {
+			ran = true
+			return nil
+		}),
+	}}}, LockTTL(ttl))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Up(0); err != ErrLockLost {
+		t.Fatalf("expected ErrLockLost, got %v", err)
+	}
+	if ran {
+		t.Fatal("expected no step run after the lock was lost")
+	}
+	if docs := server.Docs("test."+DefaultHistoryCollection, nil); len(docs) != 0 {
+		t.Fatalf("expected no history recorded, got %v", docs)
+	}
+}
@@ -0,0 +1,93 @@
+package migrate
+
+import (
+	"fmt"
+
+	"github.com/ZloyDyadka/mdb"
+	"github.com/globalsign/mgo"
+)
+
+//Step is a single action of a migration
+type Step interface {
+	//Describe is printed in dry-run mode
+	Describe() string
+	Apply(db *mdb.Database) error
+}
+
+type step struct {
+	description string
+	apply       func(db *mdb.Database) error
+}
+
+func (s *step) Describe() string {
+	return s.description
+}
+
+func (s *step) Apply(db *mdb.Database) error {
+	return s.apply(db)
+}
+
+//Func is a step running arbitrary code
+func Func(description string, f func(db *mdb.Database) error) Step {
+	return &step{description: description, apply: f}
+}
+
+func CreateCollection(name string, info *mgo.CollectionInfo) Step {
+	return &step{
+		description: fmt.Sprintf("create collection %s", name),
+		apply: func(db *mdb.Database) error {
+			return db.C(name).Create(info)
+		},
+	}
+}
+
+func DropCollection(name string) Step {
+	return &step{
+		description: fmt.Sprintf("drop collection %s", name),
+		apply: func(db *mdb.Database) error {
+			err := db.C(name).DropCollection()
+			if mdb.IsNamespaceNotFound(err) {
+				return nil
+			}
+			return err
+		},
+	}
+}
+
+func EnsureIndex(collection string, index mgo.Index) Step {
+	return &step{
+		description: fmt.Sprintf("ensure index %v on %s", index.Key, collection),
+		apply: func(db *mdb.Database) error {
+			return db.C(collection).EnsureIndex(index)
+		},
+	}
+}
+
+func DropIndexName(collection string, name string) Step {
+	return &step{
+		description: fmt.Sprintf("drop index %s on %s", name, collection),
+		apply: func(db *mdb.Database) error {
+			return db.C(collection).DropIndexName(name)
+		},
+	}
+}
+
+//UpdateAll backfills documents matching selector
+func UpdateAll(collection string, selector interface{}, update interface{}) Step {
+	return &step{
+		description: fmt.Sprintf("update all in %s matching %v with %v", collection, selector, update),
+		apply: func(db *mdb.Database) error {
+			_, err := db.C(collection).UpdateAll(selector, update)
+			return err
+		},
+	}
+}
+
+func CreateView(view string, source string, pipeline interface{}, collation *mgo.Collation) Step {
+	return &step{
+		description: fmt.Sprintf("create view %s on %s with %v", view, source, pipeline),
+		apply: func(db *mdb.Database) error {
+			return db.CreateView(view, source, pipeline, collation)
+		},
+	}
+}
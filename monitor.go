@@ -0,0 +1,297 @@
+package mdb
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMonitorInterval = time.Second * 10
+	DefaultEventBuffer     = 64
+)
+
+var ErrNoPrimary = errors.New("mdb: no primary")
+
+type EventKind int
+
+const (
+	PrimaryElected EventKind = iota
+	MemberDown
+	LagExceeded
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case PrimaryElected:
+		return "primary elected"
+	case MemberDown:
+		return "member down"
+	case LagExceeded:
+		return "lag exceeded"
+	}
+
+	return "unknown"
+}
+
+type TopologyEvent struct {
+	Kind   EventKind
+	Member string
+	Lag    time.Duration
+	Time   time.Time
+}
+
+type Member struct {
+	Name    string
+	State   string
+	Healthy bool
+	Lag     time.Duration
+}
+
+//Topology is a snapshot of the cluster as seen by the last check
+type Topology struct {
+	SetName     string
+	Primary     string
+	Members     []Member
+	LiveServers []string
+	CheckedAt   time.Time
+	Err         error
+}
+
+type MonitorConfig struct {
+	//Interval between checks, DefaultMonitorInterval if zero
+	Interval time.Duration
+	//MaxLag emits LagExceeded and fails readiness when a secondary lags more, disabled if zero
+	MaxLag time.Duration
+	//EventBuffer is the events channel capacity, DefaultEventBuffer if zero.
+	//Events are dropped when the channel is full.
+	EventBuffer int
+}
+
+//Monitor periodically checks the cluster with isMaster and replSetGetStatus
+type Monitor struct {
+	config  MonitorConfig
+	session *Session
+	events  chan TopologyEvent
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	mu       sync.RWMutex
+	topology Topology
+	//last successful check, events are computed against it
+	lastGood Topology
+}
+
+type isMasterResult struct {
+	IsMaster  bool     `bson:"ismaster"`
+	Secondary bool     `bson:"secondary"`
+	SetName   string   `bson:"setName"`
+	Primary   string   `bson:"primary"`
+	Hosts     []string `bson:"hosts"`
+	Me        string   `bson:"me"`
+}
+
+//StartMonitor attaches a topology monitor to the session
+//and to sessions, databases and collections derived from it afterwards.
+//A monitor already attached to the session is stopped.
+func (s *Session) StartMonitor(config MonitorConfig) *Monitor {
+	m := newMonitor(config)
+	//reads secondaries too, so members are still reported when there is no primary
+	m.session = s.Copy()
+	m.session.SetMode(Nearest, true)
+	m.check()
+	go m.loop()
+
+	s.monitorMu.Lock()
+	prev := s.monitor
+	s.monitor = m
+	s.monitorMu.Unlock()
+
+	if prev != nil {
+		prev.Stop()
+	}
+
+	return m
+}
+
+func newMonitor(config MonitorConfig) *Monitor {
+	if config.Interval == 0 {
+		config.Interval = DefaultMonitorInterval
+	}
+	if config.EventBuffer == 0 {
+		config.EventBuffer = DefaultEventBuffer
+	}
+
+	return &Monitor{
+		config: config,
+		events: make(chan TopologyEvent, config.EventBuffer),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+//Monitor returns the attached monitor or nil
+func (s *Session) Monitor() *Monitor {
+	s.monitorMu.Lock()
+	defer s.monitorMu.Unlock()
+
+	return s.monitor
+}
+
+//Snapshot returns the topology from the last check
+func (m *Monitor) Snapshot() Topology {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t := m.topology
+	t.Members = append([]Member(nil), t.Members...)
+	t.LiveServers = append([]string(nil), t.LiveServers...)
+
+	return t
+}
+
+func (m *Monitor) Events() <-chan TopologyEvent {
+	return m.events
+}
+
+//Ready returns nil if the last check is recent and succeeded,
+//a primary is known and no secondary lags more than MaxLag
+func (m *Monitor) Ready() error {
+	t := m.Snapshot()
+	if t.Err != nil {
+		return t.Err
+	}
+
+	if time.Since(t.CheckedAt) > 2*m.config.Interval {
+		return errors.New("mdb: topology check is stale")
+	}
+
+	if t.Primary == "" {
+		return ErrNoPrimary
+	}
+
+	if m.config.MaxLag > 0 {
+		for _, member := range t.Members {
+			if member.Lag > m.config.MaxLag {
+				return errors.New("mdb: member " + member.Name + " lag exceeded")
+			}
+		}
+	}
+
+	return nil
+}
+
+//Stop stops the monitor and closes the events channel
+func (m *Monitor) Stop() {
+	m.once.Do(func() {
+		close(m.stop)
+		<-m.done
+		m.session.Close()
+		close(m.events)
+	})
+}
+
+func (m *Monitor) loop() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+func (m *Monitor) check() {
+	t := Topology{CheckedAt: time.Now(), LiveServers: m.session.LiveServers()}
+
+	var isMaster isMasterResult
+	if err := m.session.Run("ismaster", &isMaster); err != nil {
+		t.Err = err
+		m.update(t)
+		return
+	}
+
+	t.SetName = isMaster.SetName
+	t.Primary = isMaster.Primary
+	if isMaster.SetName == "" && isMaster.IsMaster {
+		//standalone or mongos
+		t.Primary = isMaster.Me
+		if t.Primary == "" && len(t.LiveServers) > 0 {
+			t.Primary = t.LiveServers[0]
+		}
+	}
+
+	if isMaster.SetName != "" {
+		status, err := m.session.replSetStatus()
+		if err != nil {
+			t.Err = err
+			m.update(t)
+			return
+		}
+
+		for i := range status.Members {
+			member := &status.Members[i]
+			t.Members = append(t.Members, Member{
+				Name:    member.Name,
+				State:   member.StateStr,
+				Healthy: member.Health == 1,
+				Lag:     status.lag(member),
+			})
+			if member.State == memberPrimary {
+				t.Primary = member.Name
+			}
+		}
+	}
+
+	m.update(t)
+}
+
+func (m *Monitor) update(t Topology) {
+	m.mu.Lock()
+	prev := m.lastGood
+	m.topology = t
+	if t.Err == nil {
+		m.lastGood = t
+	}
+	m.mu.Unlock()
+
+	//the first successful check only establishes the baseline
+	if t.Err != nil || prev.CheckedAt.IsZero() {
+		return
+	}
+
+	if t.Primary != "" && t.Primary != prev.Primary {
+		m.emit(TopologyEvent{Kind: PrimaryElected, Member: t.Primary, Time: t.CheckedAt})
+	}
+
+	prevMembers := make(map[string]Member, len(prev.Members))
+	for _, member := range prev.Members {
+		prevMembers[member.Name] = member
+	}
+
+	for _, member := range t.Members {
+		was, known := prevMembers[member.Name]
+		if !member.Healthy && known && was.Healthy {
+			m.emit(TopologyEvent{Kind: MemberDown, Member: member.Name, Time: t.CheckedAt})
+		}
+
+		exceeded := m.config.MaxLag > 0 && member.Lag > m.config.MaxLag
+		if exceeded && !(known && was.Lag > m.config.MaxLag) {
+			m.emit(TopologyEvent{Kind: LagExceeded, Member: member.Name, Lag: member.Lag, Time: t.CheckedAt})
+		}
+	}
+}
+
+func (m *Monitor) emit(e TopologyEvent) {
+	select {
+	case m.events <- e:
+	default:
+	}
+}
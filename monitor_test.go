@@ -0,0 +1,157 @@
+package mdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func drain(m *Monitor) []TopologyEvent {
+	var events []TopologyEvent
+	for {
+		select {
+		case e := <-m.events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestMonitorUpdateEvents(t *testing.T) {
+	now := time.Now()
+	healthy := []Member{{Name: "a", Healthy: true}, {Name: "b", Healthy: true}}
+
+	tests := []struct {
+		name   string
+		checks []Topology
+		events []EventKind
+	}{
+		{
+			name:   "startup is not an election",
+			checks: []Topology{{Primary: "a", Members: healthy}},
+		},
+		{
+			name: "primary elected",
+			checks: []Topology{
+				{Primary: "a", Members: healthy},
+				{Primary: "", Members: healthy},
+				{Primary: "b", Members: healthy},
+			},
+			events: []EventKind{PrimaryElected},
+		},
+		{
+			name: "failed check keeps baseline",
+			checks: []Topology{
+				{Primary: "a", Members: healthy},
+				{Err: errors.New("no reachable servers")},
+				{Primary: "a", Members: healthy},
+			},
+		},
+		{
+			name: "member down once",
+			checks: []Topology{
+				{Primary: "a", Members: healthy},
+				{Primary: "a", Members: []Member{{Name: "a", Healthy: true}, {Name: "b"}}},
+				{Primary: "a", Members: []Member{{Name: "a", Healthy: true}, {Name: "b"}}},
+			},
+			events: []EventKind{MemberDown},
+		},
+		{
+			name: "lag exceeded once",
+			checks: []Topology{
+				{Primary: "a", Members: healthy},
+				{Primary: "a", Members: []Member{{Name: "a", Healthy: true}, {Name: "b", Healthy: true, Lag: time.Minute}}},
+				{Primary: "a", Members: []Member{{Name: "a", Healthy: true}, {Name: "b", Healthy: true, Lag: time.Hour}}},
+				{Primary: "a", Members: healthy},
+				{Primary: "a", Members: []Member{{Name: "a", Healthy: true}, {Name: "b", Healthy: true, Lag: time.Minute}}},
+			},
+			events: []EventKind{LagExceeded, LagExceeded},
+		},
+	}
+
+	for _, test := range tests {
+		m := newMonitor(MonitorConfig{MaxLag: time.Second})
+		for i, check := range test.checks {
+			check.CheckedAt = now.Add(time.Duration(i) * time.Second)
+			m.update(check)
+		}
+
+		events := drain(m)
+		if len(events) != len(test.events) {
+			t.Errorf("%s: expected %v, got %+v", test.name, test.events, events)
+			continue
+		}
+		for i, e := range events {
+			if e.Kind != test.events[i] {
+				t.Errorf("%s: expected %v, got %+v", test.name, test.events, events)
+			}
+		}
+	}
+}
+
+func TestMonitorEventsDropOnFull(t *testing.T) {
+	m := newMonitor(MonitorConfig{EventBuffer: 1})
+	m.update(Topology{Primary: "a", CheckedAt: time.Now()})
+	m.update(Topology{Primary: "b", CheckedAt: time.Now()})
+	m.update(Topology{Primary: "c", CheckedAt: time.Now()})
+
+	events := drain(m)
+	if len(events) != 1 || events[0].Member != "b" {
+		t.Fatalf("expected only the first event to be kept, got %+v", events)
+	}
+}
+
+func TestMonitorReady(t *testing.T) {
+	tests := []struct {
+		name     string
+		topology Topology
+		ready    bool
+	}{
+		{"ready", Topology{Primary: "a", CheckedAt: time.Now(), Members: []Member{{Name: "b", Lag: time.Millisecond}}}, true},
+		{"stale", Topology{Primary: "a", CheckedAt: time.Now().Add(-time.Minute)}, false},
+		{"no primary", Topology{CheckedAt: time.Now()}, false},
+		{"error", Topology{Primary: "a", CheckedAt: time.Now(), Err: errors.New("EOF")}, false},
+		{"lag", Topology{Primary: "a", CheckedAt: time.Now(), Members: []Member{{Name: "b", Lag: time.Minute}}}, false},
+	}
+
+	for _, test := range tests {
+		m := newMonitor(MonitorConfig{Interval: time.Second, MaxLag: time.Second})
+		m.update(test.topology)
+
+		if err := m.Ready(); (err == nil) != test.ready {
+			t.Errorf("%s: expected ready %v, got %v", test.name, test.ready, err)
+		}
+	}
+}
+
+func TestStartMonitor(t *testing.T) {
+	server := newFakeServer(t)
+	s := server.Dial(0)
+
+	first := s.StartMonitor(MonitorConfig{Interval: time.Hour})
+	if err := first.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if p := first.Snapshot().Primary; p != server.Addr() {
+		t.Fatalf("expected standalone primary %s, got %s", server.Addr(), p)
+	}
+
+	second := s.StartMonitor(MonitorConfig{Interval: time.Hour})
+	if _, ok := <-first.Events(); ok {
+		t.Fatal("expected the replaced monitor to be stopped")
+	}
+	if s.DB("test").Session.Monitor() != second {
+		t.Fatal("expected derived sessions to share the monitor")
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			second.Stop()
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+}
@@ -0,0 +1,503 @@
+package mdb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+var ErrInvalidPageToken = errors.New("mdb: invalid page token")
+
+//PageOptions controls Query.Paginate and Pipe.Paginate
+type PageOptions struct {
+	//Size is the number of documents per page
+	Size int
+	//Token is Page.Next or Page.Prev of the previous call, empty for the first page
+	Token string
+	//Keyset pages by the values of the sort fields instead of skipping documents,
+	//_id is added as the last sort field if missing
+	Keyset bool
+	//Sort is the page order, the query's sort by default. Required for pipes.
+	Sort []string
+	//Secret signs the tokens
+	Secret []byte
+}
+
+//Page holds the tokens of the pages around the one returned
+type Page struct {
+	//Next is empty on the last page
+	Next string
+	//Prev is empty on the first page
+	Prev string
+}
+
+type pageToken struct {
+	Keyset   bool          `bson:"k,omitempty"`
+	Sort     []string      `bson:"s"`
+	Query    []byte        `bson:"q"`
+	Offset   int           `bson:"o,omitempty"`
+	Values   []interface{} `bson:"v,omitempty"`
+	Backward bool          `bson:"b,omitempty"`
+}
+
+//pageFetch runs the paged query with the keyset filter, which may be nil
+type pageFetch func(filter bson.M, order []string, skip, limit int) ([]bson.Raw, error)
+
+//Paginate loads a page of the query into result, a pointer to a slice.
+//Skip and Limit of the query are replaced by the page ones.
+func (q *Query) Paginate(opts PageOptions, result interface{}) (*Page, error) {
+	if opts.Sort == nil {
+		opts.Sort = q.spec.sort
+	}
+
+	return paginate(opts, q.spec.filter, result, func(filter bson.M, order []string, skip, limit int) ([]bson.Raw, error) {
+		pq := *q
+		if filter != nil {
+			pq.spec.filter = bson.M{"$and": []interface{}{nonNilFilter(q.spec.filter), filter}}
+		}
+		pq.spec.sort = order
+		pq.spec.skip = skip
+		pq.spec.limit = limit
+		pq.originQuery = pq.spec.build(q.collection.originCollection)
+
+		var docs []bson.Raw
+		err := pq.All(&docs)
+		return docs, err
+	})
+}
+
+//Paginate loads a page of the pipeline results into result, a pointer to a slice.
+//The page stages are appended to the pipeline, opts.Sort is required.
+func (p *Pipe) Paginate(opts PageOptions, result interface{}) (*Page, error) {
+	if len(opts.Sort) == 0 {
+		return nil, errors.New("mdb: pipe pagination requires a sort")
+	}
+
+	return paginate(opts, p.pipeline, result, func(filter bson.M, order []string, skip, limit int) ([]bson.Raw, error) {
+		stages, err := pipelineStages(p.pipeline)
+		if err != nil {
+			return nil, err
+		}
+
+		if filter != nil {
+			stages = append(stages, bson.M{"$match": filter})
+		}
+		stages = append(stages, bson.M{"$sort": sortDocument(order)})
+		if skip > 0 {
+			stages = append(stages, bson.M{"$skip": skip})
+		}
+		stages = append(stages, bson.M{"$limit": limit})
+
+		pp := p.collection.Pipe(stages)
+		pp.allowDiskUse = p.allowDiskUse
+		pp.batch = p.batch
+		pp.readPref = p.readPref
+		if p.allowDiskUse {
+			pp.originPipe = pp.originPipe.AllowDiskUse()
+		}
+		if p.batch != 0 {
+			pp.originPipe = pp.originPipe.Batch(p.batch)
+		}
+
+		var docs []bson.Raw
+		err = pp.All(&docs)
+		return docs, err
+	})
+}
+
+func paginate(opts PageOptions, query interface{}, result interface{}, fetch pageFetch) (*Page, error) {
+	if opts.Size <= 0 {
+		return nil, errors.New("mdb: page size must be positive")
+	}
+	if len(opts.Secret) == 0 {
+		return nil, errors.New("mdb: page token secret is empty")
+	}
+
+	order := opts.Sort
+	if opts.Keyset {
+		var err error
+		if order, err = keysetSort(order); err != nil {
+			return nil, err
+		}
+	}
+
+	queryHash, err := hashQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &pageToken{Keyset: opts.Keyset, Sort: order, Query: queryHash}
+	if opts.Token != "" {
+		if token, err = decodePageToken(opts.Token, opts.Secret); err != nil {
+			return nil, err
+		}
+		if token.Keyset != opts.Keyset || !equalStrings(token.Sort, order) || !bytes.Equal(token.Query, queryHash) {
+			return nil, ErrInvalidPageToken
+		}
+	}
+
+	if !opts.Keyset {
+		return offsetPage(opts, token, result, fetch)
+	}
+
+	return keysetPage(opts, token, result, fetch)
+}
+
+func offsetPage(opts PageOptions, token *pageToken, result interface{}, fetch pageFetch) (*Page, error) {
+	docs, err := fetch(nil, token.Sort, token.Offset, opts.Size+1)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{}
+	if len(docs) > opts.Size {
+		docs = docs[:opts.Size]
+		next := *token
+		next.Offset = token.Offset + opts.Size
+		if page.Next, err = next.encode(opts.Secret); err != nil {
+			return nil, err
+		}
+	}
+
+	if token.Offset > 0 {
+		prev := *token
+		prev.Offset = token.Offset - opts.Size
+		if prev.Offset < 0 {
+			prev.Offset = 0
+		}
+		if page.Prev, err = prev.encode(opts.Secret); err != nil {
+			return nil, err
+		}
+	}
+
+	return page, decodeDocuments(docs, result)
+}
+
+func keysetPage(opts PageOptions, token *pageToken, result interface{}, fetch pageFetch) (*Page, error) {
+	order := token.Sort
+	if token.Backward {
+		order = reverseSort(order)
+	}
+
+	var filter bson.M
+	if token.Values != nil {
+		filter = keysetFilter(order, token.Values)
+	}
+
+	docs, err := fetch(filter, order, 0, opts.Size+1)
+	if err != nil {
+		return nil, err
+	}
+
+	//more is true if there are documents past this page in the fetch direction
+	more := len(docs) > opts.Size
+	if more {
+		docs = docs[:opts.Size]
+	}
+	if token.Backward {
+		for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+			docs[i], docs[j] = docs[j], docs[i]
+		}
+	}
+
+	hasNext, hasPrev := more, token.Values != nil
+	if token.Backward {
+		hasNext, hasPrev = token.Values != nil, more
+	}
+
+	page := &Page{}
+	if len(docs) == 0 {
+		return page, decodeDocuments(docs, result)
+	}
+
+	if hasNext {
+		if page.Next, err = keysetToken(token, docs[len(docs)-1], false, opts.Secret); err != nil {
+			return nil, err
+		}
+	}
+	if hasPrev {
+		if page.Prev, err = keysetToken(token, docs[0], true, opts.Secret); err != nil {
+			return nil, err
+		}
+	}
+
+	return page, decodeDocuments(docs, result)
+}
+
+func keysetToken(token *pageToken, doc bson.Raw, backward bool, secret []byte) (string, error) {
+	values, err := sortValues(doc, token.Sort)
+	if err != nil {
+		return "", err
+	}
+
+	t := *token
+	t.Values = values
+	t.Backward = backward
+	return t.encode(secret)
+}
+
+//keysetSort validates the sort fields and appends _id as tiebreaker
+func keysetSort(order []string) ([]string, error) {
+	var fields []string
+	hasId := false
+	for _, field := range order {
+		name := sortFieldName(field)
+		if name == "" || strings.HasPrefix(name, "$") {
+			return nil, fmt.Errorf("mdb: can't page by sort field %q", field)
+		}
+		if name == "_id" {
+			hasId = true
+		}
+		fields = append(fields, field)
+	}
+
+	if !hasId {
+		fields = append(fields, "_id")
+	}
+
+	return fields, nil
+}
+
+//keysetFilter matches documents after values in the sort order:
+//{$or: [{a: {$gt: va}}, {a: va, b: {$gt: vb}}, ...]}.
+//Null and missing values sort before all others, as in MongoDB.
+func keysetFilter(order []string, values []interface{}) bson.M {
+	or := make([]interface{}, 0, len(order))
+	for i, field := range order {
+		after := func(cond interface{}) bson.M {
+			m := bson.M{}
+			for j := 0; j < i; j++ {
+				//null also matches a missing field
+				m[sortFieldName(order[j])] = values[j]
+			}
+			m[sortFieldName(field)] = cond
+			return m
+		}
+
+		descending := strings.HasPrefix(field, "-")
+		switch {
+		case values[i] == nil && descending:
+			//nothing sorts before null
+		case values[i] == nil:
+			or = append(or, after(bson.M{"$ne": nil}))
+		case descending:
+			or = append(or, after(bson.M{"$lt": values[i]}), after(nil))
+		default:
+			or = append(or, after(bson.M{"$gt": values[i]}))
+		}
+	}
+
+	return bson.M{"$or": or}
+}
+
+func sortValues(doc bson.Raw, order []string) ([]interface{}, error) {
+	var m bson.M
+	if err := doc.Unmarshal(&m); err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, 0, len(order))
+	for _, field := range order {
+		//a missing field sorts as null
+		v, _ := lookupPath(m, sortFieldName(field))
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+func lookupPath(doc bson.M, path string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+func sortFieldName(field string) string {
+	return strings.TrimLeft(field, "+-")
+}
+
+func reverseSort(order []string) []string {
+	reversed := make([]string, len(order))
+	for i, field := range order {
+		if strings.HasPrefix(field, "-") {
+			reversed[i] = sortFieldName(field)
+		} else {
+			reversed[i] = "-" + sortFieldName(field)
+		}
+	}
+
+	return reversed
+}
+
+func sortDocument(order []string) bson.D {
+	doc := make(bson.D, 0, len(order))
+	for _, field := range order {
+		direction := 1
+		if strings.HasPrefix(field, "-") {
+			direction = -1
+		}
+		doc = append(doc, bson.DocElem{Name: sortFieldName(field), Value: direction})
+	}
+
+	return doc
+}
+
+//pipelineStages converts any slice pipeline to []interface{}
+func pipelineStages(pipeline interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(pipeline)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("mdb: pipeline is %T, not a slice", pipeline)
+	}
+
+	stages := make([]interface{}, 0, v.Len()+4)
+	for i := 0; i < v.Len(); i++ {
+		stages = append(stages, v.Index(i).Interface())
+	}
+
+	return stages, nil
+}
+
+//decodeDocuments unmarshals docs into result, a pointer to a slice
+func decodeDocuments(docs []bson.Raw, result interface{}) error {
+	v := reflect.ValueOf(result)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("mdb: result is %T, not a pointer to a slice", result)
+	}
+
+	slice := reflect.MakeSlice(v.Elem().Type(), len(docs), len(docs))
+	for i, doc := range docs {
+		if err := doc.Unmarshal(slice.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	v.Elem().Set(slice)
+
+	return nil
+}
+
+//hashQuery binds tokens to the query they were created for
+func hashQuery(query interface{}) ([]byte, error) {
+	canonical, err := canonicalBson(query)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(canonical)
+	return sum[:8], nil
+}
+
+//canonicalBson marshals v with map keys sorted, so equal documents give equal bytes
+func canonicalBson(v interface{}) ([]byte, error) {
+	data, err := bson.Marshal(bson.M{"v": v})
+	if err != nil {
+		return nil, err
+	}
+
+	var m bson.M
+	if err := bson.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	return bson.Marshal(bson.D{{"v", sortedKeys(m["v"])}})
+}
+
+func sortedKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		doc := make(bson.D, 0, len(v))
+		for _, k := range keys {
+			doc = append(doc, bson.DocElem{Name: k, Value: sortedKeys(v[k])})
+		}
+		return doc
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, e := range v {
+			values[i] = sortedKeys(e)
+		}
+		return values
+	}
+
+	return v
+}
+
+func (t *pageToken) encode(secret []byte) (string, error) {
+	data, err := bson.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+
+	encoding := base64.RawURLEncoding
+	return encoding.EncodeToString(data) + "." + encoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func decodePageToken(token string, secret []byte) (*pageToken, error) {
+	encoding := base64.RawURLEncoding
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, ErrInvalidPageToken
+	}
+
+	data, err := encoding.DecodeString(token[:i])
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	signature, err := encoding.DecodeString(token[i+1:])
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidPageToken
+	}
+
+	t := &pageToken{}
+	if err := bson.Unmarshal(data, t); err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	if t.Keyset && len(t.Values) != 0 && len(t.Values) != len(t.Sort) {
+		return nil, ErrInvalidPageToken
+	}
+
+	return t, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,246 @@
+package mdb
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ZloyDyadka/mdb/internal/mongotest"
+	"github.com/globalsign/mgo/bson"
+)
+
+type pageDoc struct {
+	Id    int `bson:"_id"`
+	Score int `bson:"score"`
+}
+
+//memoryFetch pages over docs, understanding the filters built by keysetFilter
+func memoryFetch(t *testing.T, docs []pageDoc) pageFetch {
+	matches := func(doc bson.M, cond bson.M) bool {
+		for field, v := range cond {
+			value := doc[field].(int)
+			switch v := v.(type) {
+			case nil:
+				//the documents have no null scores
+				return false
+			case bson.M:
+				if bound, ok := v["$gt"]; ok && !(value > bound.(int)) {
+					return false
+				}
+				if bound, ok := v["$lt"]; ok && !(value < bound.(int)) {
+					return false
+				}
+			default:
+				if value != v.(int) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	return func(filter bson.M, order []string, skip, limit int) ([]bson.Raw, error) {
+		var selected []bson.M
+		for _, d := range docs {
+			doc := bson.M{"_id": d.Id, "score": d.Score}
+			if filter == nil {
+				selected = append(selected, doc)
+				continue
+			}
+			for _, cond := range filter["$or"].([]interface{}) {
+				if matches(doc, cond.(bson.M)) {
+					selected = append(selected, doc)
+					break
+				}
+			}
+		}
+
+		sort.SliceStable(selected, func(i, j int) bool {
+			for _, field := range order {
+				a, b := selected[i][sortFieldName(field)].(int), selected[j][sortFieldName(field)].(int)
+				if a == b {
+					continue
+				}
+				if field[0] == '-' {
+					return a > b
+				}
+				return a < b
+			}
+			return false
+		})
+
+		if skip > len(selected) {
+			skip = len(selected)
+		}
+		selected = selected[skip:]
+		if len(selected) > limit {
+			selected = selected[:limit]
+		}
+
+		var raws []bson.Raw
+		for _, doc := range selected {
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raws = append(raws, bson.Raw{Kind: 3, Data: data})
+		}
+		return raws, nil
+	}
+}
+
+func pageIds(docs []pageDoc) []int {
+	ids := []int{}
+	for _, doc := range docs {
+		ids = append(ids, doc.Id)
+	}
+	return ids
+}
+
+func TestKeysetPagination(t *testing.T) {
+	docs := []pageDoc{{1, 50}, {2, 40}, {3, 40}, {4, 30}, {5, 20}}
+	fetch := memoryFetch(t, docs)
+	opts := PageOptions{Size: 2, Keyset: true, Sort: []string{"-score"}, Secret: []byte("secret")}
+	filter := bson.M{"active": true}
+
+	var page []pageDoc
+	var pages [][]int
+	var prevs []string
+	for {
+		p, err := paginate(opts, filter, &page, fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, pageIds(page))
+		prevs = append(prevs, p.Prev)
+		if p.Next == "" {
+			break
+		}
+		opts.Token = p.Next
+	}
+
+	if !reflect.DeepEqual(pages, [][]int{{1, 2}, {3, 4}, {5}}) {
+		t.Fatalf("unexpected pages %v", pages)
+	}
+	if prevs[0] != "" {
+		t.Fatal("first page must not have a previous token")
+	}
+
+	opts.Token = prevs[2]
+	p, err := paginate(opts, filter, &page, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pageIds(page), []int{3, 4}) || p.Next == "" || p.Prev == "" {
+		t.Fatalf("unexpected previous page %v %+v", pageIds(page), p)
+	}
+
+	if _, err := paginate(opts, bson.M{"active": false}, &page, fetch); err != ErrInvalidPageToken {
+		t.Fatalf("token of another query must be rejected, got %v", err)
+	}
+}
+
+func TestOffsetPagination(t *testing.T) {
+	docs := []pageDoc{{1, 50}, {2, 40}, {3, 30}}
+	fetch := memoryFetch(t, docs)
+	opts := PageOptions{Size: 2, Sort: []string{"_id"}, Secret: []byte("secret")}
+
+	var page []pageDoc
+	p, err := paginate(opts, nil, &page, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pageIds(page), []int{1, 2}) || p.Next == "" || p.Prev != "" {
+		t.Fatalf("unexpected first page %v %+v", pageIds(page), p)
+	}
+
+	opts.Token = p.Next
+	p, err = paginate(opts, nil, &page, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pageIds(page), []int{3}) || p.Next != "" || p.Prev == "" {
+		t.Fatalf("unexpected last page %v %+v", pageIds(page), p)
+	}
+}
+
+func TestPageTokenSignature(t *testing.T) {
+	token, err := (&pageToken{Sort: []string{"_id"}, Offset: 10}).encode([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodePageToken(token, []byte("secret"))
+	if err != nil || decoded.Offset != 10 {
+		t.Fatalf("unexpected token %+v %v", decoded, err)
+	}
+
+	if _, err := decodePageToken(token, []byte("other")); err != ErrInvalidPageToken {
+		t.Fatalf("expected invalid token with another secret, got %v", err)
+	}
+	if _, err := decodePageToken("x"+token, []byte("secret")); err != ErrInvalidPageToken {
+		t.Fatalf("expected invalid tampered token, got %v", err)
+	}
+}
+
+func TestHashQueryIgnoresKeyOrder(t *testing.T) {
+	a, err := hashQuery(bson.M{"a": 1, "b": bson.M{"c": 2, "d": 3}, "e": 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		b, err := hashQuery(bson.M{"e": 4, "b": bson.M{"d": 3, "c": 2}, "a": 1})
+		if err != nil || !reflect.DeepEqual(a, b) {
+			t.Fatalf("expected equal hashes, got %x %x %v", a, b, err)
+		}
+	}
+}
+
+func TestKeysetPaginationMissingSortField(t *testing.T) {
+	server := mongotest.NewServer(t)
+	c := Wrap(server.Dial(), 0, time.Millisecond).DB("test").C("scores")
+	for _, doc := range []bson.M{{"_id": 1, "score": 3}, {"_id": 2}, {"_id": 3, "score": 1}, {"_id": 4}, {"_id": 5, "score": 2}} {
+		if err := c.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		sort  string
+		pages [][]int
+	}{
+		//null and missing values sort first
+		{"score", [][]int{{2, 4}, {3, 5}, {1}}},
+		{"-score", [][]int{{1, 5}, {3, 2}, {4}}},
+	} {
+		opts := PageOptions{Size: 2, Keyset: true, Sort: []string{test.sort}, Secret: []byte("secret")}
+
+		var page []pageDoc
+		var pages [][]int
+		var p *Page
+		for {
+			var err error
+			if p, err = c.Find(nil).Paginate(opts, &page); err != nil {
+				t.Fatalf("%s: %v", test.sort, err)
+			}
+			pages = append(pages, pageIds(page))
+			if p.Next == "" {
+				break
+			}
+			opts.Token = p.Next
+		}
+		if !reflect.DeepEqual(pages, test.pages) {
+			t.Fatalf("%s: unexpected pages %v", test.sort, pages)
+		}
+
+		//back to the page ending with a missing value
+		opts.Token = p.Prev
+		if _, err := c.Find(nil).Paginate(opts, &page); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pageIds(page), test.pages[1]) {
+			t.Fatalf("%s: unexpected previous page %v", test.sort, pageIds(page))
+		}
+	}
+}
@@ -1,12 +1,21 @@
 package mdb
 
 import (
+	"time"
+
 	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 )
 
 type Pipe struct {
-	originPipe *mgo.Pipe
-	session    *Session
+	originPipe   *mgo.Pipe
+	session      *Session
+	collection   *Collection
+	pipeline     interface{}
+	allowDiskUse bool
+	batch        int
+	readPref     *readPref
+	timeout      time.Duration
 }
 
 //Origin returns origin mgo pipe
@@ -15,13 +24,16 @@ func (p *Pipe) Origin() *mgo.Pipe {
 }
 
 func (p *Pipe) Iter() *Iter {
-	i := &Iter{session: p.session}
-	p.session.execWithRetry(func() error {
-		i.originIter = p.originPipe.Iter()
-		return i.originIter.Err()
+	var iter *Iter
+	d := newDeadline(p.timeout)
+	err := p.intercept(func(p *Pipe, op *Operation) error {
+		iter = p.session.iter(p.readPref, d, op, func(s *Session) *mgo.Iter {
+			return p.timed(s, d).Iter()
+		})
+		return iter.Err()
 	})
 
-	return i
+	return interceptedIter(p.session, iter, err)
 }
 
 func (p *Pipe) All(result interface{}) error {
@@ -29,31 +41,78 @@ func (p *Pipe) All(result interface{}) error {
 }
 
 func (p *Pipe) One(result interface{}) error {
-	lastErr := p.session.execWithRetry(func() error {
-		return p.originPipe.One(result)
+	return p.exec(func(pipe *mgo.Pipe) error {
+		return pipe.One(result)
 	})
-
-	return lastErr
 }
 
 func (p *Pipe) Explain(result interface{}) error {
-	lastErr := p.session.execWithRetry(func() error {
-		return p.originPipe.Explain(result)
+	return p.exec(func(pipe *mgo.Pipe) error {
+		return pipe.Explain(result)
 	})
-
-	return lastErr
 }
 
 func (p *Pipe) AllowDiskUse() *Pipe {
-	return &Pipe{
-		originPipe: p.originPipe.AllowDiskUse(),
-		session:    p.session,
-	}
+	np := *p
+	np.allowDiskUse = true
+	np.originPipe = p.originPipe.AllowDiskUse()
+	return &np
 }
 
 func (p *Pipe) Batch(n int) *Pipe {
-	return &Pipe{
-		session:    p.session,
-		originPipe: p.originPipe.Batch(n),
+	np := *p
+	np.batch = n
+	np.originPipe = p.originPipe.Batch(n)
+	return &np
+}
+
+//ReadPref makes the pipeline execute on a copy of the session
+//in the given mode, see Query.ReadPref
+func (p *Pipe) ReadPref(mode Mode, tags ...bson.D) *Pipe {
+	np := *p
+	np.readPref = &readPref{mode: mode, tags: tags}
+	return &np
+}
+
+//on returns the mgo pipe bound to the given session
+func (p *Pipe) on(s *Session) *mgo.Pipe {
+	if s == p.session {
+		return p.originPipe
 	}
+
+	return p.rebuild(p.collection.originCollection.With(s.originSession))
+}
+
+func (p *Pipe) rebuild(c *mgo.Collection) *mgo.Pipe {
+	pipe := c.Pipe(p.pipeline)
+	if p.allowDiskUse {
+		pipe = pipe.AllowDiskUse()
+	}
+	if p.batch != 0 {
+		pipe = pipe.Batch(p.batch)
+	}
+
+	return pipe
+}
+
+func (p *Pipe) exec(f func(pipe *mgo.Pipe) error) error {
+	d := newDeadline(p.timeout)
+	return p.intercept(func(p *Pipe, op *Operation) error {
+		return p.session.read(p.readPref, func(s *Session) error {
+			return s.execWithDeadline(d, countRetries(op, func() error {
+				return s.attempt(d, func(s *Session) error {
+					return f(p.timed(s, d))
+				})
+			}))
+		})
+	})
+}
+
+//timed returns the mgo pipe bound to s with maxTimeMS set to the time left of d
+func (p *Pipe) timed(s *Session, d deadline) *mgo.Pipe {
+	if !d.set() {
+		return p.on(s)
+	}
+
+	return p.rebuild(p.collection.originCollection.With(s.originSession)).SetMaxTime(d.maxTime(0))
 }
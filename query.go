@@ -4,11 +4,82 @@ import (
 	"time"
 
 	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 )
 
 type Query struct {
 	originQuery *mgo.Query
 	session     *Session
+	collection  *Collection
+	spec        querySpec
+	readPref    *readPref
+	cacheTTL    time.Duration
+	coalesce    bool
+	timeout     time.Duration
+}
+
+// querySpec records everything applied to a query,
+// so it can be rebuilt over another session.
+type querySpec struct {
+	filter    interface{}
+	selector  interface{}
+	sort      []string
+	skip      int
+	limit     int
+	batch     int
+	prefetch  *float64
+	hint      []string
+	maxScan   int
+	maxTime   time.Duration
+	snapshot  bool
+	comment   string
+	logReplay bool
+	collation *mgo.Collation
+}
+
+func (s *querySpec) build(c *mgo.Collection) *mgo.Query {
+	q := c.Find(s.filter)
+	if s.selector != nil {
+		q = q.Select(s.selector)
+	}
+	if len(s.sort) > 0 {
+		q = q.Sort(s.sort...)
+	}
+	if s.skip != 0 {
+		q = q.Skip(s.skip)
+	}
+	if s.limit != 0 {
+		q = q.Limit(s.limit)
+	}
+	if s.batch != 0 {
+		q = q.Batch(s.batch)
+	}
+	if s.prefetch != nil {
+		q = q.Prefetch(*s.prefetch)
+	}
+	if len(s.hint) > 0 {
+		q = q.Hint(s.hint...)
+	}
+	if s.maxScan != 0 {
+		q = q.SetMaxScan(s.maxScan)
+	}
+	if s.maxTime != 0 {
+		q = q.SetMaxTime(s.maxTime)
+	}
+	if s.snapshot {
+		q = q.Snapshot()
+	}
+	if s.comment != "" {
+		q = q.Comment(s.comment)
+	}
+	if s.logReplay {
+		q = q.LogReplay()
+	}
+	if s.collation != nil {
+		q = q.Collation(s.collation)
+	}
+
+	return q
 }
 
 //Origin returns origin mgo query
@@ -17,86 +88,127 @@ func (q *Query) Origin() *mgo.Query {
 }
 
 func (q *Query) Batch(n int) *Query {
+	q.spec.batch = n
 	q.originQuery = q.originQuery.Batch(n)
 	return q
 }
 
 func (q *Query) Prefetch(p float64) *Query {
+	q.spec.prefetch = &p
 	q.originQuery = q.originQuery.Prefetch(p)
 	return q
 }
 
 func (q *Query) Skip(n int) *Query {
+	q.spec.skip = n
 	q.originQuery = q.originQuery.Skip(n)
 	return q
 }
 
 func (q *Query) Limit(n int) *Query {
+	q.spec.limit = n
 	q.originQuery = q.originQuery.Limit(n)
 	return q
 }
 
 func (q *Query) Select(selector interface{}) *Query {
+	q.spec.selector = selector
 	q.originQuery = q.originQuery.Select(selector)
 	return q
 }
 
 func (q *Query) Sort(fields ...string) *Query {
+	q.spec.sort = fields
 	q.originQuery = q.originQuery.Sort(fields...)
 	return q
 }
 
+//ReadPref makes the query execute on a copy of the session
+//in the given mode, restricted to servers matching tags.
+//If the session has a fallback policy, the query is sent to the primary
+//when secondaries are unavailable or lagging.
+func (q *Query) ReadPref(mode Mode, tags ...bson.D) *Query {
+	q.readPref = &readPref{mode: mode, tags: tags}
+	return q
+}
+
 func (q *Query) Explain(result interface{}) error {
-	lastErr := q.session.execWithRetry(func() error {
-		return q.originQuery.Explain(result)
+	return q.exec(OpExplain, nil, func(query *mgo.Query) error {
+		return query.Explain(result)
 	})
-
-	return lastErr
 }
 
 func (q *Query) Hint(indexKey ...string) *Query {
+	q.spec.hint = indexKey
 	q.originQuery = q.originQuery.Hint(indexKey...)
 	return q
 }
 
 func (q *Query) SetMaxScan(n int) *Query {
+	q.spec.maxScan = n
 	q.originQuery = q.originQuery.SetMaxScan(n)
 	return q
 }
 
 func (q *Query) SetMaxTime(d time.Duration) *Query {
+	q.spec.maxTime = d
 	q.originQuery = q.originQuery.SetMaxTime(d)
 	return q
 }
 
 func (q *Query) Snapshot() *Query {
+	q.spec.snapshot = true
 	q.originQuery = q.originQuery.Snapshot()
 	return q
 }
 
 func (q *Query) Comment(comment string) *Query {
+	q.spec.comment = comment
 	q.originQuery = q.originQuery.Comment(comment)
 	return q
 }
 
 func (q *Query) LogReplay() *Query {
+	q.spec.logReplay = true
 	q.originQuery = q.originQuery.LogReplay()
 	return q
 }
 
 func (q *Query) One(result interface{}) error {
-	err := q.session.execWithRetry(func() error {
-		return q.originQuery.One(result)
-	})
+	if crypt := q.collection.crypt; crypt != nil {
+		var raw bson.Raw
+		if err := q.one(&raw); err != nil {
+			return err
+		}
+		return crypt.decode(raw, result)
+	}
+
+	return q.one(result)
+}
+
+func (q *Query) one(result interface{}) error {
+	if q.caching() || q.coalescing() {
+		return q.cachedOne(result)
+	}
 
-	return err
+	return q.exec(OpFind, bson.M{"one": true}, func(query *mgo.Query) error {
+		return query.One(result)
+	})
 }
 
 func (q *Query) Count() (int, error) {
+	if q.caching() || q.coalescing() {
+		return q.cachedCount()
+	}
+
+	return q.count()
+}
+
+func (q *Query) count() (int, error) {
 	var n int
-	lastErr := q.session.execWithRetry(func() error {
+	lastErr := q.exec(OpCount, nil, func(query *mgo.Query) error {
 		var err error
-		n, err = q.originQuery.Count()
+		n, err = query.Count()
 		return err
 	})
 
@@ -104,59 +216,250 @@ func (q *Query) Count() (int, error) {
 }
 
 func (q *Query) Iter() *Iter {
-	i := &Iter{session: q.session}
-	q.session.execWithRetry(func() error {
-		i.originIter = q.originQuery.Iter()
-		return i.originIter.Err()
+	var iter *Iter
+	d := newDeadline(q.timeout)
+	err := q.intercept(q.operation(OpFind, nil), func(q *Query, op *Operation) error {
+		iter = q.session.iter(q.readPref, d, op, func(s *Session) *mgo.Iter {
+			return q.timed(s, d).Iter()
+		})
+		iter.crypt = q.collection.crypt
+		return iter.Err()
 	})
 
-	return i
+	return interceptedIter(q.session, iter, err)
 }
 
 func (q *Query) Tail(timeout time.Duration) *Iter {
-	i := &Iter{session: q.session}
-	q.session.execWithRetry(func() error {
-		i.originIter = q.originQuery.Tail(timeout)
-		return i.originIter.Err()
+	var iter *Iter
+	err := q.intercept(q.operation(OpFind, bson.M{"tailable": true}), func(q *Query, op *Operation) error {
+		iter = q.session.iter(q.readPref, deadline{}, op, func(s *Session) *mgo.Iter {
+			return q.on(s).Tail(timeout)
+		})
+		iter.crypt = q.collection.crypt
+		return iter.Err()
 	})
 
-	return i
+	return interceptedIter(q.session, iter, err)
 }
 
 func (q *Query) Distinct(key string, result interface{}) error {
-	lastErr := q.session.execWithRetry(func() error {
-		return q.originQuery.Distinct(key, result)
-	})
+	if q.caching() || q.coalescing() {
+		return q.cachedDistinct(key, result)
+	}
 
-	return lastErr
+	return q.exec(OpDistinct, bson.M{"key": key}, func(query *mgo.Query) error {
+		return query.Distinct(key, result)
+	})
 }
 
 func (q *Query) MapReduce(job *mgo.MapReduce, result interface{}) (*mgo.MapReduceInfo, error) {
 	var info *mgo.MapReduceInfo
-	lastErr := q.session.execWithRetry(func() error {
+	lastErr := q.exec(OpMapReduce, bson.M{"job": job}, func(query *mgo.Query) error {
 		var err error
-		info, err = q.originQuery.MapReduce(job, result)
+		info, err = query.MapReduce(job, result)
 		return err
 	})
 
 	return info, lastErr
 }
 
+//Apply always runs on the primary, read preference is ignored
 func (q *Query) Apply(change mgo.Change, result interface{}) (*mgo.ChangeInfo, error) {
+	change, err := q.collection.prepareChange(change)
+	if err != nil {
+		return nil, err
+	}
+
+	op := q.operation(OpApply, bson.M{"upsert": change.Upsert, "remove": change.Remove, "returnNew": change.ReturnNew})
+	op.Update = change.Update
+
+	//the returned document is read raw, to be decrypted and kept for the middleware
+	var raw bson.Raw
 	var info *mgo.ChangeInfo
-	lastErr := q.session.execWithRetry(func() error {
-		var err error
-		info, err = q.originQuery.Apply(change, result)
-		return err
+	d := newDeadline(q.timeout)
+	lastErr := q.intercept(op, func(q *Query, op *Operation) error {
+		change.Update = op.Update
+		return q.session.execWithDeadline(d, countRetries(op, func() error {
+			return q.session.attempt(d, func(s *Session) error {
+				var err error
+				info, err = q.apply(s, d, change, &raw)
+				op.applied = raw
+				return err
+			})
+		}))
 	})
+	if lastErr == nil && result != nil && raw.Kind != 0 {
+		var err error
+		if crypt := q.collection.crypt; crypt != nil {
+			err = crypt.decode(raw, result)
+		} else {
+			err = raw.Unmarshal(result)
+		}
+		if err != nil {
+			return info, err
+		}
+	}
+	q.collection.invalidateCache()
 
 	return info, lastErr
 }
 
+//applyUpsertAttempts is how many times an upsert racing another on a unique index is run, like mgo does
+const applyUpsertAttempts = 5
+
+//apply runs findAndModify on s. mgo can't send maxTimeMS with it, so within a deadline
+//the command is run directly with the time left of d, on the attempt copy of the session.
+func (q *Query) apply(s *Session, d deadline, change mgo.Change, result *bson.Raw) (*mgo.ChangeInfo, error) {
+	if !d.set() {
+		return q.on(s).Apply(change, result)
+	}
+
+	cmd := bson.D{{"findAndModify", q.collection.Name}, {"query", q.spec.filter}}
+	if len(q.spec.sort) > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "sort", Value: sortDocument(q.spec.sort)})
+	}
+	if q.spec.selector != nil {
+		cmd = append(cmd, bson.DocElem{Name: "fields", Value: q.spec.selector})
+	}
+	if change.Remove {
+		cmd = append(cmd, bson.DocElem{Name: "remove", Value: true})
+	} else {
+		cmd = append(cmd, bson.DocElem{Name: "update", Value: change.Update})
+	}
+	if change.Upsert {
+		cmd = append(cmd, bson.DocElem{Name: "upsert", Value: true})
+	}
+	if change.ReturnNew {
+		cmd = append(cmd, bson.DocElem{Name: "new", Value: true})
+	}
+	cmd = append(cmd,
+		bson.DocElem{Name: "writeConcern", Value: writeConcern(s.Safe())},
+		bson.DocElem{Name: "maxTimeMS", Value: int64(d.maxTime(q.spec.maxTime) / time.Millisecond)},
+	)
+
+	var doc struct {
+		Value        bson.Raw
+		LastError    mgo.LastError `bson:"lastErrorObject"`
+		ConcernError struct {
+			Code   int
+			ErrMsg string `bson:"errmsg"`
+		} `bson:"writeConcernError"`
+	}
+	s.SetMode(mgo.Strong, false)
+	db := q.collection.on(s).Database
+	var err error
+	for i := 0; i < applyUpsertAttempts; i++ {
+		if err = db.Run(cmd, &doc); err == nil || !change.Upsert || !mgo.IsDup(err) {
+			break
+		}
+	}
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Message == "No matching object found" {
+		return nil, mgo.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if doc.LastError.N == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	if doc.Value.Kind != 0x0A {
+		*result = doc.Value
+	}
+
+	info := &mgo.ChangeInfo{}
+	switch lerr := doc.LastError; {
+	case lerr.UpdatedExisting:
+		info.Updated, info.Matched = lerr.N, lerr.N
+	case change.Remove:
+		info.Removed, info.Matched = lerr.N, lerr.N
+	case change.Upsert:
+		info.UpsertedId = lerr.UpsertedId
+	}
+	if e := doc.ConcernError; e.Code != 0 {
+		return info, &mgo.LastError{Code: e.Code, Err: e.ErrMsg}
+	}
+
+	return info, nil
+}
+
+//writeConcern returns the write concern of the safety mode the way mgo sends it
+func writeConcern(safe *mgo.Safe) bson.D {
+	if safe == nil {
+		return bson.D{{"w", 0}}
+	}
+
+	wc := bson.D{}
+	if safe.WMode != "" {
+		wc = append(wc, bson.DocElem{Name: "w", Value: safe.WMode})
+	} else if safe.W > 0 {
+		wc = append(wc, bson.DocElem{Name: "w", Value: safe.W})
+	}
+	if safe.WTimeout > 0 {
+		wc = append(wc, bson.DocElem{Name: "wtimeout", Value: safe.WTimeout})
+	}
+	if safe.FSync {
+		wc = append(wc, bson.DocElem{Name: "fsync", Value: true})
+	}
+	if safe.J {
+		wc = append(wc, bson.DocElem{Name: "j", Value: true})
+	}
+
+	return wc
+}
+
 func (q *Query) All(result interface{}) error {
+	if crypt := q.collection.crypt; crypt != nil {
+		var docs []bson.Raw
+		if err := q.all(&docs); err != nil {
+			return err
+		}
+		return crypt.decodeAll(docs, result)
+	}
+
+	return q.all(result)
+}
+
+func (q *Query) all(result interface{}) error {
+	if q.caching() {
+		return q.cachedAll(result)
+	}
+
 	return q.Iter().All(result)
 }
 
 func (q *Query) For(result interface{}, f func() error) error {
 	return q.Iter().For(result, f)
 }
+
+//on returns the mgo query bound to the given session
+func (q *Query) on(s *Session) *mgo.Query {
+	if s == q.session {
+		return q.originQuery
+	}
+
+	return q.spec.build(q.collection.originCollection.With(s.originSession))
+}
+
+func (q *Query) exec(kind OpKind, options bson.M, f func(query *mgo.Query) error) error {
+	d := newDeadline(q.timeout)
+	return q.intercept(q.operation(kind, options), func(q *Query, op *Operation) error {
+		return q.session.read(q.readPref, func(s *Session) error {
+			return s.execWithDeadline(d, countRetries(op, func() error {
+				return s.attempt(d, func(s *Session) error {
+					return f(q.timed(s, d))
+				})
+			}))
+		})
+	})
+}
+
+//timed returns the mgo query bound to s with maxTimeMS set to the time left of d
+func (q *Query) timed(s *Session, d deadline) *mgo.Query {
+	if !d.set() {
+		return q.on(s)
+	}
+
+	spec := q.spec
+	spec.maxTime = d.maxTime(spec.maxTime)
+	return spec.build(q.collection.originCollection.With(s.originSession))
+}
@@ -0,0 +1,72 @@
+package mdb
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestQuerySpecBuild(t *testing.T) {
+	server := newFakeServer(t)
+	s := server.Dial(0)
+
+	var mu sync.Mutex
+	var ops []*fakeOp
+	server.Handle(func(op *fakeOp) []bson.M {
+		mu.Lock()
+		ops = append(ops, op)
+		mu.Unlock()
+		return []bson.M{{"_id": 1}}
+	})
+
+	c := s.DB("test").C("people")
+	q := c.Find(bson.M{"name": "Ale"}).
+		Select(bson.M{"name": 1}).
+		Sort("-age", "name").
+		Skip(3).
+		Limit(5).
+		Batch(2).
+		Prefetch(0.5).
+		Hint("name").
+		SetMaxScan(10).
+		SetMaxTime(time.Second).
+		Snapshot().
+		Comment("spec").
+		LogReplay().
+		Collation(&mgo.Collation{Locale: "en"})
+
+	var result bson.M
+	if err := q.One(&result); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.spec.build(c.originCollection).One(&result); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.ReadPref(Primary).One(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ops) != 3 {
+		t.Fatalf("expected 3 queries, got %d", len(ops))
+	}
+
+	origin := ops[0]
+	if origin.Skip != 3 || origin.Selector == nil || origin.Query["name"] != "Ale" {
+		t.Fatalf("builders not applied: %+v", origin)
+	}
+	for _, key := range []string{"$orderby", "$hint", "$maxScan", "$maxTimeMS", "$snapshot", "$comment", "$collation"} {
+		if _, ok := origin.Options[key]; !ok {
+			t.Fatalf("%s not applied: %+v", key, origin.Options)
+		}
+	}
+
+	for i, op := range ops[1:] {
+		if !reflect.DeepEqual(origin, op) {
+			t.Fatalf("rebuilt query %d differs:\n%+v\n%+v", i+1, origin, op)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Package queue implements a persistent work queue on a collection,
+// with priorities, delays, visibility timeouts and dead-lettering.
+package queue
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ZloyDyadka/mdb"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	DefaultVisibilityTimeout = time.Minute * 5
+	DefaultMaxAttempts       = 5
+	DefaultPollInterval      = time.Second
+	DeadLetterSuffix         = "_dead"
+)
+
+var (
+	//ErrEmpty is returned by Claim when no job is ready
+	ErrEmpty = errors.New("queue: no job ready")
+	//ErrClaimLost is returned when the job was claimed again after the visibility timeout or already acked
+	ErrClaimLost = errors.New("queue: job claim lost")
+)
+
+//Job is a queued document
+type Job struct {
+	Id        bson.ObjectId `bson:"_id"`
+	Payload   bson.Raw      `bson:"payload"`
+	Priority  int           `bson:"priority"`
+	Attempts  int           `bson:"attempts"`
+	VisibleAt time.Time     `bson:"visibleAt"`
+	CreatedAt time.Time     `bson:"createdAt"`
+	LastError string        `bson:"lastError,omitempty"`
+	//Claim identifies the current claim, acks and nacks of an older claim fail with ErrClaimLost
+	Claim string `bson:"claim,omitempty"`
+}
+
+//Decode unmarshals the payload into v
+func (j *Job) Decode(v interface{}) error {
+	return j.Payload.Unmarshal(v)
+}
+
+type Option func(q *Queue)
+
+type Queue struct {
+	c                 *mdb.Collection
+	dead              *mdb.Collection
+	visibilityTimeout time.Duration
+	maxAttempts       int
+	pollInterval      time.Duration
+}
+
+//VisibilityTimeout is how long a claimed job is hidden from other workers before it's claimed again
+func VisibilityTimeout(d time.Duration) Option {
+	return func(q *Queue) {
+		q.visibilityTimeout = d
+	}
+}
+
+//MaxAttempts is how many times a job is claimed before it's moved to the dead letter collection
+func MaxAttempts(n int) Option {
+	return func(q *Queue) {
+		q.maxAttempts = n
+	}
+}
+
+//DeadLetter sets the collection of failed jobs, the queue collection name with DeadLetterSuffix by default
+func DeadLetter(c *mdb.Collection) Option {
+	return func(q *Queue) {
+		q.dead = c
+	}
+}
+
+//PollInterval is how often idle workers look for ready jobs
+func PollInterval(d time.Duration) Option {
+	return func(q *Queue) {
+		q.pollInterval = d
+	}
+}
+
+func New(c *mdb.Collection, opts ...Option) *Queue {
+	q := &Queue{
+		c:                 c,
+		visibilityTimeout: DefaultVisibilityTimeout,
+		maxAttempts:       DefaultMaxAttempts,
+		pollInterval:      DefaultPollInterval,
+	}
+
+	for _, o := range opts {
+		o(q)
+	}
+
+	if q.dead == nil {
+		q.dead = c.Database.C(c.Name + DeadLetterSuffix)
+	}
+
+	return q
+}
+
+//EnsureIndexes creates the index used by Claim
+func (q *Queue) EnsureIndexes() error {
+	return q.c.EnsureIndex(mgo.Index{Key: []string{"-priority", "visibleAt"}})
+}
+
+type enqueueOptions struct {
+	priority int
+	delay    time.Duration
+}
+
+type EnqueueOption func(o *enqueueOptions)
+
+//Priority sets the job priority, higher priorities are claimed first
+func Priority(p int) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.priority = p
+	}
+}
+
+//Delay hides the job for d
+func Delay(d time.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.delay = d
+	}
+}
+
+//Enqueue adds a job with the payload and returns its id
+func (q *Queue) Enqueue(payload interface{}, opts ...EnqueueOption) (bson.ObjectId, error) {
+	job, err := newJob(payload, time.Now(), opts...)
+	if err != nil {
+		return "", err
+	}
+
+	//the id is set before inserting, so a duplicate after a retried insert means it was stored
+	if err := q.c.Insert(job); err != nil && !mgo.IsDup(err) {
+		return "", err
+	}
+
+	return job.Id, nil
+}
+
+func newJob(payload interface{}, now time.Time, opts ...EnqueueOption) (*Job, error) {
+	var o enqueueOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	data, err := bson.Marshal(bson.M{"payload": payload})
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Payload bson.Raw `bson:"payload"`
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	return &Job{
+		Id:        bson.NewObjectId(),
+		Payload:   doc.Payload,
+		Priority:  o.priority,
+		VisibleAt: now.Add(o.delay),
+		CreatedAt: now,
+	}, nil
+}
+
+//Claim atomically takes the ready job with the highest priority and hides it for the visibility timeout.
+//Jobs claimed more than the max attempts are dead-lettered instead.
+//A claim whose reply was lost with the connection is retried as a new claim,
+//the lost one becomes ready again after the visibility timeout.
+//It returns ErrEmpty if no job is ready.
+func (q *Queue) Claim() (*Job, error) {
+	for {
+		now := time.Now()
+		job := &Job{}
+		_, err := q.c.Find(bson.M{"visibleAt": bson.M{"$lte": now}}).Sort("-priority", "visibleAt").Apply(mgo.Change{
+			Update: bson.M{
+				"$set": bson.M{"visibleAt": now.Add(q.visibilityTimeout), "claim": bson.NewObjectId().Hex()},
+				"$inc": bson.M{"attempts": 1},
+			},
+			ReturnNew: true,
+		}, job)
+
+		if err == mgo.ErrNotFound {
+			return nil, ErrEmpty
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		//the previous claims timed out without ack or nack
+		if job.Attempts > q.maxAttempts {
+			if err := q.deadLetter(job); err != nil && err != ErrClaimLost {
+				return nil, err
+			}
+			continue
+		}
+
+		return job, nil
+	}
+}
+
+//Ack removes the completed job
+func (q *Queue) Ack(job *Job) error {
+	err := q.c.Remove(bson.M{"_id": job.Id, "claim": job.Claim})
+	if err == mgo.ErrNotFound {
+		return q.claimLost(job)
+	}
+
+	return err
+}
+
+//claimLost tells a job claimed by another worker from one already removed,
+//e.g. by a remove retried after the connection broke
+func (q *Queue) claimLost(job *Job) error {
+	err := q.c.FindId(job.Id).Select(bson.M{"_id": 1}).One(&bson.M{})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return ErrClaimLost
+}
+
+//Nack releases the job to be claimed again after delay,
+//or moves it to the dead letter collection when it reached the max attempts
+func (q *Queue) Nack(job *Job, delay time.Duration, cause error) error {
+	if cause != nil {
+		job.LastError = cause.Error()
+	}
+
+	if job.Attempts >= q.maxAttempts {
+		return q.deadLetter(job)
+	}
+
+	err := q.c.Update(
+		bson.M{"_id": job.Id, "claim": job.Claim},
+		//the claim is kept, so a retried update still matches
+		bson.M{"$set": bson.M{"visibleAt": time.Now().Add(delay), "lastError": job.LastError}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrClaimLost
+	}
+
+	return err
+}
+
+//Extend hides the claimed job for another d, for jobs running longer than the visibility timeout
+func (q *Queue) Extend(job *Job, d time.Duration) error {
+	visibleAt := time.Now().Add(d)
+	err := q.c.Update(bson.M{"_id": job.Id, "claim": job.Claim}, bson.M{"$set": bson.M{"visibleAt": visibleAt}})
+	if err == mgo.ErrNotFound {
+		return ErrClaimLost
+	}
+	if err == nil {
+		job.VisibleAt = visibleAt
+	}
+
+	return err
+}
+
+//DeadLetters returns the dead letter collection
+func (q *Queue) DeadLetters() *mdb.Collection {
+	return q.dead
+}
+
+//deadLetter copies the job to the dead letter collection before removing it,
+//a retried copy fails as duplicate and is ignored
+func (q *Queue) deadLetter(job *Job) error {
+	if err := q.dead.Insert(job); err != nil && !mgo.IsDup(err) {
+		return err
+	}
+
+	return q.Ack(job)
+}
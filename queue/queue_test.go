@@ -0,0 +1,221 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ZloyDyadka/mdb"
+	"github.com/ZloyDyadka/mdb/internal/mongotest"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestNewJob(t *testing.T) {
+	now := time.Now()
+	job, err := newJob(map[string]string{"email": "ale@example.com"}, now, Priority(3), Delay(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.Id == "" || job.Priority != 3 || !job.VisibleAt.Equal(now.Add(time.Minute)) || !job.CreatedAt.Equal(now) {
+		t.Fatalf("unexpected job %+v", job)
+	}
+
+	var payload struct {
+		Email string `bson:"email"`
+	}
+	if err := job.Decode(&payload); err != nil || payload.Email != "ale@example.com" {
+		t.Fatalf("unexpected payload %+v %v", payload, err)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second, time.Second*5)
+
+	for attempts, expected := range map[int]time.Duration{
+		1: time.Second,
+		2: time.Second * 2,
+		3: time.Second * 4,
+		4: time.Second * 5,
+		9: time.Second * 5,
+	} {
+		if d := backoff(attempts); d != expected {
+			t.Fatalf("attempt %d: expected %v, got %v", attempts, expected, d)
+		}
+	}
+}
+
+func newTestQueue(t *testing.T, opts ...Option) (*mongotest.Server, *Queue) {
+	server := mongotest.NewServer(t)
+	c := mdb.Wrap(server.Dial(), 0, time.Millisecond).DB("test").C("jobs")
+	return server, New(c, opts...)
+}
+
+func TestClaimAckNack(t *testing.T) {
+	server, q := newTestQueue(t)
+
+	low, err := q.Enqueue("low")
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := q.Enqueue("high", Priority(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue("delayed", Priority(9), Delay(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := q.Claim()
+	if err != nil || first.Id != high || first.Attempts != 1 {
+		t.Fatalf("expected the high priority job claimed, got %+v %v", first, err)
+	}
+	second, err := q.Claim()
+	if err != nil || second.Id != low {
+		t.Fatalf("expected the low priority job claimed, got %+v %v", second, err)
+	}
+	if _, err := q.Claim(); err != ErrEmpty {
+		t.Fatalf("expected ErrEmpty while jobs are claimed or delayed, got %v", err)
+	}
+
+	if err := q.Ack(first); err != nil {
+		t.Fatal(err)
+	}
+	if docs := server.Docs("test.jobs", bson.D{{"_id", high}}); len(docs) != 0 {
+		t.Fatalf("expected the acked job removed, got %v", docs)
+	}
+
+	if err := q.Nack(second, 0, errors.New("smtp down")); err != nil {
+		t.Fatal(err)
+	}
+	retried, err := q.Claim()
+	if err != nil || retried.Id != low || retried.Attempts != 2 || retried.LastError != "smtp down" {
+		t.Fatalf("expected the nacked job claimed again, got %+v %v", retried, err)
+	}
+	if err := q.Ack(second); err != ErrClaimLost {
+		t.Fatalf("expected ErrClaimLost for the previous claim, got %v", err)
+	}
+
+	if err := q.Nack(retried, time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Claim(); err != ErrEmpty {
+		t.Fatalf("expected the nacked job hidden for its delay, got %v", err)
+	}
+	visibleAt := server.Docs("test.jobs", bson.D{{"_id", low}})[0].Map()["visibleAt"].(time.Time)
+	if visibleAt.Before(time.Now().Add(time.Minute * 59)) {
+		t.Fatalf("expected the job visible in an hour, got %v", visibleAt)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	server, q := newTestQueue(t, MaxAttempts(2), VisibilityTimeout(time.Millisecond*10))
+
+	nacked, err := q.Enqueue("nacked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 2; attempt++ {
+		job, err := q.Claim()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Nack(job, 0, errors.New("failed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dead := server.Docs("test.jobs_dead", bson.D{{"_id", nacked}})
+	if len(dead) != 1 || dead[0].Map()["lastError"] != "failed" {
+		t.Fatalf("expected the job dead-lettered after max attempts, got %v", dead)
+	}
+
+	//claims timing out without ack or nack count as attempts too
+	timedOut, err := q.Enqueue("timed out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 2; attempt++ {
+		if _, err := q.Claim(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if _, err := q.Claim(); err != ErrEmpty {
+		t.Fatalf("expected ErrEmpty after dead-lettering, got %v", err)
+	}
+	if dead := server.Docs("test.jobs_dead", bson.D{{"_id", timedOut}}); len(dead) != 1 {
+		t.Fatalf("expected the timed out job dead-lettered, got %v", dead)
+	}
+	if docs := server.Docs("test.jobs", nil); len(docs) != 0 {
+		t.Fatalf("expected an empty queue, got %v", docs)
+	}
+}
+
+func TestClaimIsExclusive(t *testing.T) {
+	_, q := newTestQueue(t)
+
+	const jobs = 50
+	for i := 0; i < jobs; i++ {
+		if _, err := q.Enqueue(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		claimed = map[bson.ObjectId]int{}
+		wg      sync.WaitGroup
+	)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := q.Claim()
+				if err != nil {
+					if err != ErrEmpty {
+						t.Error(err)
+					}
+					return
+				}
+				mu.Lock()
+				claimed[job.Id]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != jobs {
+		t.Fatalf("expected %d jobs claimed, got %d", jobs, len(claimed))
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Fatalf("job %s claimed %d times", id.Hex(), n)
+		}
+	}
+}
+
+func TestRunDefaultsBackoff(t *testing.T) {
+	server, q := newTestQueue(t, PollInterval(time.Millisecond))
+
+	id, err := q.Enqueue("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Run(ctx, 1, func(ctx context.Context, job *Job) error {
+		cancel()
+		return errors.New("failed")
+	}, nil, func(err error) {
+		t.Error(err)
+	})
+
+	doc := server.Docs("test.jobs", bson.D{{"_id", id}})[0].Map()
+	if doc["lastError"] != "failed" || !doc["visibleAt"].(time.Time).After(time.Now()) {
+		t.Fatalf("expected the job nacked with the default backoff, got %v", doc)
+	}
+}
@@ -0,0 +1,85 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBackoffBase = time.Second
+	DefaultBackoffMax  = time.Minute * 10
+)
+
+//Handler processes a claimed job, returning an error nacks it
+type Handler func(ctx context.Context, job *Job) error
+
+//Backoff returns the delay before a failed job is retried
+type Backoff func(attempts int) time.Duration
+
+//ExponentialBackoff doubles the delay on every attempt, up to max
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(attempts int) time.Duration {
+		d := base
+		for i := 1; i < attempts && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			return max
+		}
+		return d
+	}
+}
+
+//Run processes jobs with the given number of workers until ctx is done.
+//Jobs are acked when handler succeeds and nacked with the backoff delay when it fails,
+//backoff is ExponentialBackoff(DefaultBackoffBase, DefaultBackoffMax) if nil.
+//Errors of the queue itself are passed to onError, which may be nil.
+func (q *Queue) Run(ctx context.Context, workers int, handler Handler, backoff Backoff, onError func(error)) {
+	if backoff == nil {
+		backoff = ExponentialBackoff(DefaultBackoffBase, DefaultBackoffMax)
+	}
+	if onError == nil {
+		onError = func(error) {}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx, handler, backoff, onError)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context, handler Handler, backoff Backoff, onError func(error)) {
+	for ctx.Err() == nil {
+		job, err := q.Claim()
+		if err != nil {
+			if err != ErrEmpty {
+				onError(err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(q.pollInterval):
+			}
+			continue
+		}
+
+		if err := handler(ctx, job); err != nil {
+			err = q.Nack(job, backoff(job.Attempts), err)
+			if err != nil {
+				onError(err)
+			}
+			continue
+		}
+
+		if err := q.Ack(job); err != nil {
+			onError(err)
+		}
+	}
+}
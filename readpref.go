@@ -0,0 +1,333 @@
+package mdb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const DefaultStatusInterval = time.Second * 5
+
+const (
+	memberPrimary   = 1
+	memberSecondary = 2
+)
+
+//FallbackPolicy controls when reads with a secondary read preference
+//are sent to the primary instead.
+//Secondaries matching the read preference tags are eligible, those lagging more than MaxStaleness
+//are excluded by narrowing the read to the tags of the fresh ones.
+//The read falls back if no healthy fresh secondary is left or the tags can't tell it from a stale one.
+type FallbackPolicy struct {
+	//MaxStaleness is the maximum replication lag of an eligible secondary.
+	//Zero means that only availability of secondaries is checked.
+	MaxStaleness time.Duration
+	//StatusInterval is how long the replSetGetStatus result is reused,
+	//DefaultStatusInterval if zero
+	StatusInterval time.Duration
+}
+
+//ReadFallback enables falling back to the primary for reads issued with Query.ReadPref or Pipe.ReadPref
+func ReadFallback(policy FallbackPolicy) func(session *Session) {
+	return func(s *Session) {
+		if policy.StatusInterval == 0 {
+			policy.StatusInterval = DefaultStatusInterval
+		}
+		s.fallback = &readFallback{policy: policy}
+	}
+}
+
+type readPref struct {
+	mode Mode
+	tags []bson.D
+}
+
+type readFallback struct {
+	policy FallbackPolicy
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	checking  bool
+	//members is nil until the status was fetched successfully
+	members []fallbackMember
+}
+
+type fallbackMember struct {
+	secondary bool
+	healthy   bool
+	lag       time.Duration
+	tags      bson.D
+}
+
+type replSetStatus struct {
+	Set     string          `bson:"set"`
+	Date    time.Time       `bson:"date"`
+	Members []replSetMember `bson:"members"`
+}
+
+type replSetMember struct {
+	Name       string    `bson:"name"`
+	Health     float64   `bson:"health"`
+	State      int       `bson:"state"`
+	StateStr   string    `bson:"stateStr"`
+	OptimeDate time.Time `bson:"optimeDate"`
+	Self       bool      `bson:"self"`
+}
+
+type replSetConfig struct {
+	Config struct {
+		Members []struct {
+			Host string `bson:"host"`
+			Tags bson.D `bson:"tags"`
+		} `bson:"members"`
+	} `bson:"config"`
+}
+
+func (st *replSetStatus) primary() *replSetMember {
+	for i := range st.Members {
+		if st.Members[i].State == memberPrimary {
+			return &st.Members[i]
+		}
+	}
+
+	return nil
+}
+
+//lag returns replication lag of the member relative to the primary
+func (st *replSetStatus) lag(m *replSetMember) time.Duration {
+	primary := st.primary()
+	if primary == nil || m.State != memberSecondary {
+		return 0
+	}
+
+	if lag := primary.OptimeDate.Sub(m.OptimeDate); lag > 0 {
+		return lag
+	}
+
+	return 0
+}
+
+func (s *Session) replSetStatus() (*replSetStatus, error) {
+	var status replSetStatus
+	if err := s.Run(bson.D{{"replSetGetStatus", 1}}, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+//secondaryTags returns the tag sets selecting the secondaries that can serve the read,
+//false if the read must go to the primary.
+//The replica set status is refreshed by a single caller outside the lock,
+//others use the last known status meanwhile.
+//If the status is unknown (e.g. standalone server) secondaries are assumed usable,
+//unavailability is then detected on the read itself.
+func (f *readFallback) secondaryTags(s *Session, tags []bson.D) ([]bson.D, bool) {
+	f.mu.Lock()
+	if !f.checking && time.Since(f.checkedAt) >= f.policy.StatusInterval {
+		f.checking = true
+		f.mu.Unlock()
+
+		members := fetchFallbackMembers(s)
+
+		f.mu.Lock()
+		f.checking = false
+		f.checkedAt = time.Now()
+		f.members = members
+	}
+	members := f.members
+	f.mu.Unlock()
+
+	if members == nil {
+		return tags, true
+	}
+
+	return f.policy.usable(members, tags)
+}
+
+//usable returns the tag sets selecting the fresh eligible secondaries, false if there is none.
+//The requested tags are kept if no eligible secondary is stale, otherwise they are narrowed
+//to the tags of the fresh secondaries that no stale one matches.
+func (p FallbackPolicy) usable(members []fallbackMember, tags []bson.D) ([]bson.D, bool) {
+	var fresh, stale []fallbackMember
+	for _, m := range members {
+		if !m.secondary || !m.healthy || !hasTags(m.tags, tags) {
+			continue
+		}
+
+		if p.MaxStaleness > 0 && m.lag > p.MaxStaleness {
+			stale = append(stale, m)
+			continue
+		}
+		fresh = append(fresh, m)
+	}
+
+	if len(fresh) == 0 {
+		return nil, false
+	}
+	if len(stale) == 0 {
+		return tags, true
+	}
+
+	var narrowed []bson.D
+NextFresh:
+	for _, m := range fresh {
+		//a member without tags can't be selected apart from the others
+		if len(m.tags) == 0 {
+			continue
+		}
+		for _, st := range stale {
+			if hasTags(st.tags, []bson.D{m.tags}) {
+				continue NextFresh
+			}
+		}
+		narrowed = append(narrowed, m.tags)
+	}
+
+	return narrowed, len(narrowed) > 0
+}
+
+//fetchFallbackMembers returns nil if the status can't be fetched.
+//Member tags come from replSetGetConfig, if it fails all secondaries are treated as matching.
+func fetchFallbackMembers(s *Session) []fallbackMember {
+	status, err := s.replSetStatus()
+	if err != nil {
+		return nil
+	}
+
+	var config replSetConfig
+	configured := s.Run(bson.D{{"replSetGetConfig", 1}}, &config) == nil
+
+	tags := map[string]bson.D{}
+	for _, m := range config.Config.Members {
+		tags[m.Host] = m.Tags
+	}
+
+	members := make([]fallbackMember, 0, len(status.Members))
+	for i := range status.Members {
+		m := &status.Members[i]
+		member := fallbackMember{
+			secondary: m.State == memberSecondary,
+			healthy:   m.Health == 1,
+			lag:       status.lag(m),
+		}
+		if configured {
+			member.tags = append(bson.D{}, tags[m.Name]...)
+		}
+		members = append(members, member)
+	}
+
+	return members
+}
+
+//hasTags reports whether member tags satisfy any of the tag sets the same way mgo selects servers.
+//Members with unknown tags (nil) match everything.
+func hasTags(member bson.D, sets []bson.D) bool {
+	if len(sets) == 0 || member == nil {
+		return true
+	}
+
+NextTagSet:
+	for _, set := range sets {
+	NextReqTag:
+		for _, req := range set {
+			for _, has := range member {
+				if req.Name == has.Name {
+					if req.Value == has.Value {
+						continue NextReqTag
+					}
+					continue NextTagSet
+				}
+			}
+			continue NextTagSet
+		}
+		return true
+	}
+
+	return false
+}
+
+func readsSecondaries(mode Mode) bool {
+	switch mode {
+	case Secondary, SecondaryPreferred, Nearest, Eventual, Monotonic:
+		return true
+	}
+
+	return false
+}
+
+func isNoReachableServers(err error) bool {
+	return err != nil && err.Error() == "no reachable servers"
+}
+
+func (s *Session) modeCopy(mode Mode, tags []bson.D) *Session {
+	sess := s.Copy()
+	sess.SetMode(mode, true)
+	if len(tags) > 0 {
+		sess.SelectServers(tags...)
+	}
+
+	return sess
+}
+
+//readSession runs f on a session copy in the requested read preference,
+//falling back to the primary if the policy allows.
+//The copy used by the last attempt is returned and must be closed by the caller.
+func (s *Session) readSession(pref *readPref, f func(s *Session) error) (*Session, error) {
+	canFallback := s.fallback != nil && readsSecondaries(pref.mode)
+
+	mode, tags := pref.mode, pref.tags
+	if canFallback {
+		var usable bool
+		if tags, usable = s.fallback.secondaryTags(s, pref.tags); !usable {
+			mode, tags = Primary, nil
+		}
+	}
+
+	sess := s.modeCopy(mode, tags)
+	err := f(sess)
+	if canFallback && mode != Primary && isNoReachableServers(err) {
+		sess.Close()
+		sess = s.modeCopy(Primary, nil)
+		err = f(sess)
+	}
+
+	return sess, err
+}
+
+//read runs f on the session itself or, if pref is set, on a session copy in that read preference
+func (s *Session) read(pref *readPref, f func(s *Session) error) error {
+	if pref == nil {
+		return f(s)
+	}
+
+	sess, err := s.readSession(pref, f)
+	sess.Close()
+
+	return err
+}
+
+//iter opens an iterator with the read preference within d, counting the retries in op,
+//the session copy is owned by the iterator and closed with it
+func (s *Session) iter(pref *readPref, d deadline, op *Operation, open func(s *Session) *mgo.Iter) *Iter {
+	i := &Iter{session: s}
+	openIter := func(sess *Session) error {
+		i.session = sess
+		return sess.execWithDeadline(d, countRetries(op, func() error {
+			i.originIter = open(sess)
+			return i.originIter.Err()
+		}))
+	}
+
+	if pref == nil {
+		openIter(s)
+		return i
+	}
+
+	i.session, _ = s.readSession(pref, openIter)
+	i.owned = true
+
+	return i
+}
@@ -0,0 +1,183 @@
+package mdb
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestReplSetStatusLag(t *testing.T) {
+	now := time.Now()
+	status := &replSetStatus{Members: []replSetMember{
+		{Name: "a", State: memberPrimary, OptimeDate: now},
+		{Name: "b", State: memberSecondary, OptimeDate: now.Add(-5 * time.Second)},
+		{Name: "c", State: memberSecondary, OptimeDate: now.Add(time.Second)},
+		{Name: "d", State: 8, OptimeDate: now.Add(-time.Hour)},
+	}}
+
+	tests := []struct {
+		member int
+		lag    time.Duration
+	}{
+		{0, 0},
+		{1, 5 * time.Second},
+		{2, 0},
+		{3, 0},
+	}
+
+	for _, test := range tests {
+		if lag := status.lag(&status.Members[test.member]); lag != test.lag {
+			t.Errorf("member %s: expected lag %s, got %s", status.Members[test.member].Name, test.lag, lag)
+		}
+	}
+
+	noPrimary := &replSetStatus{Members: status.Members[1:]}
+	if lag := noPrimary.lag(&noPrimary.Members[0]); lag != 0 {
+		t.Errorf("expected zero lag without primary, got %s", lag)
+	}
+}
+
+func TestReadsSecondaries(t *testing.T) {
+	for mode, expected := range map[Mode]bool{
+		Primary:            false,
+		PrimaryPreferred:   false,
+		Secondary:          true,
+		SecondaryPreferred: true,
+		Nearest:            true,
+		Eventual:           true,
+		Monotonic:          true,
+	} {
+		if readsSecondaries(mode) != expected {
+			t.Errorf("mode %d: expected %v", mode, expected)
+		}
+	}
+}
+
+func TestFallbackPolicyUsable(t *testing.T) {
+	east := bson.D{{"dc", "east"}}
+	west := bson.D{{"dc", "west"}}
+	members := []fallbackMember{
+		{secondary: false, healthy: true, tags: east},
+		{secondary: true, healthy: true, lag: time.Second, tags: east},
+		{secondary: true, healthy: true, lag: time.Minute, tags: west},
+		{secondary: true, healthy: false, tags: bson.D{{"dc", "north"}}},
+	}
+
+	tests := []struct {
+		name         string
+		maxStaleness time.Duration
+		tags         []bson.D
+		usable       bool
+		selected     []bson.D
+	}{
+		{"no staleness limit", 0, nil, true, nil},
+		{"lagging secondary excluded", 10 * time.Second, nil, true, []bson.D{east}},
+		{"tagged secondary fresh", 10 * time.Second, []bson.D{east}, true, []bson.D{east}},
+		{"tagged secondary lagging", 10 * time.Second, []bson.D{west}, false, nil},
+		{"any of tag sets", 2 * time.Minute, []bson.D{{{"dc", "south"}}, west}, true, []bson.D{{{"dc", "south"}}, west}},
+		{"only unhealthy matches", 0, []bson.D{{{"dc", "north"}}}, false, nil},
+		{"nothing matches", 0, []bson.D{{{"dc", "south"}}}, false, nil},
+	}
+
+	for _, test := range tests {
+		p := FallbackPolicy{MaxStaleness: test.maxStaleness}
+		selected, usable := p.usable(members, test.tags)
+		if usable != test.usable || !reflect.DeepEqual(selected, test.selected) {
+			t.Errorf("%s: expected %v %v, got %v %v", test.name, test.usable, test.selected, usable, selected)
+		}
+	}
+
+	//a stale member without tags can't be excluded
+	untagged := append(members, fallbackMember{secondary: true, healthy: true, lag: time.Hour})
+	if _, usable := (FallbackPolicy{MaxStaleness: 10 * time.Second}).usable(untagged, nil); usable {
+		t.Error("expected the primary when a stale member matches every tag set")
+	}
+
+	if !hasTags(nil, []bson.D{east}) {
+		t.Error("members with unknown tags must match")
+	}
+}
+
+func TestReadSessionFallback(t *testing.T) {
+	server := newFakeServer(t)
+
+	var mu sync.Mutex
+	statusCalls := 0
+	secondaryLag := time.Second
+	server.Handle(func(op *fakeOp) []bson.M {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		if _, ok := op.Query["replSetGetStatus"]; ok {
+			statusCalls++
+			return []bson.M{{"ok": 1, "members": []bson.M{
+				{"name": "a:1", "health": 1, "state": memberPrimary, "optimeDate": now},
+				{"name": "b:1", "health": 1, "state": memberSecondary, "optimeDate": now.Add(-secondaryLag)},
+			}}}
+		}
+		if _, ok := op.Query["replSetGetConfig"]; ok {
+			return []bson.M{{"ok": 1, "config": bson.M{"members": []bson.M{
+				{"host": "a:1"},
+				{"host": "b:1", "tags": bson.M{"dc": "east"}},
+			}}}}
+		}
+		return []bson.M{{"ok": 1}}
+	})
+
+	s := server.Dial(0)
+	ReadFallback(FallbackPolicy{MaxStaleness: 10 * time.Second, StatusInterval: time.Hour})(s)
+
+	mode := func(pref *readPref, err error) Mode {
+		attempt := 0
+		sess, _ := s.readSession(pref, func(s *Session) error {
+			attempt++
+			if attempt == 1 {
+				return err
+			}
+			return nil
+		})
+		defer sess.Close()
+
+		return sess.Mode()
+	}
+
+	if m := mode(&readPref{mode: Secondary}, nil); m != Secondary {
+		t.Fatalf("expected secondary, got %d", m)
+	}
+
+	mu.Lock()
+	secondaryLag = time.Minute
+	mu.Unlock()
+
+	if m := mode(&readPref{mode: Secondary}, nil); m != Secondary || statusCalls != 1 {
+		t.Fatalf("expected cached status and secondary, got %d after %d calls", m, statusCalls)
+	}
+
+	s.fallback.checkedAt = time.Time{}
+	if m := mode(&readPref{mode: SecondaryPreferred}, nil); m != Primary || statusCalls != 2 {
+		t.Fatalf("expected primary for lagging secondary, got %d after %d calls", m, statusCalls)
+	}
+
+	mu.Lock()
+	secondaryLag = time.Second
+	mu.Unlock()
+	s.fallback.checkedAt = time.Time{}
+
+	if m := mode(&readPref{mode: Secondary, tags: []bson.D{{{"dc", "west"}}}}, nil); m != Primary {
+		t.Fatalf("expected primary without matching secondaries, got %d", m)
+	}
+	if m := mode(&readPref{mode: Secondary, tags: []bson.D{{{"dc", "east"}}}}, nil); m != Secondary {
+		t.Fatalf("expected secondary matching tags, got %d", m)
+	}
+	if m := mode(&readPref{mode: Secondary}, errors.New("no reachable servers")); m != Primary {
+		t.Fatalf("expected primary after unreachable secondaries, got %d", m)
+	}
+	if m := mode(&readPref{mode: PrimaryPreferred}, errors.New("no reachable servers")); m != PrimaryPreferred {
+		t.Fatalf("primary preferred must not fall back, got %d", m)
+	}
+}
@@ -0,0 +1,207 @@
+package mdb
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	opReply = 1
+	opQuery = 2004
+)
+
+//fakeServer is a standalone mongod speaking the legacy OP_QUERY protocol,
+//enough for mgo to dial it and run commands and queries
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+
+	mu      sync.Mutex
+	conns   []net.Conn
+	handler func(op *fakeOp) []bson.M
+}
+
+type fakeOp struct {
+	Collection string
+	Flags      uint32
+	Skip       int32
+	Limit      int32
+	//Query is unwrapped from $query
+	Query bson.M
+	//Options is the whole document if the query was wrapped in $query
+	Options  bson.M
+	Selector bson.M
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{t: t, listener: l}
+	go s.accept()
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *fakeServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+//Handle sets the function answering queries other than isMaster and ping
+func (s *fakeServer) Handle(h func(op *fakeOp) []bson.M) {
+	s.mu.Lock()
+	s.handler = h
+	s.mu.Unlock()
+}
+
+func (s *fakeServer) Close() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+//Dial returns a session to the server with short timeouts
+func (s *fakeServer) Dial(maxRetries int) *Session {
+	sess, err := mgo.DialWithTimeout(s.Addr(), time.Second)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	sess.SetSyncTimeout(200 * time.Millisecond)
+	sess.SetSocketTimeout(time.Second)
+	s.t.Cleanup(sess.Close)
+
+	return Wrap(sess, maxRetries, time.Millisecond)
+}
+
+func (s *fakeServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		go s.serve(conn)
+	}
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		body := make([]byte, int(binary.LittleEndian.Uint32(header))-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		if binary.LittleEndian.Uint32(header[12:]) != opQuery {
+			continue
+		}
+
+		requestID := binary.LittleEndian.Uint32(header[4:])
+		if err := s.reply(conn, requestID, s.answer(body)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) answer(body []byte) []bson.M {
+	op := &fakeOp{Flags: binary.LittleEndian.Uint32(body)}
+	body = body[4:]
+	end := strings.IndexByte(string(body), 0)
+	op.Collection = string(body[:end])
+	body = body[end+1:]
+	op.Skip = int32(binary.LittleEndian.Uint32(body))
+	op.Limit = int32(binary.LittleEndian.Uint32(body[4:]))
+	body = body[8:]
+
+	n := binary.LittleEndian.Uint32(body)
+	if err := bson.Unmarshal(body[:n], &op.Query); err != nil {
+		s.t.Error(err)
+		return []bson.M{{"ok": 0, "errmsg": err.Error()}}
+	}
+	if len(body) > int(n) {
+		if err := bson.Unmarshal(body[n:], &op.Selector); err != nil {
+			s.t.Error(err)
+		}
+	}
+	if q, ok := op.Query["$query"].(bson.M); ok {
+		op.Options = op.Query
+		op.Query = q
+	}
+
+	collection, query := op.Collection, op.Query
+
+	if strings.HasSuffix(collection, ".$cmd") {
+		for _, name := range []string{"ismaster", "isMaster"} {
+			if _, ok := query[name]; ok {
+				return []bson.M{{"ok": 1, "ismaster": true, "maxWireVersion": 1, "me": s.Addr()}}
+			}
+		}
+
+		if _, ok := query["getnonce"]; ok {
+			return []bson.M{{"ok": 1, "nonce": "2375531c32080ae8"}}
+		}
+
+		if _, ok := query["ping"]; ok {
+			return []bson.M{{"ok": 1}}
+		}
+
+		if _, ok := query["getlasterror"]; ok {
+			return []bson.M{{"ok": 1, "n": 0}}
+		}
+	}
+
+	s.mu.Lock()
+	h := s.handler
+	s.mu.Unlock()
+
+	if h != nil {
+		return h(op)
+	}
+
+	return []bson.M{{"ok": 1}}
+}
+
+func (s *fakeServer) reply(conn net.Conn, responseTo uint32, docs []bson.M) error {
+	msg := make([]byte, 36)
+	binary.LittleEndian.PutUint32(msg[8:], responseTo)
+	binary.LittleEndian.PutUint32(msg[12:], opReply)
+	binary.LittleEndian.PutUint32(msg[32:], uint32(len(docs)))
+
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		msg = append(msg, data...)
+	}
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+
+	_, err := conn.Write(msg)
+	return err
+}
@@ -1,9 +1,11 @@
 package mdb
 
 import (
+	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -16,6 +18,13 @@ type Session struct {
 	RetryInterval     time.Duration
 	originSession     *mgo.Session
 	refreshing        int32
+	fallback          *readFallback
+	monitorMu         sync.Mutex
+	monitor           *Monitor
+	failures          *failureLog
+	cache             *queryCache
+	flights           *flightGroup
+	middleware        []Middleware
 }
 
 //Origin returns origin mgo session
@@ -162,7 +171,11 @@ func (s *Session) FsyncUnlock() error {
 }
 
 func (s *Session) FindRef(ref *mgo.DBRef) *Query {
-	return &Query{originQuery: s.originSession.FindRef(ref), session: s}
+	if ref.Database == "" {
+		panic(fmt.Errorf("Can't resolve database for %#v", ref))
+	}
+
+	return s.DB(ref.Database).C(ref.Collection).FindId(ref.Id)
 }
 
 func (s *Session) DatabaseNames() ([]string, error) {
@@ -193,26 +206,56 @@ func (s *Session) with(session *mgo.Session) *Session {
 		MaxConnectRetries: s.MaxConnectRetries,
 		RetryInterval:     s.RetryInterval,
 		refreshing:        0,
+		fallback:          s.fallback,
+		monitor:           s.Monitor(),
+		failures:          s.failures,
+		cache:             s.cache,
+		flights:           s.flights,
+		middleware:        s.middleware,
 	}
 }
 
 func (s *Session) execWithRetry(f func() error) error {
+	return s.execWithDeadline(deadline{}, f)
+}
+
+//execWithDeadline is execWithRetry starting no retry once d is exhausted
+func (s *Session) execWithDeadline(d deadline, f func() error) error {
 	err := f()
 
 	if isNetworkError(err) {
+		failure := err
 		for i := 0; i < s.MaxConnectRetries; i++ {
+			if d.expired() {
+				return s.checkDeadline(d, failure)
+			}
+
 			lastErr := f()
 
 			if isNetworkError(lastErr) {
+				failure = lastErr
 				if ok := s.refresh(); !ok {
-					time.Sleep(s.RetryInterval)
+					d.sleep(s.RetryInterval)
 				}
 
 				continue
 			}
 
-			return lastErr
+			return s.checkDeadline(d, lastErr)
 		}
+
+		s.failures.add(RetryFailure, failure)
+		return d.check(err)
+	}
+
+	return s.checkDeadline(d, err)
+}
+
+//checkDeadline returns d.check(err), recording the timeouts
+func (s *Session) checkDeadline(d deadline, err error) error {
+	err = d.check(err)
+	if _, ok := err.(*TimeoutError); ok {
+		s.failures.add(TimeoutFailure, err)
 	}
 
 	return err
@@ -225,6 +268,7 @@ func (s *Session) refresh() bool {
 
 	s.originSession.Refresh()
 	if err := s.Ping(); err != nil {
+		s.failures.add(RefreshFailure, err)
 		return false
 	}
 
@@ -0,0 +1,265 @@
+package mdb
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	DefaultSlowThreshold   = 100 * time.Millisecond
+	DefaultSlowLogInterval = time.Minute
+	//slowLogShapes bounds the shapes remembered for rate limiting
+	slowLogShapes = 1024
+)
+
+type SlowLogOptions struct {
+	//Threshold is the duration from which an operation is logged, DefaultSlowThreshold if zero
+	Threshold time.Duration
+	//Interval is the minimum time between two records of the same query shape,
+	//DefaultSlowLogInterval if zero. The skipped operations are counted in the next record.
+	Interval time.Duration
+	//Explain adds the explain output of slow finds, counts and distincts
+	Explain bool
+	//Level is the level of the records, slog.LevelInfo by default
+	Level slog.Level
+}
+
+//SlowLog logs the operations slower than the threshold to logger.
+//The duration includes the retries, for iterators it is the time to open the cursor.
+func SlowLog(logger *slog.Logger, opts SlowLogOptions) func(session *Session) {
+	if opts.Threshold == 0 {
+		opts.Threshold = DefaultSlowThreshold
+	}
+	if opts.Interval == 0 {
+		opts.Interval = DefaultSlowLogInterval
+	}
+
+	l := &slowLog{logger: logger, opts: opts, shapes: map[string]*shapeRecord{}}
+	return Use(l.middleware)
+}
+
+type slowLog struct {
+	logger *slog.Logger
+	opts   SlowLogOptions
+	mu     sync.Mutex
+	shapes map[string]*shapeRecord
+}
+
+type shapeRecord struct {
+	logged     time.Time
+	suppressed int
+}
+
+func (l *slowLog) middleware(next Handler) Handler {
+	return func(op *Operation) error {
+		start := time.Now()
+		err := next(op)
+		elapsed := time.Since(start)
+		if elapsed < l.opts.Threshold {
+			return err
+		}
+
+		filter := op.Filter
+		if op.Kind == OpAggregate {
+			filter = op.Options["pipeline"]
+		}
+		shape := QueryShape(filter)
+		sortFields, _ := op.Options["sort"].([]string)
+
+		suppressed, ok := l.allow(string(op.Kind)+" "+op.DB+"."+op.Collection+" "+shape+" "+strings.Join(sortFields, ","), start)
+		if !ok {
+			return err
+		}
+
+		attrs := []slog.Attr{
+			slog.String("op", string(op.Kind)),
+			slog.String("ns", op.DB+"."+op.Collection),
+			slog.Duration("duration", elapsed),
+			slog.String("shape", shape),
+			slog.Int("retries", op.Retries),
+		}
+		if len(sortFields) > 0 {
+			attrs = append(attrs, slog.String("sort", strings.Join(sortFields, ",")))
+		}
+		if selector := op.Options["selector"]; selector != nil {
+			attrs = append(attrs, slog.String("projection", formatShape(genericBson(selector), false)))
+		}
+		if suppressed > 0 {
+			attrs = append(attrs, slog.Int("suppressed", suppressed))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		if l.opts.Explain && explainable(op) {
+			attrs = append(attrs, l.explain(op, sortFields))
+		}
+
+		ctx := op.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		l.logger.LogAttrs(ctx, l.opts.Level, "mdb: slow operation", attrs...)
+
+		return err
+	}
+}
+
+//allow reports if the shape can be logged at now and how many records of it were skipped since the last one
+func (l *slowLog) allow(key string, now time.Time) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record, ok := l.shapes[key]
+	if ok && now.Sub(record.logged) < l.opts.Interval {
+		record.suppressed++
+		return 0, false
+	}
+
+	if !ok {
+		if len(l.shapes) >= slowLogShapes {
+			for k, r := range l.shapes {
+				if now.Sub(r.logged) >= l.opts.Interval {
+					delete(l.shapes, k)
+				}
+			}
+		}
+		record = &shapeRecord{}
+		l.shapes[key] = record
+	}
+
+	suppressed := record.suppressed
+	record.logged, record.suppressed = now, 0
+
+	return suppressed, true
+}
+
+func explainable(op *Operation) bool {
+	return op.collection != nil && (op.Kind == OpFind || op.Kind == OpCount || op.Kind == OpDistinct)
+}
+
+//explain explains the query of op, bypassing the middleware
+func (l *slowLog) explain(op *Operation, sortFields []string) slog.Attr {
+	var result bson.M
+	err := op.collection.session.execWithRetry(func() error {
+		query := op.collection.originCollection.Find(op.Filter)
+		if len(sortFields) > 0 {
+			query = query.Sort(sortFields...)
+		}
+		return query.Explain(&result)
+	})
+	if err != nil {
+		return slog.String("explainError", err.Error())
+	}
+
+	return slog.Any("explain", result)
+}
+
+//QueryShape returns the filter or pipeline with the values replaced by ?,
+//so queries differing only by their values have the same shape
+func QueryShape(query interface{}) string {
+	if query == nil {
+		return "{}"
+	}
+
+	return formatShape(genericBson(query), true)
+}
+
+//genericBson converts v to bson.M, []interface{} and plain values
+func genericBson(v interface{}) interface{} {
+	data, err := bson.Marshal(bson.M{"v": v})
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+
+	var m bson.M
+	if err := bson.Unmarshal(data, &m); err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return m["v"]
+}
+
+//formatShape formats v with sorted keys, replacing the values by ? if placeholders is set.
+//Embedded documents without operators and lists of values are a single ?.
+func formatShape(v interface{}, placeholders bool) string {
+	var b strings.Builder
+	writeShape(&b, v, placeholders, true)
+	return b.String()
+}
+
+func writeShape(b *strings.Builder, v interface{}, placeholders, expand bool) {
+	switch v := v.(type) {
+	case bson.M:
+		if !expand && placeholders && !hasOperator(v) {
+			b.WriteString("?")
+			return
+		}
+
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b.WriteString("{")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(k + ": ")
+			//the values of operators like $elemMatch or $group are shaped too
+			writeShape(b, v[k], placeholders, strings.HasPrefix(k, "$"))
+		}
+		b.WriteString("}")
+
+	case []interface{}:
+		//only lists of documents, like the conditions of $or or the pipeline stages, are expanded
+		if placeholders && (!expand || !allDocuments(v)) {
+			b.WriteString("?")
+			return
+		}
+
+		b.WriteString("[")
+		for i, e := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeShape(b, e, placeholders, true)
+		}
+		b.WriteString("]")
+
+	default:
+		if placeholders {
+			b.WriteString("?")
+			return
+		}
+		fmt.Fprint(b, v)
+	}
+}
+
+func allDocuments(values []interface{}) bool {
+	for _, v := range values {
+		if _, ok := v.(bson.M); !ok {
+			return false
+		}
+	}
+
+	return len(values) > 0
+}
+
+func hasOperator(doc bson.M) bool {
+	for k := range doc {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package mdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestQueryShape(t *testing.T) {
+	tests := []struct {
+		query interface{}
+		shape string
+	}{
+		{nil, "{}"},
+		{bson.M{"name": "Ale", "age": bson.M{"$gt": 30}}, "{age: {$gt: ?}, name: ?}"},
+		{bson.D{{"tags", bson.M{"$in": []string{"a", "b", "c"}}}}, "{tags: {$in: ?}}"},
+		{bson.M{"$or": []interface{}{bson.M{"a": 1}, bson.M{"b": bson.M{"x": 1}}}}, "{$or: [{a: ?}, {b: ?}]}"},
+		{[]bson.M{{"$match": bson.M{"a": 1}}, {"$group": bson.M{"_id": "$a", "n": bson.M{"$sum": 1}}}}, "[{$match: {a: ?}}, {$group: {_id: ?, n: {$sum: ?}}}]"},
+	}
+
+	for _, test := range tests {
+		if shape := QueryShape(test.query); shape != test.shape {
+			t.Errorf("expected %s, got %s", test.shape, shape)
+		}
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	server := newFakeServer(t)
+	server.Handle(func(op *fakeOp) []bson.M {
+		if _, ok := op.Options["$explain"]; ok {
+			return []bson.M{{"queryPlanner": bson.M{"winningPlan": bson.M{"stage": "COLLSCAN"}}}}
+		}
+		return []bson.M{{"_id": 1}}
+	})
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	session := server.Dial(0)
+	SlowLog(logger, SlowLogOptions{Threshold: time.Nanosecond, Interval: time.Hour, Explain: true})(session)
+	c := session.DB("test").C("people")
+
+	var doc bson.M
+	for _, age := range []int{20, 30, 40} {
+		if err := c.Find(bson.M{"age": bson.M{"$gt": age}}).Sort("-age").Select(bson.M{"name": 1}).One(&doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Find(bson.M{"name": "Ale"}).Count(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []map[string]interface{}
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var record map[string]interface{}
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected a record per shape, got %v", records)
+	}
+	first := records[0]
+	if first["op"] != "find" || first["ns"] != "test.people" || first["shape"] != "{age: {$gt: ?}}" ||
+		first["sort"] != "-age" || first["projection"] != "{name: 1}" || first["retries"] != float64(0) {
+		t.Fatalf("unexpected record %v", first)
+	}
+	if explain, ok := first["explain"].(map[string]interface{}); !ok || explain["queryPlanner"] == nil {
+		t.Fatalf("expected the explain output, got %v", first)
+	}
+	if records[1]["op"] != "count" || records[1]["shape"] != "{name: ?}" {
+		t.Fatalf("unexpected record %v", records[1])
+	}
+}
@@ -0,0 +1,117 @@
+package mdb
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const DefaultDeletedField = "deletedAt"
+
+type deletedScope int
+
+const (
+	excludeDeleted deletedScope = iota
+	includeDeleted
+	onlyDeleted
+)
+
+//WithSoftDelete returns the collection marking removed documents with the removal time in field,
+//DefaultDeletedField if empty, instead of removing them.
+//Find, FindId, Count, Pipe and Query.Apply skip the marked documents.
+func (c *Collection) WithSoftDelete(field string) *Collection {
+	if field == "" {
+		field = DefaultDeletedField
+	}
+
+	nc := c.clone()
+	nc.deletedField = field
+	return nc
+}
+
+//WithDeleted returns the soft delete collection reading the removed documents too
+func (c *Collection) WithDeleted() *Collection {
+	nc := c.clone()
+	nc.deletedScope = includeDeleted
+	return nc
+}
+
+//OnlyDeleted returns the soft delete collection reading only the removed documents
+func (c *Collection) OnlyDeleted() *Collection {
+	nc := c.clone()
+	nc.deletedScope = onlyDeleted
+	return nc
+}
+
+//Restore unmarks the removed documents matching selector
+func (c *Collection) Restore(selector interface{}) (*mgo.ChangeInfo, error) {
+	if c.deletedField == "" {
+		return &mgo.ChangeInfo{}, nil
+	}
+
+	return c.UpdateAll(c.deletedFilter(selector, onlyDeleted), bson.M{"$unset": bson.M{c.deletedField: ""}})
+}
+
+//Purge removes the documents matching selector for good, whether they are marked as removed or not
+func (c *Collection) Purge(selector interface{}) (*mgo.ChangeInfo, error) {
+	nc := c.clone()
+	nc.deletedField = ""
+	return nc.RemoveAll(selector)
+}
+
+func (c *Collection) softDelete() bool {
+	return c.deletedField != ""
+}
+
+//scoped restricts filter to the documents the collection reads
+func (c *Collection) scoped(filter interface{}) interface{} {
+	return c.deletedFilter(filter, c.deletedScope)
+}
+
+func (c *Collection) deletedFilter(filter interface{}, scope deletedScope) interface{} {
+	if !c.softDelete() || scope == includeDeleted {
+		return filter
+	}
+
+	condition := bson.M{"$exists": scope == onlyDeleted}
+	if filter == nil {
+		return bson.M{c.deletedField: condition}
+	}
+	switch f := filter.(type) {
+	case bson.M:
+		if _, ok := f[c.deletedField]; !ok {
+			scoped := make(bson.M, len(f)+1)
+			for k, v := range f {
+				scoped[k] = v
+			}
+			scoped[c.deletedField] = condition
+			return scoped
+		}
+	case bson.D:
+		if _, ok := f.Map()[c.deletedField]; !ok {
+			return append(append(bson.D{}, f...), bson.DocElem{Name: c.deletedField, Value: condition})
+		}
+	}
+
+	return bson.M{"$and": []interface{}{filter, bson.M{c.deletedField: condition}}}
+}
+
+//scopedPipeline prepends a $match of the documents the collection reads
+func (c *Collection) scopedPipeline(pipeline interface{}) interface{} {
+	if !c.softDelete() || c.deletedScope == includeDeleted {
+		return pipeline
+	}
+
+	stages, err := pipelineStages(pipeline)
+	if err != nil {
+		//left for the server to reject
+		return pipeline
+	}
+
+	return append([]interface{}{bson.M{"$match": c.scoped(nil)}}, stages...)
+}
+
+func (c *Collection) markDeleted() bson.M {
+	return bson.M{"$set": bson.M{c.deletedField: time.Now()}}
+}
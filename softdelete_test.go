@@ -0,0 +1,105 @@
+package mdb
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestSoftDeleteScopes(t *testing.T) {
+	server := newFakeServer(t)
+
+	var (
+		mu  sync.Mutex
+		ops []*fakeOp
+	)
+	server.Handle(func(op *fakeOp) []bson.M {
+		mu.Lock()
+		ops = append(ops, op)
+		mu.Unlock()
+		if _, ok := op.Query["count"]; ok {
+			return []bson.M{{"ok": 1, "n": 0}}
+		}
+		if _, ok := op.Query["aggregate"]; ok {
+			return []bson.M{{"ok": 1, "result": []interface{}{}}}
+		}
+		return []bson.M{{"_id": 1}}
+	})
+
+	c := server.Dial(0).DB("test").C("people").WithSoftDelete("")
+	last := func() *fakeOp {
+		mu.Lock()
+		defer mu.Unlock()
+		return ops[len(ops)-1]
+	}
+	exists := func(filter bson.M) interface{} {
+		condition, ok := filter[DefaultDeletedField].(bson.M)
+		if !ok {
+			return nil
+		}
+		return condition["$exists"]
+	}
+
+	var doc bson.M
+	if err := c.Find(bson.M{"name": "Ale"}).One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if q := last().Query; q["name"] != "Ale" || exists(q) != false {
+		t.Fatalf("expected removed documents to be skipped, got %v", q)
+	}
+
+	if err := c.OnlyDeleted().FindId(1).One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if q := last().Query; exists(q) != true {
+		t.Fatalf("expected only removed documents, got %v", q)
+	}
+
+	if err := c.WithDeleted().Find(nil).One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if q := last().Query; exists(q) != nil {
+		t.Fatalf("expected every document, got %v", q)
+	}
+
+	if _, err := c.Count(); err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := last().Query["query"].(bson.M); exists(q) != false {
+		t.Fatalf("expected the count to skip removed documents, got %v", last().Query)
+	}
+
+	if err := c.Pipe([]bson.M{{"$sort": bson.M{"name": 1}}}).All(&[]bson.M{}); err != nil {
+		t.Fatal(err)
+	}
+	pipeline, _ := last().Query["pipeline"].([]interface{})
+	if len(pipeline) != 2 {
+		t.Fatalf("expected a leading $match, got %v", last().Query)
+	}
+	if match, _ := pipeline[0].(bson.M)["$match"].(bson.M); exists(match) != false {
+		t.Fatalf("expected the $match to skip removed documents, got %v", pipeline[0])
+	}
+}
+
+func TestSoftDeleteFilter(t *testing.T) {
+	c := (&Collection{}).WithSoftDelete("removed")
+
+	filter := bson.M{"name": "Ale"}
+	scoped := c.scoped(filter).(bson.M)
+	if len(filter) != 1 || scoped["name"] != "Ale" || scoped["removed"] == nil {
+		t.Fatalf("expected a scoped copy of the filter, got %v %v", filter, scoped)
+	}
+
+	if d := c.scoped(bson.D{{"name", "Ale"}}).(bson.D); len(d) != 2 || d[1].Name != "removed" {
+		t.Fatalf("expected the condition appended to the filter, got %v", d)
+	}
+
+	if and, ok := c.scoped(bson.M{"removed": nil}).(bson.M)["$and"]; !ok || len(and.([]interface{})) != 2 {
+		t.Fatalf("expected filters on the field to be combined with $and, got %v", and)
+	}
+
+	if f := c.WithDeleted().scoped(filter); f.(bson.M)["removed"] != nil {
+		t.Fatalf("expected WithDeleted to keep the filter, got %v", f)
+	}
+}
@@ -0,0 +1,213 @@
+package mdb
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+//tagOptions are the comma separated options of an `mdb` struct tag,
+//e.g. `mdb:"index=byName,desc"` gives {"index": "byName", "desc": ""}
+type tagOptions map[string]string
+
+func parseTag(tag string) tagOptions {
+	options := tagOptions{}
+	for _, option := range strings.Split(tag, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+
+		name, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			name, value = option[:i], option[i+1:]
+		}
+		options[name] = value
+	}
+
+	return options
+}
+
+func (o tagOptions) has(name string) bool {
+	_, ok := o[name]
+	return ok
+}
+
+//taggedField is a struct field with an `mdb` tag and its bson path
+type taggedField struct {
+	path    string
+	index   []int
+	options tagOptions
+}
+
+//taggedFields walks the struct type, descending into inline and nested structs
+//and into the elements of slices and arrays of structs, whose fields share the path of the slice
+func taggedFields(t reflect.Type, prefix string, index []int) []taggedField {
+	return walkTaggedFields(t, prefix, index, map[reflect.Type]bool{})
+}
+
+//walkTaggedFields stops at the types already being walked, so recursive models like
+//a category with a parent category end
+func walkTaggedFields(t reflect.Type, prefix string, index []int, walking map[reflect.Type]bool) []taggedField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || walking[t] {
+		return nil
+	}
+	walking[t] = true
+	defer delete(walking, t)
+
+	var fields []taggedField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		name, inline, skip := bsonFieldName(f)
+		if skip {
+			continue
+		}
+
+		fieldIndex := append(append([]int(nil), index...), i)
+		path := prefix + name
+		if tag, ok := f.Tag.Lookup("mdb"); ok {
+			fields = append(fields, taggedField{path: path, index: fieldIndex, options: parseTag(tag)})
+		}
+
+		ft := elemType(f.Type)
+		if ft.Kind() != reflect.Struct || ft == reflect.TypeOf(time.Time{}) {
+			continue
+		}
+
+		if inline {
+			fields = append(fields, walkTaggedFields(ft, prefix, fieldIndex, walking)...)
+		} else {
+			fields = append(fields, walkTaggedFields(ft, path+".", fieldIndex, walking)...)
+		}
+	}
+
+	return fields
+}
+
+//elemType dereferences pointers and slice or array elements, except of []byte
+func elemType(t reflect.Type) reflect.Type {
+	for {
+		switch {
+		case t.Kind() == reflect.Ptr:
+			t = t.Elem()
+		case (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && t.Elem().Kind() != reflect.Uint8:
+			t = t.Elem()
+		default:
+			return t
+		}
+	}
+}
+
+//bsonFieldName follows the mgo/bson naming rules
+func bsonFieldName(f reflect.StructField) (name string, inline bool, skip bool) {
+	tag := f.Tag.Get("bson")
+	if tag == "-" {
+		return "", false, true
+	}
+
+	parts := strings.Split(tag, ",")
+	for _, flag := range parts[1:] {
+		if flag == "inline" {
+			inline = true
+		}
+	}
+
+	if parts[0] != "" {
+		return parts[0], inline, false
+	}
+
+	return strings.ToLower(f.Name), inline, false
+}
+
+//IndexesOf returns the indexes declared with `mdb` tags on the model struct:
+//
+//	index        single field index
+//	unique       unique index
+//	ttl=3600     TTL index expiring after the number of seconds
+//	text         field of the collection text index
+//	index=name   field of the compound index name, in field order
+//	unique=name  field of the compound unique index name
+//	desc         descending order
+//	sparse       sparse index
+func IndexesOf(model interface{}) ([]mgo.Index, error) {
+	var indexes []mgo.Index
+	compound := map[string]int{}
+	text := -1
+
+	for _, field := range taggedFields(reflect.TypeOf(model), "", nil) {
+		o := field.options
+		key := field.path
+		if o.has("desc") {
+			key = "-" + key
+		}
+
+		if o.has("text") {
+			if text < 0 {
+				text = len(indexes)
+				indexes = append(indexes, mgo.Index{})
+			}
+			indexes[text].Key = append(indexes[text].Key, "$text:"+field.path)
+		}
+
+		if !o.has("index") && !o.has("unique") && !o.has("ttl") {
+			continue
+		}
+
+		index := mgo.Index{Key: []string{key}, Unique: o.has("unique"), Sparse: o.has("sparse")}
+		if ttl, ok := o["ttl"]; ok {
+			seconds, err := strconv.Atoi(ttl)
+			if err != nil || seconds <= 0 {
+				return nil, fmt.Errorf("mdb: invalid ttl %q on %s", ttl, field.path)
+			}
+			index.ExpireAfter = time.Duration(seconds) * time.Second
+		}
+
+		group := o["index"]
+		if group == "" {
+			group = o["unique"]
+		}
+		if group == "" {
+			indexes = append(indexes, index)
+			continue
+		}
+
+		if index.ExpireAfter > 0 {
+			return nil, fmt.Errorf("mdb: ttl index on %s can't be compound", field.path)
+		}
+
+		i, ok := compound[group]
+		if !ok {
+			compound[group] = len(indexes)
+			indexes = append(indexes, index)
+			continue
+		}
+
+		indexes[i].Key = append(indexes[i].Key, key)
+		indexes[i].Unique = indexes[i].Unique || index.Unique
+		indexes[i].Sparse = indexes[i].Sparse || index.Sparse
+	}
+
+	return indexes, nil
+}
+
+//EnsureModelIndexes creates the indexes declared on the model with EnsureIndex.
+//Existing indexes not declared on the model are reported in IndexReport.Drop, but not dropped.
+func (c *Collection) EnsureModelIndexes(model interface{}) (*IndexReport, error) {
+	indexes, err := IndexesOf(model)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.SyncIndexes(indexes, SyncOptions{})
+}
@@ -0,0 +1,82 @@
+package mdb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+type taggedAddress struct {
+	City string `bson:"city" mdb:"index"`
+}
+
+type taggedBase struct {
+	CreatedAt time.Time `bson:"createdAt" mdb:"ttl=3600"`
+}
+
+type taggedPerson struct {
+	taggedBase `bson:",inline"`
+	Email      string         `bson:"email" mdb:"unique"`
+	First      string         `bson:"first" mdb:"index=name"`
+	Last       string         `mdb:"index=name,desc"`
+	Tenant     string         `bson:"tenant" mdb:"unique=tenantCode"`
+	Code       string         `bson:"code" mdb:"index=tenantCode,sparse"`
+	Bio        string         `bson:"bio" mdb:"text"`
+	Title      string         `bson:"title" mdb:"text"`
+	Address    *taggedAddress `bson:"address"`
+	Ignored    string         `bson:"-" mdb:"index"`
+	Plain      string
+}
+
+func TestIndexesOf(t *testing.T) {
+	indexes, err := IndexesOf(&taggedPerson{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []mgo.Index{
+		{Key: []string{"createdAt"}, ExpireAfter: time.Hour},
+		{Key: []string{"email"}, Unique: true},
+		{Key: []string{"first", "-last"}},
+		{Key: []string{"tenant", "code"}, Unique: true, Sparse: true},
+		{Key: []string{"$text:bio", "$text:title"}},
+		{Key: []string{"address.city"}},
+	}
+
+	if !reflect.DeepEqual(indexes, expected) {
+		t.Fatalf("unexpected indexes:\n%+v\n%+v", indexes, expected)
+	}
+}
+
+func TestIndexesOfInvalid(t *testing.T) {
+	if _, err := IndexesOf(struct {
+		At time.Time `mdb:"ttl=soon"`
+	}{}); err == nil {
+		t.Error("expected invalid ttl error")
+	}
+
+	if _, err := IndexesOf(struct {
+		At time.Time `mdb:"index=g,ttl=60"`
+	}{}); err == nil {
+		t.Error("expected compound ttl error")
+	}
+}
+
+type taggedCategory struct {
+	Name   string          `bson:"name" mdb:"unique"`
+	Parent *taggedCategory `bson:"parent"`
+}
+
+func TestIndexesOfRecursiveModel(t *testing.T) {
+	indexes, err := IndexesOf(taggedCategory{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []mgo.Index{{Key: []string{"name"}, Unique: true}}
+	if !reflect.DeepEqual(indexes, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, indexes)
+	}
+}
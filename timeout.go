@@ -0,0 +1,150 @@
+package mdb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+//maxTimeExceeded is the server error code of an operation interrupted by maxTimeMS
+const maxTimeExceeded = 50
+
+var ErrTimeout = errors.New("mdb: operation timed out")
+
+//TimeoutError is returned when the budget set with Query.Timeout or Collection.WithTimeout is exhausted,
+//it matches ErrTimeout with errors.Is and unwraps to the error of the last attempt
+type TimeoutError struct {
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	msg := "mdb: operation timed out after " + e.Timeout.String()
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+//WithTimeout returns the collection bounding each operation to d, retries included.
+//Queries, pipelines and Query.Apply send the time left as maxTimeMS, see Query.Timeout.
+//Other writes can't be bounded on the server, every attempt has the time left as socket timeout
+//and their retries stop when d is exhausted. Operations timing out are recorded in RecentFailures.
+func (c *Collection) WithTimeout(d time.Duration) *Collection {
+	nc := c.clone()
+	nc.timeout = d
+	return nc
+}
+
+//Timeout bounds the query to d, retries included. Every attempt sets maxTimeMS to the time left,
+//lower than SetMaxTime if set, and the socket timeout to the time left, and no retry starts once d is exhausted.
+//The error is a *TimeoutError then. Tail ignores the timeout.
+func (q *Query) Timeout(d time.Duration) *Query {
+	q.timeout = d
+	return q
+}
+
+//Timeout bounds the pipeline to d, retries included, see Query.Timeout
+func (p *Pipe) Timeout(d time.Duration) *Pipe {
+	np := *p
+	np.timeout = d
+	return &np
+}
+
+//deadline is the budget of an operation, the zero value is unbounded
+type deadline struct {
+	timeout time.Duration
+	at      time.Time
+}
+
+func newDeadline(timeout time.Duration) deadline {
+	if timeout <= 0 {
+		return deadline{}
+	}
+
+	return deadline{timeout: timeout, at: time.Now().Add(timeout)}
+}
+
+func (d deadline) set() bool {
+	return d.timeout > 0
+}
+
+func (d deadline) remaining() time.Duration {
+	return time.Until(d.at)
+}
+
+func (d deadline) expired() bool {
+	return d.set() && d.remaining() <= 0
+}
+
+//maxTime returns the maxTimeMS of an attempt, the time left or max if lower
+func (d deadline) maxTime(max time.Duration) time.Duration {
+	left := d.remaining()
+	//maxTimeMS has a millisecond resolution and 0 disables it
+	if left < time.Millisecond {
+		left = time.Millisecond
+	}
+	if max > 0 && max < left {
+		return max
+	}
+
+	return left
+}
+
+//sleep sleeps for d or until the deadline
+func (d deadline) sleep(interval time.Duration) {
+	if d.set() && d.remaining() < interval {
+		interval = d.remaining()
+	}
+	if interval > 0 {
+		time.Sleep(interval)
+	}
+}
+
+//check returns err as a TimeoutError if the budget is exhausted or the server interrupted the operation
+func (d deadline) check(err error) error {
+	if err == nil || !d.set() {
+		return err
+	}
+
+	if d.expired() || isMaxTimeExceeded(err) {
+		return &TimeoutError{Timeout: d.timeout, Err: err}
+	}
+
+	return err
+}
+
+func isMaxTimeExceeded(err error) bool {
+	var queryErr *mgo.QueryError
+	if errors.As(err, &queryErr) {
+		return queryErr.Code == maxTimeExceeded
+	}
+
+	var lastErr *mgo.LastError
+	return errors.As(err, &lastErr) && lastErr.Code == maxTimeExceeded
+}
+
+//attempt runs f on a copy of s with the time left of d as socket timeout, bounding the attempt
+//on the client too, or on s itself if d is unbounded
+func (s *Session) attempt(d deadline, f func(s *Session) error) error {
+	if !d.set() {
+		return f(s)
+	}
+
+	sess := s.Copy()
+	defer sess.Close()
+	//a socket timeout of 0 disables it like maxTimeMS
+	sess.SetSocketTimeout(d.maxTime(0))
+
+	return f(sess)
+}
@@ -0,0 +1,145 @@
+package mdb
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestExecWithDeadline(t *testing.T) {
+	server := newFakeServer(t)
+	s := server.Dial(10)
+	s.RetryInterval = 20 * time.Millisecond
+
+	calls := 0
+	start := time.Now()
+	err := s.execWithDeadline(newDeadline(50*time.Millisecond), func() error {
+		calls++
+		time.Sleep(15 * time.Millisecond)
+		return io.EOF
+	})
+
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, ErrTimeout) || !errors.Is(err, io.EOF) {
+		t.Fatalf("expected a timeout wrapping EOF, got %v", err)
+	}
+	if calls > 5 || time.Since(start) > 200*time.Millisecond {
+		t.Fatalf("expected the retries to stop at the deadline, got %d calls in %v", calls, time.Since(start))
+	}
+
+	if err := s.execWithDeadline(newDeadline(time.Second), func() error { return mgo.ErrNotFound }); err != mgo.ErrNotFound {
+		t.Fatalf("expected errors within the budget unchanged, got %v", err)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	server := newFakeServer(t)
+
+	var (
+		mu        sync.Mutex
+		maxTimeMS interface{}
+	)
+	server.Handle(func(op *fakeOp) []bson.M {
+		if _, ok := op.Query["count"]; ok {
+			return []bson.M{{"ok": 0, "code": 50, "errmsg": "operation exceeded time limit"}}
+		}
+		mu.Lock()
+		maxTimeMS = op.Options["$maxTimeMS"]
+		mu.Unlock()
+		return []bson.M{{"_id": 1}}
+	})
+
+	c := server.Dial(0).DB("test").C("people").WithTimeout(time.Second)
+
+	var doc bson.M
+	if err := c.Find(bson.M{"name": "Ale"}).One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	ms, ok := maxTimeMS.(int)
+	mu.Unlock()
+	if !ok || ms <= 0 || ms > 1000 {
+		t.Fatalf("expected maxTimeMS within the budget, got %#v", maxTimeMS)
+	}
+
+	if err := c.Find(bson.M{"name": "Ale"}).Timeout(time.Minute).SetMaxTime(10 * time.Millisecond).One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	ms = maxTimeMS.(int)
+	mu.Unlock()
+	if ms != 10 {
+		t.Fatalf("expected the lower maxTimeMS of the query, got %d", ms)
+	}
+
+	if _, err := c.Find(nil).Count(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected the server interruption as a timeout, got %v", err)
+	}
+}
+
+func TestApplyTimeout(t *testing.T) {
+	server := newFakeServer(t)
+
+	var (
+		mu  sync.Mutex
+		cmd bson.M
+	)
+	server.Handle(func(op *fakeOp) []bson.M {
+		mu.Lock()
+		cmd = op.Query
+		mu.Unlock()
+		return []bson.M{{"ok": 1, "value": bson.M{"_id": 1, "n": 2}, "lastErrorObject": bson.M{"n": 1, "updatedExisting": true}}}
+	})
+
+	c := server.Dial(0).DB("test").C("counters").WithTimeout(time.Second)
+
+	var doc bson.M
+	info, err := c.FindId(1).Sort("-n").Apply(mgo.Change{Update: bson.M{"$inc": bson.M{"n": 1}}, ReturnNew: true}, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Updated != 1 || doc["n"] != 2 {
+		t.Fatalf("expected the updated document, got %+v %v", info, doc)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	ms, ok := cmd["maxTimeMS"].(int64)
+	if cmd["findAndModify"] != "counters" || !ok || ms <= 0 || ms > 1000 {
+		t.Fatalf("expected findAndModify with maxTimeMS within the budget, got %v", cmd)
+	}
+	if cmd["new"] != true || cmd["sort"].(bson.M)["n"] != -1 {
+		t.Fatalf("expected the query options in the command, got %v", cmd)
+	}
+}
+
+func TestAttemptSocketTimeout(t *testing.T) {
+	server := newFakeServer(t)
+	server.Handle(func(op *fakeOp) []bson.M {
+		if _, ok := op.Query["count"]; ok {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return []bson.M{{"ok": 1, "n": 1}}
+	})
+
+	session := server.Dial(0)
+	c := session.DB("test").C("people").WithTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := c.Count(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("expected the attempt cut at the deadline, took %v", elapsed)
+	}
+
+	failures := session.RecentFailures()
+	if len(failures) != 1 || failures[0].Kind != TimeoutFailure || !errors.Is(failures[0].Err, ErrTimeout) {
+		t.Fatalf("expected the timeout recorded, got %+v", failures)
+	}
+}
@@ -0,0 +1,203 @@
+package mdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+//Timestamps names the fields set by Collection.WithTimestamps, empty names take the defaults
+type Timestamps struct {
+	CreatedAt string
+	UpdatedAt string
+	//CreatedBy and UpdatedBy are set to the actor of the collection context, see WithActor
+	CreatedBy string
+	UpdatedBy string
+	//Now returns the time of the write, time.Now by default
+	Now func() time.Time
+}
+
+type actorKey struct{}
+
+//WithActor returns a context carrying the actor stored in the createdBy and updatedBy fields
+func WithActor(ctx context.Context, actor interface{}) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+//ActorFromContext returns the actor set with WithActor
+func ActorFromContext(ctx context.Context) (interface{}, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+
+	actor := ctx.Value(actorKey{})
+	return actor, actor != nil
+}
+
+//WithContext returns the collection bound to ctx, which carries the actor of the writes
+func (c *Collection) WithContext(ctx context.Context) *Collection {
+	nc := c.clone()
+	nc.ctx = ctx
+	return nc
+}
+
+//WithTimestamps returns the collection setting createdAt and updatedAt,
+//and createdBy and updatedBy if the context has an actor, on Insert, Update, UpdateAll, Upsert and Query.Apply.
+//Operator updates set updatedAt, and createdAt with $setOnInsert when upserting.
+//Replacement documents only get updatedAt: they replace the stored createdAt with the one they carry,
+//so a replacement of a loaded document should keep its createdAt field.
+func (c *Collection) WithTimestamps(fields Timestamps) *Collection {
+	if fields.CreatedAt == "" {
+		fields.CreatedAt = "createdAt"
+	}
+	if fields.UpdatedAt == "" {
+		fields.UpdatedAt = "updatedAt"
+	}
+	if fields.CreatedBy == "" {
+		fields.CreatedBy = "createdBy"
+	}
+	if fields.UpdatedBy == "" {
+		fields.UpdatedBy = "updatedBy"
+	}
+	if fields.Now == nil {
+		fields.Now = time.Now
+	}
+
+	nc := c.clone()
+	nc.timestamps = &fields
+	return nc
+}
+
+//stampInserts sets the creation and update fields of the documents
+func (c *Collection) stampInserts(docs []interface{}) ([]interface{}, error) {
+	if c.timestamps == nil {
+		return docs, nil
+	}
+
+	now := c.timestamps.Now()
+	actor, hasActor := ActorFromContext(c.ctx)
+	stamped := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		d, err := toD(doc)
+		if err != nil {
+			return nil, err
+		}
+		stamped[i] = c.stampReplacement(d, now, actor, hasActor, true)
+	}
+
+	return stamped, nil
+}
+
+//stampUpdate sets the update fields, and the creation fields if upsert inserts the document
+func (c *Collection) stampUpdate(update interface{}, upsert bool) (interface{}, error) {
+	if c.timestamps == nil {
+		return update, nil
+	}
+
+	doc, err := toD(update)
+	if err != nil {
+		return nil, err
+	}
+
+	now := c.timestamps.Now()
+	actor, hasActor := ActorFromContext(c.ctx)
+	if !isOperatorUpdateD(doc) {
+		//a replacement can't tell an insert from a replace, createdAt is only set by $setOnInsert
+		return c.stampReplacement(doc, now, actor, hasActor, false), nil
+	}
+
+	set, err := operatorFields(doc, "$set")
+	if err != nil {
+		return nil, err
+	}
+	setOnInsert, err := operatorFields(doc, "$setOnInsert")
+	if err != nil {
+		return nil, err
+	}
+	currentDate, err := operatorFields(doc, "$currentDate")
+	if err != nil {
+		return nil, err
+	}
+
+	//a field can't be in two operators
+	unset := func(field string) bool {
+		return fieldIndex(set, field) < 0 && fieldIndex(setOnInsert, field) < 0 && fieldIndex(currentDate, field) < 0
+	}
+
+	fields := c.timestamps
+	if unset(fields.UpdatedAt) {
+		set = append(set, bson.DocElem{Name: fields.UpdatedAt, Value: now})
+	}
+	if hasActor && unset(fields.UpdatedBy) {
+		set = append(set, bson.DocElem{Name: fields.UpdatedBy, Value: actor})
+	}
+	if upsert {
+		if unset(fields.CreatedAt) {
+			setOnInsert = append(setOnInsert, bson.DocElem{Name: fields.CreatedAt, Value: now})
+		}
+		if hasActor && unset(fields.CreatedBy) {
+			setOnInsert = append(setOnInsert, bson.DocElem{Name: fields.CreatedBy, Value: actor})
+		}
+	}
+
+	doc = setField(doc, "$set", set)
+	if len(setOnInsert) > 0 {
+		doc = setField(doc, "$setOnInsert", setOnInsert)
+	}
+
+	return doc, nil
+}
+
+//stampReplacement sets the update fields of doc, and the missing creation fields if insert is set
+func (c *Collection) stampReplacement(doc bson.D, now time.Time, actor interface{}, hasActor, insert bool) bson.D {
+	fields := c.timestamps
+	doc = setField(doc, fields.UpdatedAt, now)
+	if hasActor {
+		doc = setField(doc, fields.UpdatedBy, actor)
+	}
+	if !insert {
+		return doc
+	}
+
+	if fieldIndex(doc, fields.CreatedAt) < 0 {
+		doc = append(doc, bson.DocElem{Name: fields.CreatedAt, Value: now})
+	}
+	if hasActor && fieldIndex(doc, fields.CreatedBy) < 0 {
+		doc = append(doc, bson.DocElem{Name: fields.CreatedBy, Value: actor})
+	}
+
+	return doc
+}
+
+//operatorFields returns the fields of the update operator, empty if it's missing
+func operatorFields(update bson.D, operator string) (bson.D, error) {
+	i := fieldIndex(update, operator)
+	if i < 0 {
+		return bson.D{}, nil
+	}
+
+	fields, ok := update[i].Value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("mdb: %s is %T, not a document", operator, update[i].Value)
+	}
+
+	return fields, nil
+}
+
+//prepareChange sets the timestamps and encrypts the fields of an Apply update
+func (c *Collection) prepareChange(change mgo.Change) (mgo.Change, error) {
+	if change.Remove || change.Update == nil {
+		return change, nil
+	}
+
+	update, err := c.prepareUpdate(change.Update, change.Upsert)
+	if err != nil {
+		return change, err
+	}
+	change.Update = update
+
+	return change, nil
+}
@@ -0,0 +1,90 @@
+package mdb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestTimestamps(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	created := now.Add(-time.Hour)
+	c := (&Collection{}).
+		WithTimestamps(Timestamps{Now: func() time.Time { return now }}).
+		WithContext(WithActor(context.Background(), "ale"))
+
+	docs, err := c.stampInserts([]interface{}{
+		struct {
+			Name string `bson:"name"`
+		}{"Ale"},
+		bson.M{"name": "Bob", "createdAt": created},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := docs[0].(bson.D).Map(), docs[1].(bson.D).Map()
+	if first["createdAt"] != now || first["updatedAt"] != now || first["createdBy"] != "ale" || first["updatedBy"] != "ale" {
+		t.Fatalf("expected creation and update fields, got %v", first)
+	}
+	if !second["createdAt"].(time.Time).Equal(created) {
+		t.Fatalf("expected the given createdAt to be kept, got %v", second)
+	}
+
+	update, err := c.stampUpdate(bson.M{"$set": bson.D{{"name", "Ale"}}, "$inc": bson.M{"n": 1}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, setOnInsert := update.(bson.D).Map()["$set"].(bson.D).Map(), update.(bson.D).Map()["$setOnInsert"].(bson.D).Map()
+	if set["name"] != "Ale" || set["updatedAt"] != now || set["updatedBy"] != "ale" {
+		t.Fatalf("expected updatedAt in $set, got %v", update)
+	}
+	if setOnInsert["createdAt"] != now || setOnInsert["createdBy"] != "ale" {
+		t.Fatalf("expected createdAt in $setOnInsert, got %v", update)
+	}
+
+	update, err = c.stampUpdate(bson.M{"$currentDate": bson.M{"updatedAt": true}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := update.(bson.D).Map()["$set"].(bson.D).Map()["updatedAt"]; ok {
+		t.Fatalf("expected a field of another operator to be left alone, got %v", update)
+	}
+	if _, ok := update.(bson.D).Map()["$setOnInsert"]; ok {
+		t.Fatalf("expected no $setOnInsert without upsert, got %v", update)
+	}
+
+	//replacements can't tell an insert from a replace, so even upserts don't reset createdAt
+	update, err = c.WithContext(context.Background()).stampUpdate(bson.M{"name": "Ale"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc := update.(bson.D).Map(); doc["updatedAt"] != now || doc["createdAt"] != nil || doc["updatedBy"] != nil {
+		t.Fatalf("expected a replacement with updatedAt only, got %v", doc)
+	}
+}
+
+func TestTimestampsKeepFieldOrder(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := (&Collection{}).WithTimestamps(Timestamps{Now: func() time.Time { return now }})
+
+	id := bson.D{{"a", 1}, {"b", 2}, {"c", 3}, {"d", 4}}
+	docs, err := c.stampInserts([]interface{}{bson.D{{"_id", id}, {"name", "Ale"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{"_id", id}, {"name", "Ale"}, {"updatedAt", now}, {"createdAt", now}}
+	if !reflect.DeepEqual(docs[0], expected) {
+		t.Fatalf("expected the field order kept, got %v", docs[0])
+	}
+
+	update, err := c.stampUpdate(bson.M{"$set": bson.M{"key": id}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set := update.(bson.D).Map()["$set"].(bson.D); !reflect.DeepEqual(set[0].Value, id) {
+		t.Fatalf("expected the compound value order kept, got %v", set)
+	}
+}
@@ -0,0 +1,377 @@
+package mdb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+var ErrInvalid = errors.New("mdb: invalid document")
+
+//Validator checks documents before Insert, Upsert and replacement updates
+type Validator interface {
+	Validate(doc bson.M) error
+}
+
+//FieldError is a failed check of a field, Path is empty for the document itself
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (e FieldError) String() string {
+	if e.Path == "" {
+		return e.Message
+	}
+
+	return e.Path + ": " + e.Message
+}
+
+//ValidationError lists the failed checks of a document,
+//it matches ErrInvalid with errors.Is
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		messages[i] = fe.String()
+	}
+
+	return "mdb: invalid document: " + strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+//WithValidator returns the collection rejecting the documents of Insert, Upsert and replacement updates
+//that v doesn't accept, before they are sent. Operator updates aren't validated.
+func (c *Collection) WithValidator(v Validator) *Collection {
+	nc := c.clone()
+	nc.validator = v
+	return nc
+}
+
+func (c *Collection) validateInserts(docs []interface{}) error {
+	if c.validator == nil {
+		return nil
+	}
+
+	for _, doc := range docs {
+		if err := c.validate(doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//validateUpdate validates replacement documents
+func (c *Collection) validateUpdate(update interface{}) error {
+	if c.validator == nil {
+		return nil
+	}
+
+	doc, err := toM(update)
+	if err != nil {
+		return err
+	}
+	if isOperatorUpdate(doc) {
+		return nil
+	}
+
+	return c.validator.Validate(doc)
+}
+
+func (c *Collection) validate(doc interface{}) error {
+	m, err := toM(doc)
+	if err != nil {
+		return err
+	}
+
+	return c.validator.Validate(m)
+}
+
+//JSONSchema is a validator in the $jsonSchema dialect of the server: bsonType, type, required,
+//properties, additionalProperties, enum, minimum, maximum, exclusiveMinimum, exclusiveMaximum,
+//minLength, maxLength, pattern, items, minItems and maxItems are checked.
+type JSONSchema bson.M
+
+func (s JSONSchema) Validate(doc bson.M) error {
+	var errs []FieldError
+	checkSchema(bson.M(s), doc, "", &errs)
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+
+	return nil
+}
+
+//ApplySchema sets the schema as the server-side validator of the collection with collMod,
+//or creates the collection with it. level and action are the validationLevel and validationAction,
+//the server defaults if empty.
+func (c *Collection) ApplySchema(schema JSONSchema, level, action string) error {
+	validator := bson.M{"$jsonSchema": bson.M(schema)}
+
+	cmd := bson.D{{"collMod", c.Name}, {"validator", validator}}
+	if level != "" {
+		cmd = append(cmd, bson.DocElem{Name: "validationLevel", Value: level})
+	}
+	if action != "" {
+		cmd = append(cmd, bson.DocElem{Name: "validationAction", Value: action})
+	}
+
+	err := c.Database.Run(cmd, nil)
+	if !IsNamespaceNotFound(err) {
+		return err
+	}
+
+	return c.Create(&mgo.CollectionInfo{Validator: validator, ValidationLevel: level, ValidationAction: action})
+}
+
+func checkSchema(schema bson.M, v interface{}, path string, errs *[]FieldError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if types, ok := schema["bsonType"]; ok && !matchesType(v, stringList(types), bsonTypeOf) {
+		fail("expected bsonType %v, got %s", types, bsonTypeOf(v))
+		return
+	}
+	if types, ok := schema["type"]; ok && !matchesType(v, stringList(types), jsonTypeOf) {
+		fail("expected type %v, got %s", types, jsonTypeOf(v))
+		return
+	}
+
+	if enum, ok := schema["enum"]; ok && !inEnum(v, enum) {
+		fail("%v is not one of %v", v, enum)
+	}
+
+	if n, ok := numberValue(v); ok {
+		exclusive := func(key string) bool {
+			b, _ := schema[key].(bool)
+			return b
+		}
+		if min, ok := numberValue(schema["minimum"]); ok && (n < min || exclusive("exclusiveMinimum") && n == min) {
+			fail("%v is less than the minimum %v", v, schema["minimum"])
+		}
+		if max, ok := numberValue(schema["maximum"]); ok && (n > max || exclusive("exclusiveMaximum") && n == max) {
+			fail("%v is greater than the maximum %v", v, schema["maximum"])
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		length := float64(len([]rune(v)))
+		if min, ok := numberValue(schema["minLength"]); ok && length < min {
+			fail("shorter than %v characters", schema["minLength"])
+		}
+		if max, ok := numberValue(schema["maxLength"]); ok && length > max {
+			fail("longer than %v characters", schema["maxLength"])
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				fail("invalid pattern %q: %v", pattern, err)
+			} else if !re.MatchString(v) {
+				fail("%q doesn't match %q", v, pattern)
+			}
+		}
+
+	case []interface{}:
+		length := float64(len(v))
+		if min, ok := numberValue(schema["minItems"]); ok && length < min {
+			fail("fewer than %v items", schema["minItems"])
+		}
+		if max, ok := numberValue(schema["maxItems"]); ok && length > max {
+			fail("more than %v items", schema["maxItems"])
+		}
+		if items, ok := schemaValue(schema["items"]); ok {
+			for i, item := range v {
+				checkSchema(items, item, joinPath(path, fmt.Sprint(i)), errs)
+			}
+		}
+
+	case bson.D:
+		checkSchema(schema, v.Map(), path, errs)
+
+	case bson.M:
+		for _, field := range stringList(schema["required"]) {
+			if _, ok := v[field]; !ok {
+				*errs = append(*errs, FieldError{Path: joinPath(path, field), Message: "required"})
+			}
+		}
+
+		properties, _ := schemaValue(schema["properties"])
+		for _, field := range sortedFields(v) {
+			property, ok := schemaValue(properties[field])
+			if !ok {
+				if allowed, ok := schema["additionalProperties"].(bool); ok && !allowed {
+					*errs = append(*errs, FieldError{Path: joinPath(path, field), Message: "not allowed"})
+				}
+				continue
+			}
+			checkSchema(property, v[field], joinPath(path, field), errs)
+		}
+	}
+}
+
+func schemaValue(v interface{}) (bson.M, bool) {
+	switch v := v.(type) {
+	case bson.M:
+		return v, true
+	case JSONSchema:
+		return bson.M(v), true
+	case map[string]interface{}:
+		return bson.M(v), true
+	}
+
+	return nil, false
+}
+
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		var list []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+
+	return nil
+}
+
+func sortedFields(m bson.M) []string {
+	fields := make([]string, 0, len(m))
+	for field := range m {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+func matchesType(v interface{}, types []string, typeOf func(v interface{}) string) bool {
+	actual := typeOf(v)
+	for _, t := range types {
+		if t == actual || t == "number" && isNumber(v) || t == "integer" && isInteger(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//bsonTypeOf returns the $jsonSchema bsonType alias of v
+func bsonTypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int, int32:
+		return "int"
+	case int64:
+		return "long"
+	case float64, float32:
+		return "double"
+	case bson.Decimal128:
+		return "decimal"
+	case bson.M, bson.D, map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case time.Time:
+		return "date"
+	case bson.ObjectId:
+		return "objectId"
+	case []byte, bson.Binary:
+		return "binData"
+	case bson.RegEx:
+		return "regex"
+	case bson.MongoTimestamp:
+		return "timestamp"
+	}
+
+	return fmt.Sprintf("%T", v)
+}
+
+//jsonTypeOf returns the JSON Schema type of v
+func jsonTypeOf(v interface{}) string {
+	switch t := bsonTypeOf(v); t {
+	case "bool":
+		return "boolean"
+	case "int", "long", "double", "decimal":
+		return "number"
+	default:
+		return t
+	}
+}
+
+func isNumber(v interface{}) bool {
+	_, ok := numberValue(v)
+	return ok
+}
+
+func isInteger(v interface{}) bool {
+	n, ok := numberValue(v)
+	return ok && n == math.Trunc(n)
+}
+
+func numberValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	}
+
+	return 0, false
+}
+
+func inEnum(v interface{}, enum interface{}) bool {
+	values, ok := enum.([]interface{})
+	if !ok {
+		for _, s := range stringList(enum) {
+			values = append(values, s)
+		}
+	}
+
+	for _, e := range values {
+		if n, ok := numberValue(v); ok {
+			if m, ok := numberValue(e); ok && n == m {
+				return true
+			}
+			continue
+		}
+		if fmt.Sprint(e) == fmt.Sprint(v) && bsonTypeOf(e) == bsonTypeOf(v) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,90 @@
+package mdb
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+var personSchema = JSONSchema{
+	"bsonType": "object",
+	"required": []string{"name", "age"},
+	"properties": bson.M{
+		"name": bson.M{"bsonType": "string", "minLength": 2},
+		"age":  bson.M{"bsonType": []string{"int", "long"}, "minimum": 0, "maximum": 150},
+		"role": bson.M{"enum": []interface{}{"admin", "user"}},
+		"tags": bson.M{"bsonType": "array", "items": bson.M{"bsonType": "string"}},
+	},
+	"additionalProperties": false,
+}
+
+func TestJSONSchema(t *testing.T) {
+	if err := personSchema.Validate(bson.M{"name": "Ale", "age": 30, "role": "user", "tags": []interface{}{"a"}}); err != nil {
+		t.Fatalf("expected a valid document, got %v", err)
+	}
+
+	err := personSchema.Validate(bson.M{"name": "A", "age": 200, "role": "root", "tags": []interface{}{"a", 1}, "extra": true})
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) || !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	paths := map[string]bool{}
+	for _, fe := range invalid.Errors {
+		paths[fe.Path] = true
+	}
+	for _, path := range []string{"name", "age", "role", "tags.1", "extra"} {
+		if !paths[path] {
+			t.Fatalf("expected an error on %s, got %v", path, invalid.Errors)
+		}
+	}
+
+	err = personSchema.Validate(bson.M{"name": "Ale"})
+	if !errors.As(err, &invalid) || len(invalid.Errors) != 1 || invalid.Errors[0].Path != "age" {
+		t.Fatalf("expected the missing field, got %v", err)
+	}
+}
+
+func TestValidatorAndApplySchema(t *testing.T) {
+	server := newFakeServer(t)
+
+	var (
+		mu       sync.Mutex
+		commands []bson.M
+	)
+	server.Handle(func(op *fakeOp) []bson.M {
+		mu.Lock()
+		commands = append(commands, op.Query)
+		mu.Unlock()
+		if _, ok := op.Query["collMod"]; ok {
+			return []bson.M{{"ok": 0, "code": 26, "errmsg": "ns does not exist"}}
+		}
+		return []bson.M{{"ok": 1}}
+	})
+
+	c := server.Dial(0).DB("test").C("people").WithValidator(personSchema)
+	if err := c.Insert(bson.M{"name": "Ale"}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected the insert to be rejected, got %v", err)
+	}
+	if err := c.Update(bson.M{"_id": 1}, bson.M{"$set": bson.M{"extra": 1}}); errors.Is(err, ErrInvalid) {
+		t.Fatal("expected operator updates not to be validated")
+	}
+
+	mu.Lock()
+	commands = nil
+	mu.Unlock()
+	if err := c.ApplySchema(personSchema, "moderate", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(commands) != 2 || commands[1]["create"] != "people" {
+		t.Fatalf("expected collMod then create, got %v", commands)
+	}
+	if validator, _ := commands[1]["validator"].(bson.M); validator["$jsonSchema"] == nil || commands[1]["validationLevel"] != "moderate" {
+		t.Fatalf("expected the schema in the create command, got %v", commands[1])
+	}
+}
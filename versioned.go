@@ -0,0 +1,300 @@
+package mdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const DefaultVersionField = "version"
+
+var ErrConflict = errors.New("mdb: version conflict")
+
+//ConflictError is returned when the document exists with another version,
+//it matches ErrConflict with errors.Is and IsConflict
+type ConflictError struct {
+	Id       interface{}
+	Expected int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("mdb: version conflict on %v, expected version %d", e.Id, e.Expected)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
+//WithVersionField returns the collection using field for optimistic concurrency, DefaultVersionField by default
+func (c *Collection) WithVersionField(field string) *Collection {
+	nc := c.clone()
+	nc.versionField = field
+	return nc
+}
+
+func (c *Collection) version() string {
+	if c.versionField == "" {
+		return DefaultVersionField
+	}
+
+	return c.versionField
+}
+
+//UpdateVersioned updates the document if its version is expectedVersion and increments the version.
+//update is either a replacement document or an update with operators.
+//A document without the version field has version 0.
+//It returns *ConflictError if the document has another version and mgo.ErrNotFound if it doesn't exist.
+func (c *Collection) UpdateVersioned(id interface{}, expectedVersion int64, update interface{}) error {
+	versioned, err := c.versionedUpdate(update, expectedVersion)
+	if err != nil {
+		return err
+	}
+
+	err = c.Update(bson.M{"_id": id, c.version(): versionSelector(expectedVersion)}, versioned)
+	if err == mgo.ErrNotFound {
+		return c.conflictOrNotFound(bson.M{"_id": id}, id, expectedVersion)
+	}
+
+	return err
+}
+
+//ApplyVersioned runs Apply if the matched document has expectedVersion and increments the version,
+//see Collection.UpdateVersioned. Upserts and removals are not versioned.
+func (q *Query) ApplyVersioned(expectedVersion int64, change mgo.Change, result interface{}) (*mgo.ChangeInfo, error) {
+	if change.Remove || change.Upsert {
+		return nil, errors.New("mdb: versioned apply doesn't support remove and upsert")
+	}
+
+	c := q.collection
+	update, err := c.versionedUpdate(change.Update, expectedVersion)
+	if err != nil {
+		return nil, err
+	}
+	change.Update = update
+
+	vq := *q
+	vq.spec.filter = bson.M{"$and": []interface{}{
+		nonNilFilter(q.spec.filter),
+		bson.M{c.version(): versionSelector(expectedVersion)},
+	}}
+	vq.originQuery = vq.spec.build(c.originCollection)
+
+	info, err := vq.Apply(change, result)
+	if err == mgo.ErrNotFound {
+		return nil, c.conflictOrNotFound(q.spec.filter, q.spec.filter, expectedVersion)
+	}
+
+	return info, err
+}
+
+//RetryVersioned loads the document into result, which must be a pointer to a document with the version field,
+//calls mutate to change it and replaces it if the version didn't change meanwhile.
+//On conflict it reloads and retries, up to maxAttempts times in total.
+//On success result holds the stored document with the new version.
+func (c *Collection) RetryVersioned(id interface{}, result interface{}, mutate func() error, maxAttempts int) error {
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if err := c.FindId(id).One(result); err != nil {
+			return err
+		}
+
+		version, err := documentVersion(result, c.version())
+		if err != nil {
+			return err
+		}
+
+		if err := mutate(); err != nil {
+			return err
+		}
+
+		_, lastErr = c.FindId(id).ApplyVersioned(version, mgo.Change{Update: result, ReturnNew: true}, result)
+		if !IsConflict(lastErr) {
+			return lastErr
+		}
+	}
+
+	return lastErr
+}
+
+//versionedUpdate adds the version increment to an operator update
+//or sets the next version in a replacement document
+func (c *Collection) versionedUpdate(update interface{}, expectedVersion int64) (bson.M, error) {
+	doc, err := toM(update)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isOperatorUpdate(doc) {
+		delete(doc, "_id")
+		doc[c.version()] = expectedVersion + 1
+		return doc, nil
+	}
+
+	for _, op := range []string{"$inc", "$set"} {
+		if doc[op] == nil {
+			continue
+		}
+		//the operator may be a bson.D or a struct in a bson.M update
+		fields, err := toM(doc[op])
+		if err != nil {
+			return nil, err
+		}
+		delete(fields, c.version())
+		doc[op] = fields
+	}
+
+	inc, _ := doc["$inc"].(bson.M)
+	if inc == nil {
+		inc = bson.M{}
+	}
+	inc[c.version()] = int64(1)
+	doc["$inc"] = inc
+
+	return doc, nil
+}
+
+func (c *Collection) conflictOrNotFound(filter interface{}, id interface{}, expectedVersion int64) error {
+	n, err := c.Find(filter).Limit(1).Count()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return mgo.ErrNotFound
+	}
+
+	return &ConflictError{Id: id, Expected: expectedVersion}
+}
+
+func versionSelector(version int64) interface{} {
+	if version == 0 {
+		//null matches a missing field
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+
+	return version
+}
+
+func documentVersion(doc interface{}, field string) (int64, error) {
+	m, err := toM(doc)
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := m[field].(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	}
+
+	return 0, fmt.Errorf("mdb: version field %s is %T", field, m[field])
+}
+
+func isOperatorUpdate(doc bson.M) bool {
+	for key := range doc {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func nonNilFilter(filter interface{}) interface{} {
+	if filter == nil {
+		return bson.M{}
+	}
+
+	return filter
+}
+
+//toM converts a document of any type to bson.M with a bson round trip
+func toM(doc interface{}) (bson.M, error) {
+	if m, ok := doc.(bson.M); ok {
+		return copyM(m), nil
+	}
+
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var m bson.M
+	if err := bson.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+//copyM copies m and nested bson.M values, so the caller's document isn't modified
+func copyM(m bson.M) bson.M {
+	c := make(bson.M, len(m))
+	for k, v := range m {
+		if nested, ok := v.(bson.M); ok {
+			v = copyM(nested)
+		}
+		c[k] = v
+	}
+
+	return c
+}
+
+//toD converts a document of any type to bson.D with a bson round trip,
+//keeping the field order of structs and bson.D values, which matters for compound _id values
+func toD(doc interface{}) (bson.D, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	//nested documents are bson.D too
+	var d bson.D
+	if err := bson.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+//fieldIndex returns the index of the field name in doc, -1 if it's missing
+func fieldIndex(doc bson.D, name string) int {
+	for i, e := range doc {
+		if e.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+//setField sets the field name of doc, appending it if missing
+func setField(doc bson.D, name string, value interface{}) bson.D {
+	if i := fieldIndex(doc, name); i >= 0 {
+		doc[i].Value = value
+		return doc
+	}
+
+	return append(doc, bson.DocElem{Name: name, Value: value})
+}
+
+func isOperatorUpdateD(doc bson.D) bool {
+	for _, e := range doc {
+		if strings.HasPrefix(e.Name, "$") {
+			return true
+		}
+	}
+
+	return false
+}
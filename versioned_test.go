@@ -0,0 +1,82 @@
+package mdb
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestVersionedUpdate(t *testing.T) {
+	c := &Collection{versionField: "rev"}
+
+	operators := bson.M{"$set": bson.M{"name": "Ale", "rev": 10}, "$inc": bson.M{"visits": 1}}
+	update, err := c.versionedUpdate(operators, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.M{"$set": bson.M{"name": "Ale"}, "$inc": bson.M{"visits": 1, "rev": int64(1)}}
+	if !reflect.DeepEqual(update, expected) {
+		t.Fatalf("unexpected operator update %v", update)
+	}
+	if _, ok := operators["$set"].(bson.M)["rev"]; !ok {
+		t.Fatal("caller's update must not be modified")
+	}
+
+	operators = bson.M{"$set": bson.D{{"name", "Ale"}, {"rev", 10}}, "$inc": bson.D{{"visits", 1}, {"rev", 5}}}
+	update, err = c.versionedUpdate(operators, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(update, expected) {
+		t.Fatalf("unexpected operator update with bson.D operators %v", update)
+	}
+
+	type person struct {
+		Id   int    `bson:"_id"`
+		Name string `bson:"name"`
+		Rev  int64  `bson:"rev"`
+	}
+	update, err = c.versionedUpdate(&person{Id: 1, Name: "Ale", Rev: 3}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(update, bson.M{"name": "Ale", "rev": int64(4)}) {
+		t.Fatalf("unexpected replacement %v", update)
+	}
+
+	if v, err := documentVersion(&person{Rev: 7}, "rev"); err != nil || v != 7 {
+		t.Fatalf("expected version 7, got %d %v", v, err)
+	}
+	if v, err := documentVersion(bson.M{}, "rev"); err != nil || v != 0 {
+		t.Fatalf("expected missing version to be 0, got %d %v", v, err)
+	}
+}
+
+func TestUpdateVersionedConflict(t *testing.T) {
+	server := newFakeServer(t)
+
+	var count int32 = 1
+	server.Handle(func(op *fakeOp) []bson.M {
+		if _, ok := op.Query["count"]; ok {
+			return []bson.M{{"ok": 1, "n": atomic.LoadInt32(&count)}}
+		}
+		return []bson.M{{"ok": 1}}
+	})
+
+	c := server.Dial(0).DB("test").C("people")
+
+	err := c.UpdateVersioned(1, 2, bson.M{"$set": bson.M{"name": "Ale"}})
+	var conflict *ConflictError
+	if !IsConflict(err) || !errors.As(err, &conflict) || conflict.Expected != 2 {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+
+	atomic.StoreInt32(&count, 0)
+	if err := c.UpdateVersioned(1, 2, bson.M{"$set": bson.M{"name": "Ale"}}); err != mgo.ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}